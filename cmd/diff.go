@@ -18,8 +18,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"diffchecker/internal/app/diff"
 	"diffchecker/internal/pkg/common"
+	"diffchecker/pkg/diffchecker"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -27,63 +39,317 @@ import (
 // diffCmd represents the diff command
 var diffCmd = &cobra.Command{
 	Use:   "diff",
-	Short: "Diff two MySQL compatible database tables data",
-	Long: `Diff two MySQL compatible database tables data
+	Short: "Diff two MySQL compatible, PostgreSQL or SQLite database tables data, or a csv or parquet file",
+	Long: `Diff two MySQL compatible, PostgreSQL or SQLite database tables data, or a csv or parquet file
 
-  database tables are compared and the differences results are stored in json output files.
+  database tables are compared and the differences results are stored in output files, json by
+  default or csv, markdown or junit with --format. The engine of each side is DFC_SRC_DRIVER and
+  DFC_TGT_DRIVER, mysql by default, the database file of sqlite is DBNAME; across engines use a
+  hash and chunk aggregate of both, e.g. --hash md5 --chunk-aggregate sum. A csv or parquet file
+  of DBNAME is diffed against the table of the other side, keyed and typed like it.
   `,
 	Run: func(cmd *cobra.Command, args []string) {
+		argConfig, _ := cmd.Flags().GetString("config")
+		if argConfig == "" {
+			common.ParseEnvVar()
+			runDiff(diffOptions(cmd))
+			return
+		}
+
+		jc := common.LoadJobConfig(argConfig)
 		common.ParseEnvVar()
 
-		// get all flag values
-		argDebug, _ := cmd.Flags().GetBool("debug")
-		argTrace, _ := cmd.Flags().GetBool("trace")
-		argLowerboundary, _ := cmd.Flags().GetString("lower-boundary")
-		argUpperboundary, _ := cmd.Flags().GetString("upper-boundary")
-		argTable, _ := cmd.Flags().GetString("table")
-		argSrcTable, _ := cmd.Flags().GetString("source-table")
-		argTgtTable, _ := cmd.Flags().GetString("target-table")
-		argChunksize, _ := cmd.Flags().GetInt("chunk-size")
-		argPKColumnSequence, _ := cmd.Flags().GetString("pkcolumn-sequence")
-		argIgnoreFields, _ := cmd.Flags().GetString("ignore-fields")
-		argAdditionalFilter, _ := cmd.Flags().GetString("additional-filter")
-		argOutputfile, _ := cmd.Flags().GetString("output")
-
-		// print all flag values
-		// fmt.Printf("argDebug: %v\n", argDebug)
-		// fmt.Printf("argTrace: %v\n", argTrace)
-		// fmt.Printf("argLowerboundary: %v\n", argLowerboundary)
-		// fmt.Printf("argUpperboundary: %v\n", argUpperboundary)
-		// fmt.Printf("argTable: %v\n", argTable)
-		// fmt.Printf("argSrcTable: %v\n", argSrcTable)
-		// fmt.Printf("argTgtTable: %v\n", argTgtTable)
-		// fmt.Printf("argChunksize: %v\n", argChunksize)
-		// fmt.Printf("argPKColumnSequence: %v\n", argPKColumnSequence)
-		// fmt.Printf("argIgnoreFields: %v\n", argIgnoreFields)
-		// fmt.Printf("argAdditionalFilter: %v\n", argAdditionalFilter)
-		// fmt.Printf("argOutputfile: %v\n", argOutputfile)
-		//
-		// fmt.Printf("EnvVar: %v\n", common.GetEnvVar())
-
-		// assign flag values to diff struct
-		diff.SetArgs(
-			argDebug,
-			argTrace,
-			argLowerboundary,
-			argUpperboundary,
-			argTable,
-			argSrcTable,
-			argTgtTable,
-			argChunksize,
-			argPKColumnSequence,
-			argIgnoreFields,
-			argAdditionalFilter,
-		)
-
-		diff.RunTable(argOutputfile)
+		changed := common.ChangedFlags(cmd.Flags())
+		common.ApplyFlagValues(cmd.Flags(), changed, jc.Diff, "diff")
+
+		if len(jc.Tables) == 0 {
+			runDiff(diffOptions(cmd))
+			return
+		}
+
+		if changed["table"] || changed["source-table"] || changed["target-table"] || changed["all-tables"] {
+			log.Fatalln("--table/-s/-t/--all-tables cannot be used with tables section of config file")
+		}
+
+		// run level options come from the diff section, the summary file is named after its output
+		opts := diffOptions(cmd)
+
+		for i, table := range jc.Tables {
+			section := fmt.Sprintf("tables[%d]", i)
+			for name := range table {
+				if runLevelFlags[name] {
+					log.Fatalf("%s applies to the whole run, move it from %s to diff section of config file", name, section)
+				}
+			}
+
+			common.ResetFlags(cmd.Flags(), changed)
+			common.ApplyFlagValues(cmd.Flags(), changed, jc.Diff, "diff")
+			common.ApplyFlagValues(cmd.Flags(), changed, table, section)
+
+			to := tableOptions(cmd)
+			if _, exists := table["output"]; !exists {
+				tablename := to.Table
+				if tablename == "" {
+					tablename = to.SourceTable
+				}
+				to.Output = diff.OutputFile(opts.Output, opts.Format, tablename)
+			}
+
+			opts.Tables = append(opts.Tables, to)
+		}
+
+		runDiff(opts)
 	},
 }
 
+// runLevelFlags are diff flags applying to all tables of a config file run
+var runLevelFlags = map[string]bool{
+	"config":          true,
+	"debug":           true,
+	"trace":           true,
+	"format":          true,
+	"src-concurrency": true,
+	"tgt-concurrency": true,
+	"all-tables":      true,
+	"include":         true,
+	"exclude":         true,
+	"table-map":       true,
+	"table-parallel":  true,
+
+	"sleep":               true,
+	"max-threads-running": true,
+	"replica":             true,
+	"max-replica-lag":     true,
+	"max-rows-per-second": true,
+
+	"consistent-snapshot": true,
+	"snapshot-position":   true,
+
+	"progress": true,
+}
+
+// splitFlag : split comma seperated flag value, empty value returns nil
+func splitFlag(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// tableOptions : table specific diff flag values
+func tableOptions(cmd *cobra.Command) (to diffchecker.TableOptions) {
+	// get all flag values
+	argLowerboundary, _ := cmd.Flags().GetString("lower-boundary")
+	argUpperboundary, _ := cmd.Flags().GetString("upper-boundary")
+	argTable, _ := cmd.Flags().GetString("table")
+	argSrcTable, _ := cmd.Flags().GetString("source-table")
+	argTgtTable, _ := cmd.Flags().GetString("target-table")
+	argChunksize, _ := cmd.Flags().GetInt("chunk-size")
+	argPKColumnSequence, _ := cmd.Flags().GetString("pkcolumn-sequence")
+	argKeyColumns, _ := cmd.Flags().GetString("key-columns")
+	argChunkIndex, _ := cmd.Flags().GetString("chunk-index")
+	argIgnoreFields, _ := cmd.Flags().GetString("ignore-fields")
+	argAdditionalFilter, _ := cmd.Flags().GetString("additional-filter")
+	argHash, _ := cmd.Flags().GetString("hash")
+	argRowEncoding, _ := cmd.Flags().GetString("row-encoding")
+	argChunkAggregate, _ := cmd.Flags().GetString("chunk-aggregate")
+	argBisect, _ := cmd.Flags().GetInt("bisect")
+	argRecheck, _ := cmd.Flags().GetInt("recheck")
+	argRecheckDelay, _ := cmd.Flags().GetDuration("recheck-delay")
+	argDiffColumns, _ := cmd.Flags().GetBool("diff-columns")
+	argDiffValues, _ := cmd.Flags().GetBool("diff-values")
+	argParallel, _ := cmd.Flags().GetInt("parallel")
+	argResume, _ := cmd.Flags().GetBool("resume")
+	argOutputfile, _ := cmd.Flags().GetString("output")
+
+	// print all flag values
+	// fmt.Printf("argLowerboundary: %v\n", argLowerboundary)
+	// fmt.Printf("argUpperboundary: %v\n", argUpperboundary)
+	// fmt.Printf("argTable: %v\n", argTable)
+	// fmt.Printf("argSrcTable: %v\n", argSrcTable)
+	// fmt.Printf("argTgtTable: %v\n", argTgtTable)
+	// fmt.Printf("argChunksize: %v\n", argChunksize)
+	// fmt.Printf("argPKColumnSequence: %v\n", argPKColumnSequence)
+	// fmt.Printf("argKeyColumns: %v\n", argKeyColumns)
+	// fmt.Printf("argChunkIndex: %v\n", argChunkIndex)
+	// fmt.Printf("argIgnoreFields: %v\n", argIgnoreFields)
+	// fmt.Printf("argAdditionalFilter: %v\n", argAdditionalFilter)
+	// fmt.Printf("argHash: %v\n", argHash)
+	// fmt.Printf("argRowEncoding: %v\n", argRowEncoding)
+	// fmt.Printf("argChunkAggregate: %v\n", argChunkAggregate)
+	// fmt.Printf("argBisect: %v\n", argBisect)
+	// fmt.Printf("argRecheck: %v\n", argRecheck)
+	// fmt.Printf("argRecheckDelay: %v\n", argRecheckDelay)
+	// fmt.Printf("argDiffColumns: %v\n", argDiffColumns)
+	// fmt.Printf("argDiffValues: %v\n", argDiffValues)
+	// fmt.Printf("argParallel: %v\n", argParallel)
+	// fmt.Printf("argResume: %v\n", argResume)
+	// fmt.Printf("argOutputfile: %v\n", argOutputfile)
+
+	var pkColumnSequence []int
+	for _, seq := range splitFlag(argPKColumnSequence) {
+		i, e := strconv.Atoi(seq)
+		if e != nil {
+			log.Fatalf("-S should be pk field positions seperated by commas, got %s\n", argPKColumnSequence)
+		}
+		pkColumnSequence = append(pkColumnSequence, i)
+	}
+
+	to = diffchecker.TableOptions{
+		Table:            argTable,
+		SourceTable:      argSrcTable,
+		TargetTable:      argTgtTable,
+		LowerBoundary:    splitFlag(argLowerboundary),
+		UpperBoundary:    splitFlag(argUpperboundary),
+		ChunkSize:        argChunksize,
+		PKColumnSequence: pkColumnSequence,
+		KeyColumns:       splitFlag(argKeyColumns),
+		ChunkIndex:       argChunkIndex,
+		IgnoreFields:     splitFlag(argIgnoreFields),
+		AdditionalFilter: argAdditionalFilter,
+		Hash:             argHash,
+		RowEncoding:      argRowEncoding,
+		ChunkAggregate:   argChunkAggregate,
+		Bisect:           argBisect,
+		Recheck:          argRecheck,
+		RecheckDelay:     argRecheckDelay,
+		DiffColumns:      argDiffColumns,
+		DiffValues:       argDiffValues,
+		Parallel:         argParallel,
+		Resume:           argResume,
+		Output:           argOutputfile,
+	}
+
+	return
+}
+
+// diffOptions : diff flag values and source/target DB settings from environment variables
+func diffOptions(cmd *cobra.Command) (opts diffchecker.Options) {
+	// get all flag values
+	argDebug, _ := cmd.Flags().GetBool("debug")
+	argTrace, _ := cmd.Flags().GetBool("trace")
+	argFormat, _ := cmd.Flags().GetString("format")
+	argSrcConcurrency, _ := cmd.Flags().GetInt("src-concurrency")
+	argTgtConcurrency, _ := cmd.Flags().GetInt("tgt-concurrency")
+	argAllTables, _ := cmd.Flags().GetBool("all-tables")
+	argIncludeTables, _ := cmd.Flags().GetString("include")
+	argExcludeTables, _ := cmd.Flags().GetString("exclude")
+	argTableMap, _ := cmd.Flags().GetString("table-map")
+	argTableParallel, _ := cmd.Flags().GetInt("table-parallel")
+	argSleep, _ := cmd.Flags().GetDuration("sleep")
+	argMaxThreadsRunning, _ := cmd.Flags().GetInt("max-threads-running")
+	argReplica, _ := cmd.Flags().GetString("replica")
+	argMaxReplicaLag, _ := cmd.Flags().GetDuration("max-replica-lag")
+	argMaxRowsPerSecond, _ := cmd.Flags().GetInt("max-rows-per-second")
+	argConsistentSnapshot, _ := cmd.Flags().GetBool("consistent-snapshot")
+	argSnapshotPosition, _ := cmd.Flags().GetBool("snapshot-position")
+	argProgress, _ := cmd.Flags().GetBool("progress")
+
+	// print all flag values
+	// fmt.Printf("argDebug: %v\n", argDebug)
+	// fmt.Printf("argTrace: %v\n", argTrace)
+	// fmt.Printf("argFormat: %v\n", argFormat)
+	// fmt.Printf("argSrcConcurrency: %v\n", argSrcConcurrency)
+	// fmt.Printf("argTgtConcurrency: %v\n", argTgtConcurrency)
+	// fmt.Printf("argAllTables: %v\n", argAllTables)
+	// fmt.Printf("argIncludeTables: %v\n", argIncludeTables)
+	// fmt.Printf("argExcludeTables: %v\n", argExcludeTables)
+	// fmt.Printf("argTableMap: %v\n", argTableMap)
+	// fmt.Printf("argTableParallel: %v\n", argTableParallel)
+	// fmt.Printf("argSleep: %v\n", argSleep)
+	// fmt.Printf("argMaxThreadsRunning: %v\n", argMaxThreadsRunning)
+	// fmt.Printf("argReplica: %v\n", argReplica)
+	// fmt.Printf("argMaxReplicaLag: %v\n", argMaxReplicaLag)
+	// fmt.Printf("argMaxRowsPerSecond: %v\n", argMaxRowsPerSecond)
+	// fmt.Printf("argConsistentSnapshot: %v\n", argConsistentSnapshot)
+	// fmt.Printf("argSnapshotPosition: %v\n", argSnapshotPosition)
+	// fmt.Printf("argProgress: %v\n", argProgress)
+	//
+	// fmt.Printf("EnvVar: %v\n", common.GetEnvVar())
+
+	var tableMap map[string]string
+	for _, pair := range splitFlag(argTableMap) {
+		srctgt := strings.Split(pair, ":")
+		if len(srctgt) != 2 {
+			log.Fatalf("--table-map should be pairs of source:target, got %s\n", pair)
+		}
+		if tableMap == nil {
+			tableMap = map[string]string{}
+		}
+		tableMap[srctgt[0]] = srctgt[1]
+	}
+
+	source, target := diff.EnvConnections(common.GetEnvVar())
+
+	// replica is reached with the source DB credentials and TLS settings
+	var replica diffchecker.Connection
+	if argReplica != "" {
+		host, port, e := net.SplitHostPort(argReplica)
+		if e != nil {
+			log.Fatalf("--replica should be host:port, got %s\n", argReplica)
+		}
+		replica = source
+		replica.Host, replica.Port, replica.Socket = host, port, ""
+	}
+
+	opts = diffchecker.Options{
+		TableOptions:   tableOptions(cmd),
+		Source:         source,
+		Target:         target,
+		Debug:          argDebug,
+		Trace:          argTrace,
+		Format:         argFormat,
+		SrcConcurrency: argSrcConcurrency,
+		TgtConcurrency: argTgtConcurrency,
+		AllTables:      argAllTables,
+		Include:        splitFlag(argIncludeTables),
+		Exclude:        splitFlag(argExcludeTables),
+		TableMap:       tableMap,
+		TableParallel:  argTableParallel,
+
+		Sleep:             argSleep,
+		MaxThreadsRunning: argMaxThreadsRunning,
+		Replica:           replica,
+		MaxReplicaLag:     argMaxReplicaLag,
+		MaxRowsPerSecond:  argMaxRowsPerSecond,
+
+		ConsistentSnapshot: argConsistentSnapshot,
+		SnapshotPosition:   argSnapshotPosition,
+
+		Progress: argProgress,
+	}
+
+	return
+}
+
+// runDiff : diff one table or all tables of opts, exits on error. The run summary is printed at
+// the end, of interrupted runs too. SIGINT/SIGTERM stops the run cleanly, a second signal exits at once
+func runDiff(opts diffchecker.Options) {
+	checker, e := diffchecker.New(opts)
+	if e != nil {
+		log.Fatalln(e)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop() // restore default signal handling
+	}()
+
+	rs, e := checker.Run(ctx)
+	if rs != nil {
+		rs.Print()
+	}
+	if errors.Is(e, context.Canceled) {
+		log.Println("interrupted, outputs are complete up to the last written chunk, continue with --resume")
+		os.Exit(130)
+	}
+	if e != nil {
+		log.Fatalln(e)
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(diffCmd)
 
@@ -103,11 +369,74 @@ func init() {
 	diffCmd.Flags().IntP("chunk-size", "c", 1000, "chunk size for tablename")
 	diffCmd.Flags().
 		StringP("pkcolumn-sequence", "S", "", "primary key fields sequence used for the chunk query, seperated by commas")
+	diffCmd.Flags().
+		String("key-columns", "", "unique NOT NULL columns used as primary key fields, seperated by commas. Defaults to the primary key, then the narrowest unique NOT NULL index")
+	diffCmd.Flags().
+		String("chunk-index", "", "index whose columns, followed by the primary key fields, are used as primary key fields for the chunk query")
 	diffCmd.Flags().
 		StringP("ignore-fields", "I", "", "ignore fields in the chunk query, seperated by commas")
 	diffCmd.Flags().
 		StringP("additional-filter", "F", "", "additional cutomized filter statement used in chunk query")
-	diffCmd.Flags().StringP("output", "o", "log.json", "output log file")
+	diffCmd.Flags().
+		StringP("hash", "H", "crc32", "row and chunk hash algorithm: "+strings.Join(diff.HashAlgorithmNames(), ", "))
+	diffCmd.Flags().
+		String("row-encoding", "concat-ws", "encoding of the row fields being hashed: "+strings.Join(diff.RowEncodingNames(), ", ")+". concat-ws skips NULLs and doesn't escape '#', null-safe marks NULLs and prefixes lengths")
+	diffCmd.Flags().
+		String("chunk-aggregate", "group-concat", "aggregate of the row hashes of a chunk: "+strings.Join(diff.ChunkAggregateNames(), ", ")+". bit-xor and sum are order independent and not bound by group_concat_max_len")
+	diffCmd.Flags().
+		Int("bisect", 0, "split mismatched chunks and hash the halves again down to this many rows before row level diff, 0 disables")
+	diffCmd.Flags().
+		Int("recheck", 0, "hash mismatched chunks again up to this many times before row level diff, e.g. to let a replica catch up")
+	diffCmd.Flags().
+		Duration("recheck-delay", 5*time.Second, "wait before each --recheck of a mismatched chunk")
+
+	diffCmd.Flags().Bool("diff-columns", false, "record the differing columns of update rows in the rowlevel file")
+	diffCmd.Flags().Lookup("diff-columns").NoOptDefVal = "true" // set to true with --diff-columns flag explicitly
+
+	diffCmd.Flags().Bool("diff-values", false, "record target (before) and source (after) values of the differing columns, implies --diff-columns")
+	diffCmd.Flags().Lookup("diff-values").NoOptDefVal = "true" // set to true with --diff-values flag explicitly
+
+	diffCmd.Flags().IntP("parallel", "p", 1, "number of chunks diffed concurrently")
+	diffCmd.Flags().
+		Int("src-concurrency", 0, "max concurrent chunk queries on source DB, defaults to --parallel")
+	diffCmd.Flags().
+		Int("tgt-concurrency", 0, "max concurrent chunk queries on target DB, defaults to --parallel")
+	diffCmd.Flags().StringP("output", "o", "", "output log file, defaults to log.<extension of --format>")
+	diffCmd.Flags().
+		String("format", "json", "format of the chunk and rowlevel outputs: "+strings.Join(diff.OutputFormatNames(), ", ")+". --resume and query read json only")
+
+	diffCmd.Flags().Bool("resume", false, "resume after the last chunk in output log file, appending to the outputs")
+	diffCmd.Flags().Lookup("resume").NoOptDefVal = "true" // set to true with --resume flag explicitly
+
+	diffCmd.Flags().BoolP("all-tables", "A", false, "diff all base tables of source DB, outputs are named after --output per table")
+	diffCmd.Flags().Lookup("all-tables").NoOptDefVal = "true" // set to true with -A, --all-tables flag explicitly
+	diffCmd.Flags().
+		String("include", "", "table name glob patterns to diff with --all-tables, seperated by commas")
+	diffCmd.Flags().
+		String("exclude", "", "table name glob patterns to skip with --all-tables, seperated by commas")
+	diffCmd.Flags().
+		String("table-map", "", "source:target table name pairs with --all-tables, seperated by commas")
+	diffCmd.Flags().Int("table-parallel", 1, "number of tables diffed concurrently with --all-tables")
+
+	diffCmd.Flags().Duration("sleep", 0, "sleep between chunks of each worker, e.g. 100ms")
+	diffCmd.Flags().
+		Int("max-threads-running", 0, "back off while Threads_running of source DB is above this, 0 disables")
+	diffCmd.Flags().
+		String("replica", "", "host:port of a replica of source DB (source DB credentials) checked for --max-replica-lag")
+	diffCmd.Flags().
+		Duration("max-replica-lag", 0, "back off while Seconds_Behind_Source of --replica is above this, e.g. 10s")
+	diffCmd.Flags().
+		Int("max-rows-per-second", 0, "max source rows diffed per second, 0 disables")
+
+	diffCmd.Flags().Bool("consistent-snapshot", false, "hash all chunks of each side in one START TRANSACTION WITH CONSISTENT SNAPSHOT, chunk queries of a side run one at a time")
+	diffCmd.Flags().Lookup("consistent-snapshot").NoOptDefVal = "true" // set to true with --consistent-snapshot flag explicitly
+
+	diffCmd.Flags().Bool("snapshot-position", false, "record binlog position and GTID set of source at its snapshot, takes FLUSH TABLES WITH READ LOCK briefly (RELOAD privilege)")
+	diffCmd.Flags().Lookup("snapshot-position").NoOptDefVal = "true" // set to true with --snapshot-position flag explicitly
+
+	diffCmd.Flags().Bool("progress", true, "show a progress line with rows diffed, throughput, mismatched chunks and ETA if stderr is a terminal, --progress=false turns it off")
+
+	diffCmd.Flags().String("config", "", "job config file (yaml), flags on command line override config file values")
 }
 
 // vim: fdm=marker fdc=2
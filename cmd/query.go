@@ -34,6 +34,12 @@ var queryCmd = &cobra.Command{
   based on diff output rowlevel data
   `,
 	Run: func(cmd *cobra.Command, args []string) {
+		argConfig, _ := cmd.Flags().GetString("config")
+		if argConfig != "" {
+			jc := common.LoadJobConfig(argConfig)
+			common.ApplyFlagValues(cmd.Flags(), common.ChangedFlags(cmd.Flags()), jc.Query, "query")
+		}
+
 		common.ParseEnvVar()
 
 		argInsert, _ := cmd.Flags().GetBool("insert")
@@ -78,6 +84,8 @@ func init() {
 
 	queryCmd.Flags().BoolP("delete", "d", false, "DELETE ONLY sql to target table")
 	queryCmd.Flags().Lookup("delete").NoOptDefVal = "true" // set to true with -d, --delete flag explicitly
+
+	queryCmd.Flags().String("config", "", "job config file (yaml), flags on command line override config file values")
 }
 
 // vim: fdm=marker fdc=2
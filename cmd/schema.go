@@ -0,0 +1,84 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"diffchecker/internal/app/schema"
+	"diffchecker/internal/pkg/common"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd represents the schema command
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Diff two MySQL compatible database table definitions",
+	Long: `Diff two MySQL compatible database table definitions
+
+  columns, primary and secondary indexes and table options are compared, differences are printed
+  as text or json.
+  `,
+	Run: func(cmd *cobra.Command, args []string) {
+		common.ParseEnvVar()
+
+		argTable, _ := cmd.Flags().GetString("table")
+		argSrcTable, _ := cmd.Flags().GetString("source-table")
+		argTgtTable, _ := cmd.Flags().GetString("target-table")
+		argAllTables, _ := cmd.Flags().GetBool("all-tables")
+		argFormat, _ := cmd.Flags().GetString("format")
+
+		// print all flag values
+		// fmt.Printf("argTable: %v\n", argTable)
+		// fmt.Printf("argSrcTable: %v\n", argSrcTable)
+		// fmt.Printf("argTgtTable: %v\n", argTgtTable)
+		// fmt.Printf("argAllTables: %v\n", argAllTables)
+		// fmt.Printf("argFormat: %v\n", argFormat)
+
+		// assign flag values to schema struct
+		e := schema.SetArgs(
+			argTable,
+			argSrcTable,
+			argTgtTable,
+			argAllTables,
+			argFormat,
+		)
+		if e != nil {
+			log.Fatalln(e)
+		}
+
+		if e := schema.DiffSchema(); e != nil {
+			log.Fatalln(e)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+
+	schemaCmd.Flags().String("table", "", "tablename (same for source/target) for schema diff")
+	schemaCmd.Flags().StringP("source-table", "s", "", "source tablename for schema diff")
+	schemaCmd.Flags().StringP("target-table", "t", "", "target tablename for schema diff")
+
+	schemaCmd.Flags().BoolP("all-tables", "A", false, "diff all base tables of source and target DB")
+	schemaCmd.Flags().Lookup("all-tables").NoOptDefVal = "true" // set to true with -A, --all-tables flag explicitly
+
+	schemaCmd.Flags().String("format", "text", "output format: text or json")
+}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,204 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// defaultChunkAggregate is the chunk aggregate of chunk logs written before --chunk-aggregate existed
+const defaultChunkAggregate = "group-concat"
+
+// aggregateExpr : sql aggregate of the row hash expression rowhash, hash is the --hash of the run
+type aggregateExpr func(hash func(expr string) string, rowhash string, pkcolumns []string) string
+
+// chunkAggregate : sql aggregate of the row hashes of a chunk as the chunk hash
+type chunkAggregate struct { // {{{
+	groupConcat bool // subject to group_concat_max_len
+	integer     bool // needs an integer --hash
+	expr        aggregateExpr
+} // }}}
+
+// chunkAggregates : MySQL aggregate of each --chunk-aggregate, other engines support some of them,
+// see dialect
+func chunkAggregates() map[string]chunkAggregate { // {{{
+	return map[string]chunkAggregate{
+		// order of the rows is up to the server, and may differ between source and target
+		"group-concat": {
+			groupConcat: true,
+			expr: func(hash func(string) string, rowhash string, pkcolumns []string) string {
+				return hash(`
+          GROUP_CONCAT(
+            ` + rowhash + `
+            )
+          `)
+			},
+		},
+		"group-concat-ordered": {
+			groupConcat: true,
+			expr: func(hash func(string) string, rowhash string, pkcolumns []string) string {
+				return hash(`
+          GROUP_CONCAT(
+            ` + rowhash + `
+            ORDER BY ` + strings.Join(pkcolumns, ",") + `
+            )
+          `)
+			},
+		},
+		// order independent, identical row hashes cancel out
+		"bit-xor": {
+			integer: true,
+			expr: func(hash func(string) string, rowhash string, pkcolumns []string) string {
+				return "BIT_XOR(" + rowhash + ")"
+			},
+		},
+		// order independent, exact DECIMAL sum of the 64 bit row hashes
+		"sum": {
+			integer: true,
+			expr: func(hash func(string) string, rowhash string, pkcolumns []string) string {
+				return "CAST(SUM(" + rowhash + ") AS DECIMAL(65,0))"
+			},
+		},
+	}
+} // }}}
+
+// ChunkAggregateNames : names accepted by --chunk-aggregate
+func ChunkAggregateNames() (names []string) { // {{{
+	for name := range chunkAggregates() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+} // }}}
+
+// mysqlChunkAggregates : expr of chunkAggregates
+func mysqlChunkAggregates() (exprs map[string]aggregateExpr) { // {{{
+	exprs = map[string]aggregateExpr{}
+	for name, aggregate := range chunkAggregates() {
+		exprs[name] = aggregate.expr
+	}
+
+	return
+} // }}}
+
+// hashTextWidths : max text length of the row hash of each --hash, as concatenated by GROUP_CONCAT
+func hashTextWidths() map[string]int64 { // {{{
+	return map[string]int64{
+		"crc32":       10, // 32 bit unsigned
+		"md5":         20, // 64 bit unsigned
+		"md5-full":    32,
+		"sha1":        20,
+		"sha1-full":   40,
+		"sha256":      20,
+		"sha256-full": 64,
+		"sha512-full": 128,
+		"dual":        10 + 1 + 32,
+	}
+} // }}}
+
+// integerHashes : --hash algorithms of unsigned integer row hashes
+func integerHashes() map[string]bool { // {{{
+	return map[string]bool{"crc32": true, "md5": true, "sha1": true, "sha256": true}
+} // }}}
+
+// groupConcatMaxLen : group_concat_max_len of the sessions of db, the connections share the DSN.
+// Unlimited on engines not truncating it
+func groupConcatMaxLen(ctx context.Context, db *DB) (maxlen int64, err error) { // {{{
+	query := db.dialect.groupConcatMaxLenQuery
+	if query == "" {
+		return math.MaxInt64, nil
+	}
+
+	err = db.QueryRowContext(ctx, query).Scan(&maxlen)
+	return
+} // }}}
+
+// groupConcatLength : length of the GROUP_CONCAT of rowcnt comma separated row hashes of hash
+func groupConcatLength(hash string, rowcnt int) int64 { // {{{
+	if rowcnt <= 0 {
+		return 0
+	}
+	return int64(rowcnt)*(hashTextWidths()[hash]+1) - 1
+} // }}}
+
+// groupConcatFit : c with group_concat_max_len of its sessions raised to fit the GROUP_CONCAT of a
+// whole chunk of each of args. Connections of engines not truncating GROUP_CONCAT stay as they are
+func groupConcatFit(c Connection, args ...envarg) Connection { // {{{
+	d, e := c.dialect()
+	if e != nil || d.groupConcatMaxLenQuery == "" {
+		return c
+	}
+
+	var length int64
+	for _, arg := range args {
+		if l := groupConcatLength(arg.ArgHash, arg.ArgChunksize); chunkAggregates()[arg.ArgChunkAggregate].groupConcat && l > length {
+			length = l
+		}
+	}
+
+	cfg, e := c.mysqlConfig()
+	if e != nil { // reported when connected
+		return c
+	}
+	if maxlen, _ := strconv.ParseInt(cfg.Params["group_concat_max_len"], 10, 64); length <= maxlen {
+		return c
+	}
+
+	params := map[string]string{"group_concat_max_len": strconv.FormatInt(length, 10)}
+	for name, value := range c.Params {
+		if name != "group_concat_max_len" {
+			params[name] = value
+		}
+	}
+	c.Params = params
+
+	return c
+} // }}}
+
+// groupConcatGuard : fail the chunk if the GROUP_CONCAT of its rowcnt row hashes could exceed
+// group_concat_max_len of the side. Run raises it to fit the chunk size, the server may cap it
+// though, and MySQL truncates with a warning only: a truncated chunk hash matches whatever rows
+// follow the cut
+func (t *pkTable) groupConcatGuard(issrc bool, rowcnt int) error { // {{{
+	if !chunkAggregates()[t.arg.ArgChunkAggregate].groupConcat || rowcnt == 0 {
+		return nil
+	}
+
+	side, maxlen := "target", t.arg.run.groupConcatMaxLen.tgt
+	if issrc {
+		side, maxlen = "source", t.arg.run.groupConcatMaxLen.src
+	}
+
+	if length := groupConcatLength(t.arg.ArgHash, rowcnt); length > maxlen {
+		return fmt.Errorf(
+			"GROUP_CONCAT of %d row hashes may reach %d bytes, above group_concat_max_len %d of %s DB, the chunk hash could be truncated. "+
+				"lower -c, raise the max group_concat_max_len of the server or use --chunk-aggregate bit-xor/sum",
+			rowcnt, length, maxlen, side,
+		)
+	}
+	return nil
+} // }}}
+
+// vim: fdm=marker fdc=2
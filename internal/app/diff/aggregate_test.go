@@ -0,0 +1,142 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGroupConcatLength(t *testing.T) { // {{{
+	tests := []struct {
+		hash   string
+		rowcnt int
+		want   int64
+	}{
+		{"crc32", 0, 0},
+		{"crc32", 1, 10},
+		{"crc32", 1000, 10999},
+		{"md5", 1000, 20999},
+		{"sha512-full", 2, 257},
+		{"dual", 3, 131},
+	}
+
+	for _, tt := range tests {
+		if got := groupConcatLength(tt.hash, tt.rowcnt); got != tt.want {
+			t.Errorf("groupConcatLength(%s, %d) = %d, want %d", tt.hash, tt.rowcnt, got, tt.want)
+		}
+	}
+
+	for name := range hashAlgorithms() {
+		if hashTextWidths()[name] == 0 {
+			t.Errorf("no text width of --hash %s", name)
+		}
+	}
+} // }}}
+
+func TestGroupConcatFit(t *testing.T) { // {{{
+	crc32 := envarg{ArgHash: "crc32", ArgChunksize: 1000, ArgChunkAggregate: "group-concat"}
+	big := envarg{ArgHash: "sha512-full", ArgChunksize: 100000, ArgChunkAggregate: "group-concat-ordered"}
+	bitxor := envarg{ArgHash: "md5", ArgChunksize: 10000000, ArgChunkAggregate: "bit-xor"}
+
+	tests := []struct {
+		name string
+		c    Connection
+		args []envarg
+		want map[string]string // Params of the connection
+	}{
+		{"default fits", Connection{}, []envarg{crc32}, nil},
+		{"raised for the biggest table", Connection{}, []envarg{crc32, big}, map[string]string{"group_concat_max_len": "12899999"}},
+		{"other aggregates ignored", Connection{}, []envarg{crc32, bitxor}, nil},
+		{
+			"params kept",
+			Connection{Params: map[string]string{"group_concat_max_len": "100", "charset": "utf8mb4"}},
+			[]envarg{crc32},
+			map[string]string{"group_concat_max_len": "10999", "charset": "utf8mb4"},
+		},
+		{
+			"bigger setting kept",
+			Connection{Params: map[string]string{"group_concat_max_len": "20000000"}},
+			[]envarg{big},
+			map[string]string{"group_concat_max_len": "20000000"},
+		},
+		{
+			"DSN setting raised",
+			Connection{DSN: "root@tcp(db1:3306)/src?group_concat_max_len=100"},
+			[]envarg{crc32},
+			map[string]string{"group_concat_max_len": "10999"},
+		},
+		{"not truncating engine", Connection{Driver: "sqlite", DBName: "fixture.db"}, []envarg{big}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params map[string]string
+			for name, value := range tt.c.Params {
+				if params == nil {
+					params = map[string]string{}
+				}
+				params[name] = value
+			}
+
+			got := groupConcatFit(tt.c, tt.args...)
+			if !reflect.DeepEqual(got.Params, tt.want) {
+				t.Errorf("Params = %v, want %v", got.Params, tt.want)
+			}
+			// the Params of the caller are shared, they are replaced, not changed
+			if !reflect.DeepEqual(tt.c.Params, params) {
+				t.Errorf("Params of the caller changed to %v, want %v", tt.c.Params, params)
+			}
+		})
+	}
+} // }}}
+
+func TestGroupConcatGuard(t *testing.T) { // {{{
+	tests := []struct {
+		name      string
+		aggregate string
+		hash      string
+		issrc     bool
+		rowcnt    int
+		wantErr   string
+	}{
+		{"fits", "group-concat", "crc32", true, 1000, ""},
+		{"at the limit", "group-concat", "crc32", true, 1818, ""}, // 1818*11-1 = 19997
+		{"source above", "group-concat", "crc32", true, 1819, "above group_concat_max_len 19998 of source DB"},
+		{"target above", "group-concat-ordered", "md5-full", false, 1000, "above group_concat_max_len 30000 of target DB"},
+		{"no rows", "group-concat", "sha512-full", true, 0, ""},
+		{"not group concat", "bit-xor", "crc32", true, 1000000, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(runner)
+			r.groupConcatMaxLen.src, r.groupConcatMaxLen.tgt = 19998, 30000
+			pt := &pkTable{arg: &envarg{ArgHash: tt.hash, ArgChunkAggregate: tt.aggregate, run: r}}
+
+			e := pt.groupConcatGuard(tt.issrc, tt.rowcnt)
+
+			if tt.wantErr == "" && e != nil || tt.wantErr != "" && (e == nil || !strings.Contains(e.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %q", e, tt.wantErr)
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
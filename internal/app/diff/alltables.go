@@ -0,0 +1,176 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// GetBaseTables returns base table names of the connected database
+func GetBaseTables(db *DB) (tables []string, err error) { // {{{
+	result, err := db.Query(db.dialect.baseTablesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(result, &err)
+
+	for result.Next() {
+		var tablename string
+		if err = result.Scan(&tablename); err != nil {
+			return nil, err
+		}
+		tables = append(tables, tablename)
+	}
+
+	return tables, result.Err()
+} // }}}
+
+// matchTableName : --include (all tables if empty) and --exclude glob patterns on source table
+// name, patterns are validated by newArgs
+func matchTableName(table string, o *Options) bool { // {{{
+	matchAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, table); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(o.Include) > 0 && !matchAny(o.Include) {
+		return false
+	}
+
+	return !matchAny(o.Exclude)
+} // }}}
+
+// selectTables : source/target table pairs to diff, tables that cannot be diffed are returned as
+// skipped
+func selectTables(dbSrc *DB, dbTgt *DB, o *Options, log *logrus.Logger) (tables []*TableSummary, err error) { // {{{
+	basetables, err := GetBaseTables(dbSrc)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugln(basetables)
+
+	for _, tablesrc := range basetables {
+		if !matchTableName(tablesrc, o) {
+			continue
+		}
+
+		tabletgt, exists := o.TableMap[tablesrc]
+		if !exists {
+			tabletgt = tablesrc
+		}
+
+		ts := &TableSummary{
+			TableSrc: tablesrc,
+			TableTgt: tabletgt,
+		}
+		tables = append(tables, ts)
+
+		allpkcolumns, e := queryPKColumns(dbSrc, tablesrc, nil)
+		if e != nil {
+			ts.Status, ts.Reason = "skipped", e.Error()
+		} else if len(allpkcolumns) > 4 {
+			ts.Status, ts.Reason = "skipped", "5 or more composite pk table is not supported"
+		} else if columns, e := GetTableColumns(dbTgt, tabletgt); e != nil {
+			return nil, e
+		} else if len(columns) == 0 {
+			ts.Status, ts.Reason = "skipped", fmt.Sprintf("target table %s not found", tabletgt)
+		}
+
+		if ts.Status == "skipped" {
+			log.Warnf("skip table %s: %s\n", tablesrc, ts.Reason)
+		}
+	}
+
+	return
+} // }}}
+
+// tableRun : args and outputfile of one table of the run
+type tableRun struct { // {{{
+	arg        envarg
+	outputfile string
+	summary    *TableSummary // set before the run for skipped tables
+} // }}}
+
+// runTables : diff tables tableparallel at a time, returns totals of all tables. A table failing
+// the run cancels the tables after it, they are summarized as incomplete
+func runTables(start time.Time, dbSrc *DB, dbTgt *DB, runs []*tableRun, tableparallel int) (rs *RunSummary) { // {{{
+	if tableparallel < 1 {
+		tableparallel = 1
+	}
+
+	var waitgroup sync.WaitGroup
+	tableslots := make(chan struct{}, tableparallel)
+
+	for _, tr := range runs {
+		if tr.summary != nil {
+			continue
+		}
+
+		waitgroup.Add(1)
+		go func(tr *tableRun) {
+			defer waitgroup.Done()
+
+			tableslots <- struct{}{}
+			defer func() {
+				<-tableslots
+			}()
+
+			if tr.arg.run.ctx.Err() != nil {
+				return
+			}
+			ts, e := runTable(dbSrc, dbTgt, &tr.arg, tr.outputfile)
+			if e != nil {
+				tr.arg.run.fail(e)
+				return
+			}
+			tr.summary = ts
+		}(tr)
+	}
+
+	waitgroup.Wait()
+
+	tables := make([]*TableSummary, len(runs))
+	for i, tr := range runs {
+		tables[i] = tr.summary
+		if tr.summary == nil { // failed or not started
+			tables[i] = &TableSummary{
+				TableSrc:   tr.arg.ArgSrcTable,
+				TableTgt:   tr.arg.ArgTgtTable,
+				Status:     "incomplete",
+				Outputfile: tr.outputfile,
+				Args:       newTableArgs(&tr.arg),
+			}
+		}
+	}
+
+	rs = newRunSummary(start, tables)
+
+	return
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,185 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TableArgs : json marshalable effective args of a table run after defaults and validation, keys
+// are the long flag names of the diff command
+type TableArgs struct { // {{{
+	LowerBoundary    []string `json:"lower-boundary,omitempty"`
+	UpperBoundary    []string `json:"upper-boundary,omitempty"`
+	ChunkSize        int      `json:"chunk-size"`
+	PKColumnSequence []string `json:"pkcolumn-sequence,omitempty"`
+	KeyColumns       []string `json:"key-columns,omitempty"` // resolved from --chunk-index too
+	ChunkIndex       string   `json:"chunk-index,omitempty"`
+	IgnoreFields     []string `json:"ignore-fields,omitempty"`
+	AdditionalFilter string   `json:"additional-filter,omitempty"`
+	Hash             string   `json:"hash"`
+	RowEncoding      string   `json:"row-encoding"`
+	ChunkAggregate   string   `json:"chunk-aggregate"`
+	Bisect           int      `json:"bisect"`
+	Recheck          int      `json:"recheck"`
+	RecheckDelay     string   `json:"recheck-delay"`
+	DiffColumns      bool     `json:"diff-columns"`
+	DiffValues       bool     `json:"diff-values"`
+	Parallel         int      `json:"parallel"`
+	SrcConcurrency   int      `json:"src-concurrency"`
+	TgtConcurrency   int      `json:"tgt-concurrency"`
+	Resume           bool     `json:"resume"`
+	Format           string   `json:"format"`
+} // }}}
+
+// RunArgs : json marshalable effective run level args, connections without password
+type RunArgs struct { // {{{
+	Source             string            `json:"source"`
+	Target             string            `json:"target"`
+	AllTables          bool              `json:"all-tables"`
+	Include            []string          `json:"include,omitempty"`
+	Exclude            []string          `json:"exclude,omitempty"`
+	TableMap           map[string]string `json:"table-map,omitempty"`
+	TableParallel      int               `json:"table-parallel"`
+	Sleep              string            `json:"sleep"`
+	MaxThreadsRunning  int               `json:"max-threads-running"`
+	Replica            string            `json:"replica,omitempty"`
+	MaxReplicaLag      string            `json:"max-replica-lag"`
+	MaxRowsPerSecond   int               `json:"max-rows-per-second"`
+	ConsistentSnapshot bool              `json:"consistent-snapshot"`
+	SnapshotPosition   bool              `json:"snapshot-position"`
+	Progress           bool              `json:"progress"`
+	Format             string            `json:"format"`
+	Output             string            `json:"output"`
+} // }}}
+
+// nonEmpty : list arg without the one empty value of orEmpty
+func nonEmpty(values []string) []string { // {{{
+	if len(values) == 1 && values[0] == "" {
+		return nil
+	}
+	return values
+} // }}}
+
+// newTableArgs : effective args of a table run
+func newTableArgs(arg *envarg) *TableArgs { // {{{
+	return &TableArgs{
+		LowerBoundary:    nonEmpty(arg.ArgLowerBoundary),
+		UpperBoundary:    nonEmpty(arg.ArgUpperBoundary),
+		ChunkSize:        arg.ArgChunksize,
+		PKColumnSequence: nonEmpty(arg.ArgPKColumnSequence),
+		KeyColumns:       arg.ArgKeyColumns,
+		ChunkIndex:       arg.ArgChunkIndex,
+		IgnoreFields:     nonEmpty(arg.ArgIgnoreFields),
+		AdditionalFilter: arg.ArgAdditionalFilter,
+		Hash:             arg.ArgHash,
+		RowEncoding:      arg.ArgRowEncoding,
+		ChunkAggregate:   arg.ArgChunkAggregate,
+		Bisect:           arg.ArgBisect,
+		Recheck:          arg.ArgRecheck,
+		RecheckDelay:     arg.ArgRecheckDelay.String(),
+		DiffColumns:      arg.ArgDiffColumns,
+		DiffValues:       arg.ArgDiffValues,
+		Parallel:         arg.ArgParallel,
+		SrcConcurrency:   arg.ArgSrcConcurrency,
+		TgtConcurrency:   arg.ArgTgtConcurrency,
+		Resume:           arg.ArgResume,
+		Format:           arg.ArgFormat,
+	}
+} // }}}
+
+// newRunArgs : effective run level args of o
+func newRunArgs(o *Options) *RunArgs { // {{{
+	ra := &RunArgs{
+		Source:             o.Source.describe(),
+		Target:             o.Target.describe(),
+		AllTables:          o.AllTables,
+		Include:            o.Include,
+		Exclude:            o.Exclude,
+		TableMap:           o.TableMap,
+		TableParallel:      o.TableParallel,
+		Sleep:              o.Sleep.String(),
+		MaxThreadsRunning:  o.MaxThreadsRunning,
+		MaxReplicaLag:      o.MaxReplicaLag.String(),
+		MaxRowsPerSecond:   o.MaxRowsPerSecond,
+		ConsistentSnapshot: o.ConsistentSnapshot,
+		SnapshotPosition:   o.SnapshotPosition,
+		Progress:           o.Progress,
+		Format:             o.Format,
+		Output:             o.Output,
+	}
+	if ra.TableParallel < 1 {
+		ra.TableParallel = 1
+	}
+	if o.Replica.Host != "" {
+		ra.Replica = o.Replica.describe()
+	}
+	return ra
+} // }}}
+
+// argsLine : args as --flag=value pairs sorted by flag, unset args are left out. args are the
+// plain json structs of newRunArgs and newTableArgs, which always encode
+func argsLine(args any) string { // {{{
+	b, _ := json.Marshal(args)
+	values := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber() // keep numbers like 1000000 as is
+	_ = decoder.Decode(&values)
+
+	var flags []string
+	for name, value := range values {
+		switch v := value.(type) {
+		case bool:
+			if v {
+				flags = append(flags, "--"+name)
+			}
+			continue
+		case json.Number:
+			if v == "0" {
+				continue
+			}
+		case string:
+			if v == "" || v == "0s" {
+				continue
+			}
+		case []any:
+			var items []string
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			value = strings.Join(items, ",")
+		case map[string]any:
+			var pairs []string
+			for k, item := range v {
+				pairs = append(pairs, k+":"+fmt.Sprint(item))
+			}
+			sort.Strings(pairs)
+			value = strings.Join(pairs, ",")
+		}
+		flags = append(flags, fmt.Sprintf("--%s=%v", name, value))
+	}
+	sort.Strings(flags)
+
+	return strings.Join(flags, " ")
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,358 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runner : state shared by the tables and goroutines of a run
+type runner struct { // {{{
+	ctx      context.Context
+	cancel   context.CancelFunc
+	log      *logrus.Logger // logger of the run, Options.Logger or newLogger
+	chunkLog *logrus.Logger // log without the caller, for the chunk log lines of TableLogChunk
+	slots    chunkSlots
+	throttle *throttler
+	snapshot snapshotConns // nil connections without --consistent-snapshot
+	progress *progress     // nil without --progress on a terminal
+	once     sync.Once
+	err      error    // first error of the run
+	connids  sync.Map // connection id of each driver connection of the pools, see connectionID
+
+	groupConcatMaxLen struct{ src, tgt int64 } // group_concat_max_len of each side for groupConcatGuard
+} // }}}
+
+// newRunner : runner of a run cancelled with ctx, logging to log
+func newRunner(ctx context.Context, log *logrus.Logger) (r *runner) { // {{{
+	r = &runner{log: log}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.chunkLog = &logrus.Logger{
+		Out:       log.Out,
+		Hooks:     log.Hooks,
+		Formatter: log.Formatter,
+		Level:     log.GetLevel(),
+		ExitFunc:  log.ExitFunc,
+	}
+
+	return
+} // }}}
+
+// fail : record the first error of the run and cancel the rest of it. Errors of queries killed by
+// a cancelled run are not recorded
+func (r *runner) fail(err error) { // {{{
+	r.once.Do(func() {
+		if r.ctx.Err() == nil {
+			r.err = err
+		}
+	})
+	r.cancel()
+} // }}}
+
+// errGroup : goroutines waited together, Wait returns the first error of them
+type errGroup struct { // {{{
+	waitgroup sync.WaitGroup
+	once      sync.Once
+	err       error
+} // }}}
+
+// Go : run f in a goroutine of the group
+func (g *errGroup) Go(f func() error) { // {{{
+	g.waitgroup.Add(1)
+	go func() {
+		defer g.waitgroup.Done()
+		if e := f(); e != nil {
+			g.once.Do(func() {
+				g.err = e
+			})
+		}
+	}()
+} // }}}
+
+// Wait : wait for all goroutines of the group, returns the first error of them
+func (g *errGroup) Wait() error { // {{{
+	g.waitgroup.Wait()
+	return g.err
+} // }}}
+
+// closeErr : close c, deferred by functions returning err. The error of Close is returned unless
+// there is an error already
+func closeErr(c io.Closer, err *error) { // {{{
+	if e := c.Close(); e != nil && *err == nil {
+		*err = e
+	}
+} // }}}
+
+// Checker : validated options of a diff run, see New
+type Checker struct { // {{{
+	opts Options
+	log  *logrus.Logger
+	arg  envarg      // args of every table with AllTables
+	runs []*tableRun // single table or Options.Tables, tables of AllTables are selected by Run
+} // }}}
+
+// New : validate opts, nothing is connected or written until Run
+func New(opts Options) (c *Checker, err error) { // {{{
+	if opts.Format == "" {
+		opts.Format = defaultOutputFormat
+	}
+	opts.TableOptions.setDefaults(opts.Format)
+	c = &Checker{opts: opts, log: opts.Logger}
+	if c.log == nil {
+		c.log = newLogger(opts.Debug, opts.Trace)
+	}
+
+	if _, _, e := opts.Source.connector(); e != nil {
+		return nil, fmt.Errorf("source: %w", e)
+	}
+	if _, _, e := opts.Target.connector(); e != nil {
+		return nil, fmt.Errorf("target: %w", e)
+	}
+	if opts.Replica.Host != "" {
+		if _, _, e := opts.Replica.connector(); e != nil {
+			return nil, fmt.Errorf("replica: %w", e)
+		}
+	}
+	// a file is one table, loaded with the definition of the table of the other side
+	if opts.Source.IsFile() && opts.Target.IsFile() {
+		return nil, errors.New("source and target are both files, one of them should be a DB with the table definition")
+	}
+	if (opts.Source.IsFile() || opts.Target.IsFile()) && (opts.AllTables || len(opts.Tables) > 1) {
+		return nil, errors.New("a csv or parquet file is one table, --all-tables and more than one table are not supported")
+	}
+
+	if len(opts.Tables) == 0 {
+		arg, e := newArgs(&opts.TableOptions, &opts)
+		if e != nil {
+			return nil, e
+		}
+		c.arg = arg
+		if !opts.AllTables {
+			c.runs = append(c.runs, &tableRun{arg: arg, outputfile: opts.Output})
+		}
+		return
+	}
+
+	if opts.AllTables {
+		return nil, errors.New("--all-tables cannot be used with tables")
+	}
+
+	// every table is validated before any table runs
+	for i := range opts.Tables {
+		to := opts.Tables[i]
+		to.setDefaults(opts.Format)
+
+		arg, e := newArgs(&to, &opts)
+		if e != nil {
+			return nil, fmt.Errorf("tables[%d]: %w", i, e)
+		}
+
+		for _, run := range c.runs {
+			if run.outputfile == to.Output {
+				return nil, fmt.Errorf("tables %s and %s have the same output %s", run.arg.ArgSrcTable, arg.ArgSrcTable, to.Output)
+			}
+		}
+		c.runs = append(c.runs, &tableRun{arg: arg, outputfile: to.Output})
+	}
+
+	return
+} // }}}
+
+// Run : diff the tables of the options until done or ctx is cancelled. Returns totals of every
+// table, and the first error that stopped the run or ctx.Err(). Cancelling ctx kills the chunk
+// queries in flight, chunks diffed so far are written and the tables are incomplete with the
+// boundary to --resume from. The totals, slowest chunks and effective args are also written to the
+// json summary file named after Options.Output
+func (c *Checker) Run(ctx context.Context) (rs *RunSummary, err error) { // {{{
+	start := time.Now()
+	o := &c.opts
+
+	run := newRunner(ctx, c.log)
+	defer run.cancel()
+
+	// sessions fit the GROUP_CONCAT of a whole chunk of every table
+	args := []envarg{c.arg}
+	for _, tr := range c.runs {
+		args = append(args, tr.arg)
+	}
+	dbSrc, err := InitializeDBSettings(groupConcatFit(o.Source, args...))
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(dbSrc, &err)
+	dbTgt, err := InitializeDBSettings(groupConcatFit(o.Target, args...))
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(dbTgt, &err)
+
+	for _, tr := range c.runs {
+		if err = loadFileTable(run.ctx, dbSrc, dbTgt, &tr.arg, run.log); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.ConsistentSnapshot {
+		if run.snapshot.src, err = openSnapshot(run.ctx, dbSrc, o.SnapshotPosition); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if e := run.snapshot.src.close(run.ctx); e != nil && err == nil {
+				err = e
+			}
+		}()
+		if run.snapshot.tgt, err = openSnapshot(run.ctx, dbTgt, false); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if e := run.snapshot.tgt.close(run.ctx); e != nil && err == nil {
+				err = e
+			}
+		}()
+
+		var position string
+		if src := run.snapshot.src; src.BinlogFile != "" {
+			position = fmt.Sprintf(", binlog %s:%d, gtid %s", src.BinlogFile, src.BinlogPos, src.GTIDSet)
+		} else if o.SnapshotPosition {
+			run.log.Warnln("binary log of source DB is disabled, no snapshot position captured")
+		}
+		run.log.Infof(
+			"consistent snapshot of source at %s%s, target at %s\n",
+			run.snapshot.src.Timestamp.Format(time.RFC3339Nano), position,
+			run.snapshot.tgt.Timestamp.Format(time.RFC3339Nano),
+		)
+	}
+
+	if run.groupConcatMaxLen.src, err = groupConcatMaxLen(run.ctx, dbSrc); err != nil {
+		return nil, err
+	}
+	if run.groupConcatMaxLen.tgt, err = groupConcatMaxLen(run.ctx, dbTgt); err != nil {
+		return nil, err
+	}
+
+	run.throttle = &throttler{
+		sleep:             o.Sleep,
+		maxThreadsRunning: o.MaxThreadsRunning,
+		maxReplicaLag:     o.MaxReplicaLag,
+		maxRowsPerSecond:  o.MaxRowsPerSecond,
+		dbSrc:             dbSrc,
+		log:               run.log,
+		start:             time.Now(),
+	}
+	if o.Replica.Host != "" {
+		dbReplica, e := InitializeDBSettings(o.Replica)
+		if e != nil {
+			return nil, e
+		}
+		defer closeErr(dbReplica, &err)
+		run.throttle.dbReplica = dbReplica
+	}
+
+	// every table run gets its own copy of the args
+	runs := make([]*tableRun, len(c.runs))
+	for i, tr := range c.runs {
+		runs[i] = &tableRun{arg: tr.arg, outputfile: tr.outputfile}
+	}
+
+	if o.AllTables {
+		tables, e := selectTables(dbSrc, dbTgt, o, run.log)
+		if e != nil {
+			return nil, e
+		}
+		if len(tables) == 0 {
+			return nil, errors.New("no table to diff, check --include/--exclude")
+		}
+
+		for _, ts := range tables {
+			tr := &tableRun{
+				arg:        c.arg,
+				outputfile: OutputFile(o.Output, o.Format, ts.TableSrc),
+			}
+			tr.arg.ArgSrcTable = ts.TableSrc
+			tr.arg.ArgTgtTable = ts.TableTgt
+
+			if ts.Status == "skipped" {
+				tr.summary = ts
+			}
+			runs = append(runs, tr)
+		}
+	}
+
+	if o.Progress && isTerminal(os.Stderr) {
+		run.progress = newProgress(os.Stderr, run.log, run.chunkLog)
+		defer run.progress.stop()
+
+		// tables are estimated from statistics upfront, and again by key range once chunked
+		for _, tr := range runs {
+			if tr.summary == nil {
+				rows, e := tableRows(run.ctx, dbSrc, tr.arg.ArgSrcTable)
+				if e != nil {
+					return nil, e
+				}
+				run.progress.setEstimate(tr.arg.ArgSrcTable, rows)
+			}
+		}
+	}
+
+	// query slots are shared by all tables, sized by the largest concurrency of them
+	srcConcurrency, tgtConcurrency := 1, 1
+	for _, tr := range runs {
+		tr.arg.run = run
+		if tr.arg.ArgSrcConcurrency > srcConcurrency {
+			srcConcurrency = tr.arg.ArgSrcConcurrency
+		}
+		if tr.arg.ArgTgtConcurrency > tgtConcurrency {
+			tgtConcurrency = tr.arg.ArgTgtConcurrency
+		}
+	}
+	run.slots.src = make(chan struct{}, srcConcurrency)
+	run.slots.tgt = make(chan struct{}, tgtConcurrency)
+
+	if o.AllTables || len(o.Tables) > 0 {
+		rs = runTables(start, dbSrc, dbTgt, runs, o.TableParallel)
+	} else {
+		ts, e := runTable(dbSrc, dbTgt, &runs[0].arg, runs[0].outputfile)
+		if e != nil {
+			return nil, e
+		}
+		rs = newRunSummary(start, []*TableSummary{ts})
+	}
+
+	if o.ConsistentSnapshot {
+		rs.SnapshotSrc, rs.SnapshotTgt = &run.snapshot.src.Snapshot, &run.snapshot.tgt.Snapshot
+	}
+	rs.Args = newRunArgs(o)
+	if err = rs.WriteFile(summaryFile(o.Output, o.Format)); err != nil {
+		return rs, err
+	}
+
+	if run.err != nil {
+		return rs, run.err
+	}
+	return rs, ctx.Err()
+} // }}}
+
+// vim: fdm=marker fdc=2
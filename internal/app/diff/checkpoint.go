@@ -0,0 +1,206 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// decodeLogLine : decode one json output line, numbers are kept as json.Number
+func decodeLogLine(linebytes []byte, v any) error { // {{{
+	decoder := json.NewDecoder(bytes.NewReader(linebytes))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+} // }}}
+
+// readLogLines : call fn for every complete line of the file, stops at the first line fn rejects,
+// returns the size in bytes of the accepted lines
+func readLogLines(filename string, fn func(linebytes []byte) bool) (validsize int64, err error) { // {{{
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer closeErr(file, &err)
+
+	reader := bufio.NewReader(file)
+	for {
+		linebytes, e := reader.ReadBytes('\n')
+		if e == io.EOF { // last line without newline was cut off while writing
+			break
+		} else if e != nil {
+			return validsize, e
+		}
+
+		if !fn(linebytes) {
+			break
+		}
+		validsize += int64(len(linebytes))
+	}
+
+	return
+} // }}}
+
+// LastChunkCheckpoint : find the last chunk written to the chunk log, a partially written tail is
+// cut off so that a resumed run appends after a complete line
+func LastChunkCheckpoint(outputfile string, log *logrus.Logger) (checkpoint *tableChunkInfo, err error) { // {{{
+	validsize, err := readLogLines(outputfile, func(linebytes []byte) bool {
+		var tci tableChunkInfo
+		if e := decodeLogLine(linebytes, &tci); e != nil {
+			return false
+		}
+		checkpoint = &tci
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(outputfile)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if stat.Size() > validsize {
+		log.Warnf("drop %d bytes of incomplete chunk log from %s\n", stat.Size()-validsize, outputfile)
+		if err = os.Truncate(outputfile, validsize); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+} // }}}
+
+// TrimRowLevelLog : drop row level lines of chunks after the checkpoint, those chunks are diffed
+// again by the resumed run
+func TrimRowLevelLog(rowlevelfile string, lastChunkIdx int, log *logrus.Logger) error { // {{{
+	var kept [][]byte
+	dropped := 0
+
+	_, e := readLogLines(rowlevelfile, func(linebytes []byte) bool {
+		var tcri struct {
+			ChunkIdx int `json:"chunkidx"`
+		}
+		if e := decodeLogLine(linebytes, &tcri); e != nil {
+			return false
+		}
+		if tcri.ChunkIdx <= lastChunkIdx {
+			kept = append(kept, linebytes)
+		} else {
+			dropped++
+		}
+		return true
+	})
+	if e != nil {
+		return e
+	}
+
+	if _, e := os.Stat(rowlevelfile); os.IsNotExist(e) {
+		return nil
+	}
+
+	tmpfile := rowlevelfile + ".tmp"
+	if e := os.WriteFile(tmpfile, bytes.Join(kept, nil), 0o666); e != nil {
+		return e
+	}
+	if e := os.Rename(tmpfile, rowlevelfile); e != nil {
+		return e
+	}
+
+	log.Debugf("%d row level lines after chunk %d dropped from %s\n", dropped, lastChunkIdx, rowlevelfile)
+	return nil
+} // }}}
+
+// ResumeLowerboundary : lowerboundary continuing right after the checkpoint chunk
+func (t *pkTable) ResumeLowerboundary(checkpoint *tableChunkInfo) (lowerboundary []any, err error) { // {{{
+	if checkpoint.TableSrc != t.arg.ArgSrcTable || checkpoint.TableTgt != t.arg.ArgTgtTable {
+		return nil, fmt.Errorf(
+			"checkpoint is for -s %s -t %s, cannot resume -s %s -t %s",
+			checkpoint.TableSrc,
+			checkpoint.TableTgt,
+			t.arg.ArgSrcTable,
+			t.arg.ArgTgtTable,
+		)
+	}
+
+	if checkpoint.HashAlgorithm == "" { // chunk log written before --hash existed
+		checkpoint.HashAlgorithm = defaultHashAlgorithm
+	}
+	if checkpoint.HashAlgorithm != t.arg.ArgHash {
+		return nil, fmt.Errorf("checkpoint is hashed by --hash %s, cannot resume with --hash %s", checkpoint.HashAlgorithm, t.arg.ArgHash)
+	}
+
+	if checkpoint.RowEncoding == "" {
+		checkpoint.RowEncoding = defaultRowEncoding
+	}
+	if checkpoint.RowEncoding != t.arg.ArgRowEncoding {
+		return nil, fmt.Errorf("checkpoint is encoded by --row-encoding %s, cannot resume with --row-encoding %s", checkpoint.RowEncoding, t.arg.ArgRowEncoding)
+	}
+
+	if checkpoint.ChunkAggregate == "" {
+		checkpoint.ChunkAggregate = defaultChunkAggregate
+	}
+	if checkpoint.ChunkAggregate != t.arg.ArgChunkAggregate {
+		return nil, fmt.Errorf("checkpoint is aggregated by --chunk-aggregate %s, cannot resume with --chunk-aggregate %s", checkpoint.ChunkAggregate, t.arg.ArgChunkAggregate)
+	}
+
+	pkColumnNames := t.GetPKColumnNames()
+	if strings.Join(checkpoint.PKColumnNames, ",") != strings.Join(pkColumnNames, ",") ||
+		len(checkpoint.LowerBoundary) != len(pkColumnNames) {
+		return nil, fmt.Errorf(
+			"checkpoint pk columns (%s) differ from the run pk columns (%s), check -S/--key-columns/--chunk-index",
+			strings.Join(checkpoint.PKColumnNames, ","),
+			strings.Join(pkColumnNames, ","),
+		)
+	}
+
+	// next chunk starts at the upper boundary of the checkpoint chunk
+	lowerboundary = make([]any, len(pkColumnNames))
+	for i := 0; i < len(pkColumnNames); i++ {
+		v := checkpoint.LowerBoundary[i]
+		if i == len(pkColumnNames)-1 {
+			v = checkpoint.LastPKFieldUpperBoundary
+		}
+		ft := t.GetPKColumns()[i].FieldType
+		if lowerboundary[i], err = ft.transformFieldType(v); err != nil {
+			return nil, err
+		}
+	}
+
+	t.arg.run.log.Infof(
+		"resume after chunk %d, pkcolumns: %v, lowerboundary: %v\n",
+		checkpoint.ChunkIdx,
+		pkColumnNames,
+		lowerboundary,
+	)
+
+	return
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,147 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	chunkLine1 = `{"chunkidx":1,"tablesrc":"emp","tabletgt":"emp","lastpkfieldupperboundary":100}` + "\n"
+	chunkLine2 = `{"chunkidx":2,"tablesrc":"emp","tabletgt":"emp","lastpkfieldupperboundary":200}` + "\n"
+	chunkLine3 = `{"chunkidx":3,"tablesrc":"emp","tabletgt":"emp","lastpkfieldupperboundary":300}` + "\n"
+)
+
+// discardLogger : logger of a test run, its lines are dropped
+func discardLogger() *logrus.Logger { // {{{
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+} // }}}
+
+// writeLog : file of content in a temporary directory, no file if content is nil
+func writeLog(t *testing.T, content *string) string { // {{{
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "dfc.json")
+	if content != nil {
+		if e := os.WriteFile(filename, []byte(*content), 0o600); e != nil {
+			t.Fatal(e)
+		}
+	}
+	return filename
+} // }}}
+
+// readLog : content of the file, nil if there is none
+func readLog(t *testing.T, filename string) *string { // {{{
+	t.Helper()
+	b, e := os.ReadFile(filename)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+	s := string(b)
+	return &s
+} // }}}
+
+func ptr(s string) *string { return &s }
+
+// logText : quoted content for messages
+func logText(content *string) string { // {{{
+	if content == nil {
+		return "<no file>"
+	}
+	return fmt.Sprintf("%q", *content)
+} // }}}
+
+func TestLastChunkCheckpoint(t *testing.T) { // {{{
+	tests := []struct {
+		name         string
+		content      *string
+		wantChunkIdx int // 0 for no checkpoint
+		wantContent  *string
+	}{
+		{"no file", nil, 0, nil},
+		{"empty file", ptr(""), 0, ptr("")},
+		{"complete lines", ptr(chunkLine1 + chunkLine2), 2, ptr(chunkLine1 + chunkLine2)},
+		{"partial tail", ptr(chunkLine1 + chunkLine2 + `{"chunkidx":3,"tabl`), 2, ptr(chunkLine1 + chunkLine2)},
+		{"partial tail only", ptr(`{"chunkidx":1`), 0, ptr("")},
+		{"broken line", ptr(chunkLine1 + "{\n" + chunkLine3), 1, ptr(chunkLine1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeLog(t, tt.content)
+
+			checkpoint, e := LastChunkCheckpoint(filename, discardLogger())
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			chunkidx := 0
+			if checkpoint != nil {
+				chunkidx = checkpoint.ChunkIdx
+			}
+			if chunkidx != tt.wantChunkIdx {
+				t.Errorf("checkpoint chunk = %d, want %d", chunkidx, tt.wantChunkIdx)
+			}
+			if got := readLog(t, filename); logText(got) != logText(tt.wantContent) {
+				t.Errorf("chunk log = %s, want %s", logText(got), logText(tt.wantContent))
+			}
+		})
+	}
+} // }}}
+
+func TestTrimRowLevelLog(t *testing.T) { // {{{
+	tests := []struct {
+		name         string
+		content      *string
+		lastChunkIdx int
+		wantContent  *string
+	}{
+		{"no file", nil, 1, nil},
+		{"keep all", ptr(chunkLine1 + chunkLine2), 2, ptr(chunkLine1 + chunkLine2)},
+		{"drop later chunks", ptr(chunkLine1 + chunkLine2 + chunkLine3), 1, ptr(chunkLine1)},
+		{"drop out of order chunks", ptr(chunkLine1 + chunkLine3 + chunkLine2), 2, ptr(chunkLine1 + chunkLine2)},
+		{"drop partial tail", ptr(chunkLine1 + `{"chunkidx":2`), 2, ptr(chunkLine1)},
+		{"drop all", ptr(chunkLine2 + chunkLine3), 1, ptr("")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeLog(t, tt.content)
+
+			if e := TrimRowLevelLog(filename, tt.lastChunkIdx, discardLogger()); e != nil {
+				t.Fatal(e)
+			}
+
+			if got := readLog(t, filename); logText(got) != logText(tt.wantContent) {
+				t.Errorf("row level log = %s, want %s", logText(got), logText(tt.wantContent))
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
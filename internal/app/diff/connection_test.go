@@ -0,0 +1,135 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMysqlConfig(t *testing.T) { // {{{
+	tests := []struct {
+		name    string
+		c       Connection
+		want    string // DSN of the config
+		wantErr string
+	}{
+		{
+			name: "settings",
+			c:    Connection{Username: "root", Password: "pw", Host: "db1", Port: "3306", DBName: "src"},
+			want: "root:pw@tcp(db1:3306)/src?parseTime=true&group_concat_max_len=1000000",
+		},
+		{
+			name: "settings override DSN",
+			c:    Connection{DSN: "u:p@tcp(a:1)/d?charset=utf8mb4", Password: "pw", Host: "b", Port: "2", DBName: "x"},
+			want: "u:pw@tcp(b:2)/x?parseTime=true&charset=utf8mb4&group_concat_max_len=1000000",
+		},
+		{
+			name: "DSN kept",
+			c:    Connection{DSN: "u:p@unix(/tmp/mysql.sock)/d"},
+			want: "u:p@unix(/tmp/mysql.sock)/d?parseTime=true&group_concat_max_len=1000000",
+		},
+		{
+			name: "socket",
+			c:    Connection{Username: "root", Socket: "/tmp/mysql.sock", DBName: "src"},
+			want: "root@unix(/tmp/mysql.sock)/src?parseTime=true&group_concat_max_len=1000000",
+		},
+		{
+			name: "params",
+			c:    Connection{Host: "db1", Port: "3306", Params: map[string]string{"loc": "Local", "sql_mode": "'ANSI'", "group_concat_max_len": "5"}},
+			want: "tcp(db1:3306)/?loc=Local&parseTime=true&group_concat_max_len=5&sql_mode=%27ANSI%27",
+		},
+		{
+			name: "timeouts",
+			c:    Connection{Host: "db1", Port: "3306", Timeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second},
+			want: "tcp(db1:3306)/?parseTime=true&readTimeout=2s&timeout=1s&writeTimeout=3s&group_concat_max_len=1000000",
+		},
+		{
+			name:    "socket and host",
+			c:       Connection{Socket: "/tmp/mysql.sock", Host: "db1"},
+			wantErr: "socket and host are mutual exclusive",
+		},
+		{
+			name:    "invalid DSN",
+			c:       Connection{DSN: "root@db1/src"},
+			wantErr: "invalid DSN",
+		},
+		{
+			name:    "client certificate without key",
+			c:       Connection{Host: "db1", TLSCert: "client.pem"},
+			wantErr: "TLS client certificate and key should be set together",
+		},
+		{
+			name:    "CA without TLS",
+			c:       Connection{Host: "db1", TLSMode: tlsDisabled, TLSCA: "ca.pem"},
+			wantErr: "require a TLS mode other than disabled",
+		},
+		{
+			name:    "verify-identity on socket",
+			c:       Connection{Socket: "/tmp/mysql.sock", TLSMode: tlsVerifyIdentity},
+			wantErr: "requires a host",
+		},
+		{
+			name:    "unknown TLS mode",
+			c:       Connection{Host: "db1", TLSMode: "on"},
+			wantErr: "TLS mode should be one of",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, e := tt.c.mysqlConfig()
+			if tt.wantErr != "" {
+				if e == nil || !strings.Contains(e.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", e, tt.wantErr)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			if got := cfg.FormatDSN(); got != tt.want {
+				t.Errorf("DSN = %s, want %s", got, tt.want)
+			}
+		})
+	}
+} // }}}
+
+func TestTLSMode(t *testing.T) { // {{{
+	tests := []struct {
+		name string
+		c    Connection
+		want string
+	}{
+		{"none", Connection{}, ""},
+		{"CA verifies", Connection{TLSCA: "ca.pem"}, tlsVerifyCA},
+		{"client certificate only", Connection{TLSCert: "client.pem", TLSKey: "client.key"}, tlsRequired},
+		{"mode wins", Connection{TLSMode: tlsPreferred, TLSCA: "ca.pem"}, tlsPreferred},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.tlsMode(); got != tt.want {
+				t.Errorf("tlsMode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
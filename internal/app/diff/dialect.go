@@ -0,0 +1,345 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDriver is the DB engine of a Connection without Driver
+const defaultDriver = "mysql"
+
+/*
+dialect : SQL of the DB engine of one side. Queries are written with ? placeholders and MySQL
+hints, the connector of the engine rewrites them if needed. Hash, row encoding and chunk aggregate
+expressions of the same name give the same value on every engine, names missing from an engine are
+not supported by it. Key column data types are normalized to the MySQL names of fieldTypeOf
+*/
+type dialect struct { // {{{
+	name            string // Connection.Driver
+	file            bool   // rows are loaded from a file of the connection by loadFileTable
+	connector       func(c Connection) (driver.Connector, error)
+	describe        func(c Connection) string
+	hashAlgorithms  map[string]func(expr string) string
+	rowEncodings    map[string]func(columns []string) string
+	chunkAggregates map[string]aggregateExpr
+	textExpr        func(column string) string // column as text, NULL stays NULL
+	valuesList      func(rows []string) string // list of the row values (?, ...) of IN
+	literal         func(quoted string) string // literal of the engine for a standard SQL literal of SQLite quote()
+	dataTypes       map[string]string          // engine data type: MySQL data type, empty if not supported as key
+	unlikeTypes     map[string]string          // engine data types written as text unlike other engines: how, see checkCrossEngine
+
+	columnsQuery    string // column_name of the columns of table ? in table order
+	baseTablesQuery string // table_name of the base tables
+	keyColumnsQuery string // column_name, data_type, column_type of the columns of table ?
+	keyIndexQuery   string // index_name, column_name, is_nullable of unique indexes of table ?, PRIMARY for the primary key
+	chunkIndexQuery string // column_name, is_nullable of the columns of table ? index ?
+	tableRowsQuery  string // rows of table ? in the table statistics, empty if the engine keeps none
+
+	groupConcatMaxLenQuery string // empty if GROUP_CONCAT of the engine is not truncated
+	connectionIDQuery      string
+	killQuery              string                                                        // kills the query of a connection id, empty if the driver cancels it
+	snapshotStmts          []string                                                      // start a transaction with a consistent snapshot
+	snapshotPosition       bool                                                          // binary log position can be captured at the snapshot
+	threadsRunning         func(db *sql.DB) (int, error)                                 // nil if the engine has no server threads
+	replicaLag             func(db *sql.DB) (lag time.Duration, running bool, err error) // nil if the engine has no replicas
+} // }}}
+
+// dialects : DB engines by Connection.Driver
+func dialects() map[string]func() *dialect { // {{{
+	return map[string]func() *dialect{
+		"mysql":    mysqlDialect,
+		"postgres": postgresDialect,
+		"sqlite":   sqliteDialect,
+		"csv":      csvDialect,
+		"parquet":  parquetDialect,
+	}
+} // }}}
+
+// DriverNames : sorted names of the DB engines of Connection.Driver
+func DriverNames() (names []string) { // {{{
+	for name := range dialects() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+} // }}}
+
+// supports : error if the hash, row encoding or chunk aggregate of arg is not supported by the
+// engine of side
+func (d *dialect) supports(side string, arg *envarg) error { // {{{
+	unsupported := func(flag string, value string, names []string) error {
+		sort.Strings(names)
+		return fmt.Errorf("%s %s is not supported by %s DB (%s), use one of %s", flag, value, side, d.name, strings.Join(names, ", "))
+	}
+
+	if _, exists := d.hashAlgorithms[arg.ArgHash]; !exists {
+		var names []string
+		for name := range d.hashAlgorithms {
+			names = append(names, name)
+		}
+		return unsupported("--hash", arg.ArgHash, names)
+	}
+	if _, exists := d.rowEncodings[arg.ArgRowEncoding]; !exists {
+		var names []string
+		for name := range d.rowEncodings {
+			names = append(names, name)
+		}
+		return unsupported("--row-encoding", arg.ArgRowEncoding, names)
+	}
+	if _, exists := d.chunkAggregates[arg.ArgChunkAggregate]; !exists {
+		var names []string
+		for name := range d.chunkAggregates {
+			names = append(names, name)
+		}
+		return unsupported("--chunk-aggregate", arg.ArgChunkAggregate, names)
+	}
+
+	return nil
+} // }}}
+
+// engine : DB engine of the dialect, files are loaded into SQLite
+func (d *dialect) engine() string { // {{{
+	if d.file {
+		return sqliteDialect().name
+	}
+	return d.name
+} // }}}
+
+// checkCrossEngine : error if source and target are different engines and the table has hashed
+// columns whose text differs between them, or key columns ordered by the collation of each engine.
+// Values are hashed as text, and chunks are the rows BETWEEN the boundaries in the order of each side
+func checkCrossEngine(dbSrc *DB, dbTgt *DB, arg *envarg, allpkcolumns []pkColumn) error { // {{{
+	src, tgt := dbSrc.dialect, dbTgt.dialect
+	if src.engine() == tgt.engine() {
+		return nil
+	}
+
+	for _, pkcolumn := range allpkcolumns {
+		switch pkcolumn.FieldType.(type) {
+		case *fieldtypeChar, *fieldtypeEnum:
+			return fmt.Errorf(
+				"key column %s is %s, ordered by the collation of each engine: chunks of source DB (%s) and target DB (%s) would not have the same rows. "+
+					"chunk on int, decimal, date or binary columns with --key-columns/--chunk-index",
+				pkcolumn.ColumnName, pkcolumn.DataType, src.name, tgt.name,
+			)
+		}
+	}
+
+	for _, side := range []struct {
+		name  string
+		db    *DB
+		table string
+	}{{"source", dbSrc, arg.ArgSrcTable}, {"target", dbTgt, arg.ArgTgtTable}} {
+		d := side.db.dialect
+		if len(d.unlikeTypes) == 0 {
+			continue
+		}
+		types, e := queryColumnTypes(side.db, side.table)
+		if e != nil {
+			return e
+		}
+		columns, e := GetTableColumns(side.db, side.table)
+		if e != nil {
+			return e
+		}
+		for _, name := range columns {
+			datatype := strings.ToLower(types[strings.ToLower(name)][0])
+			if how, unlike := d.unlikeTypes[datatype]; unlike && !contains(arg.ArgIgnoreFields, name) {
+				return fmt.Errorf(
+					"column %s of %s DB (%s) is %s, %s, hashes of other engines would not match. --ignore-fields it or cast it in a view",
+					name, side.name, d.name, datatype, how,
+				)
+			}
+		}
+	}
+
+	return nil
+} // }}}
+
+// contains : s is one of values
+func contains(values []string, s string) bool { // {{{
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+} // }}}
+
+// parenthesizedList : (row1, row2, ...) list of IN
+func parenthesizedList(rows []string) string { // {{{
+	return "(" + strings.Join(rows, ",") + ")"
+} // }}}
+
+// dataType : data type of the engine as the MySQL data type of fieldTypeOf
+func (d *dialect) dataType(datatype string) string { // {{{
+	if mysqltype, exists := d.dataTypes[datatype]; exists {
+		return mysqltype
+	}
+	return datatype
+} // }}}
+
+// queryConnectionID : id of the connection killQuery kills the query of, 0 if the driver cancels
+// the query itself
+func (d *dialect) queryConnectionID(ctx context.Context, conn *sql.Conn) (connectionid int64, err error) { // {{{
+	if d.killQuery == "" {
+		return 0, nil
+	}
+	err = conn.QueryRowContext(ctx, d.connectionIDQuery).Scan(&connectionid)
+
+	return
+} // }}}
+
+// rewriteConnector : connector of a driver, queries are rewritten before they reach the driver
+type rewriteConnector struct { // {{{
+	driver.Connector
+	rewrite func(query string) string
+} // }}}
+
+// Connect : connection of the driver rewriting its queries
+func (c rewriteConnector) Connect(ctx context.Context) (driver.Conn, error) { // {{{
+	conn, e := c.Connector.Connect(ctx)
+	if e != nil {
+		return nil, e
+	}
+	return &rewriteConn{Conn: conn, rewrite: c.rewrite}, nil
+} // }}}
+
+// rewriteConn : driver connection rewriting its queries, the optional interfaces of database/sql
+// are passed on to the driver connection
+type rewriteConn struct { // {{{
+	driver.Conn
+	rewrite func(query string) string
+} // }}}
+
+func (c *rewriteConn) Prepare(query string) (driver.Stmt, error) { // {{{
+	return c.Conn.Prepare(c.rewrite(query))
+} // }}}
+
+func (c *rewriteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) { // {{{
+	if conn, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return conn.PrepareContext(ctx, c.rewrite(query))
+	}
+	return c.Conn.Prepare(c.rewrite(query))
+} // }}}
+
+func (c *rewriteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) { // {{{
+	if conn, ok := c.Conn.(driver.QueryerContext); ok {
+		return conn.QueryContext(ctx, c.rewrite(query), args)
+	}
+	return nil, driver.ErrSkip
+} // }}}
+
+func (c *rewriteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) { // {{{
+	if conn, ok := c.Conn.(driver.ExecerContext); ok {
+		return conn.ExecContext(ctx, c.rewrite(query), args)
+	}
+	return nil, driver.ErrSkip
+} // }}}
+
+func (c *rewriteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) { // {{{
+	if conn, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return conn.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+} // }}}
+
+func (c *rewriteConn) Ping(ctx context.Context) error { // {{{
+	if conn, ok := c.Conn.(driver.Pinger); ok {
+		return conn.Ping(ctx)
+	}
+	return nil
+} // }}}
+
+func (c *rewriteConn) ResetSession(ctx context.Context) error { // {{{
+	if conn, ok := c.Conn.(driver.SessionResetter); ok {
+		return conn.ResetSession(ctx)
+	}
+	return nil
+} // }}}
+
+func (c *rewriteConn) IsValid() bool { // {{{
+	if conn, ok := c.Conn.(driver.Validator); ok {
+		return conn.IsValid()
+	}
+	return true
+} // }}}
+
+func (c *rewriteConn) CheckNamedValue(nv *driver.NamedValue) error { // {{{
+	if conn, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return conn.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+} // }}}
+
+// filterMark : comment around SQL of the user in queries, see additionalFilterStmt
+const filterMark = "/*dfc:filter*/"
+
+// numberedPlaceholders : query with the ? placeholders numbered like $1, $2, ... and the MySQL
+// only SQL_NO_CACHE hint dropped. ? in quoted strings and identifiers, and in the -F filter between
+// filterMarks are kept
+//
+//	SELECT SQL_NO_CACHE a FROM t WHERE a = ? AND b = '?' AND /*dfc:filter*/c ? 'k'/*dfc:filter*/
+//	SELECT a FROM t WHERE a = $1 AND b = '?' AND /*dfc:filter*/c ? 'k'/*dfc:filter*/
+func numberedPlaceholders(query string) string { // {{{
+	query = withoutHints(query)
+
+	var b strings.Builder
+	var quote byte
+	var filter bool
+	n := 0
+	for i := 0; i < len(query); i++ { // bytes, ASCII is never part of a multibyte UTF-8 rune
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(query[i:], filterMark):
+			filter = !filter
+			b.WriteString(filterMark)
+			i += len(filterMark) - 1
+			continue
+		case c == '?' && !filter:
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+} // }}}
+
+// withoutHints : query without the MySQL only SQL_NO_CACHE hint
+func withoutHints(query string) string { // {{{
+	query = strings.ReplaceAll(query, "SQL_NO_CACHE ", "")
+	return strings.ReplaceAll(query, "SQL_NO_CACHE\n", "\n")
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,93 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// csvReader : rows of a csv file, values are text as in the file
+type csvReader struct { // {{{
+	f     *os.File
+	r     *csv.Reader
+	names []string
+	null  *string
+} // }}}
+
+// openCSV : reader of the csv file at path, columns name its values without header
+func openCSV(path string, o fileOptions, columns []string) (fileReader, error) { // {{{
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+
+	r := &csvReader{f: f, r: csv.NewReader(f), names: columns, null: o.null}
+	r.r.Comma = o.delimiter
+	r.r.ReuseRecord = true
+
+	if !o.header {
+		r.r.FieldsPerRecord = len(columns)
+		return r, nil
+	}
+
+	header, e := r.r.Read()
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("header of %s: %w", path, e)
+	}
+	r.names = append([]string(nil), header...)
+	r.names[0] = strings.TrimPrefix(r.names[0], "\ufeff") // byte order mark of spreadsheet exports
+
+	return r, nil
+} // }}}
+
+func (r *csvReader) columns() []string { // {{{
+	return r.names
+} // }}}
+
+func (r *csvReader) read() (row []any, e error) { // {{{
+	record, e := r.r.Read()
+	if e != nil {
+		return nil, e
+	}
+
+	row = make([]any, len(record))
+	for i, value := range record {
+		if r.null != nil && value == *r.null {
+			continue
+		}
+		row[i] = value
+	}
+
+	return
+} // }}}
+
+func (r *csvReader) close() error { // {{{
+	return r.f.Close()
+} // }}}
+
+// csvDialect : csv file, e.g. an export of a vendor. Every value is text, converted to the column
+// types of the table of the other side when loaded
+func csvDialect() *dialect { // {{{
+	return fileDialect("csv", []string{"columns", "delimiter", "header", "null"}, openCSV)
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,503 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileLoadBatchSize is the number of rows of a file inserted by one transaction
+const fileLoadBatchSize = 10000
+
+// fileReader : rows of a file, read in file order
+type fileReader interface {
+	columns() []string          // names of the values of each row
+	read() (row []any, e error) // values of the next row, nil for NULL, io.EOF after the last row
+	close() error
+}
+
+// fileOptions : how the rows of a file are read, parameters of the DSN or Params
+type fileOptions struct { // {{{
+	delimiter rune              // csv field delimiter
+	header    bool              // first csv line names the columns, otherwise they are in table order
+	null      *string           // csv text of NULL, nil if every text is a value
+	columns   map[string]string // file column: table column, empty to skip the file column
+} // }}}
+
+// fileConnector : connector of a temporary SQLite database, the rows of the file of the connection
+// are loaded into it by loadFileTable. The database is created by the first connection and
+// removed by DB.Close
+type fileConnector struct { // {{{
+	path    string
+	options fileOptions
+	open    func(path string, o fileOptions, columns []string) (fileReader, error)
+	driver  driver.Driver
+
+	once     sync.Once
+	database string // temporary database file
+	err      error
+} // }}}
+
+func (c *fileConnector) Connect(ctx context.Context) (driver.Conn, error) { // {{{
+	c.once.Do(func() {
+		var f *os.File
+		f, c.err = os.CreateTemp("", "dfc-*.db")
+		if c.err != nil {
+			return
+		}
+		c.database = f.Name()
+		c.err = f.Close()
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	// the database is written once by loadFileTable and read only after, it needs no journal
+	dsn := "file:" + (&url.URL{Path: c.database}).EscapedPath() + "?_pragma=journal_mode(off)&_pragma=synchronous(off)"
+	return rewriteConnector{Connector: sqliteConnector{driver: c.driver, dsn: dsn}, rewrite: withoutHints}.Connect(ctx)
+} // }}}
+
+func (c *fileConnector) Driver() driver.Driver { // {{{
+	return c.driver
+} // }}}
+
+// remove : remove the temporary database, after its DB is closed
+func (c *fileConnector) remove() error { // {{{
+	if c.database == "" {
+		return nil
+	}
+	return os.Remove(c.database)
+} // }}}
+
+// IsFile : the connection is a csv or parquet file, its table is loaded from the file by the run
+func (c Connection) IsFile() bool { // {{{
+	d, e := c.dialect()
+	return e == nil && d.file
+} // }}}
+
+// filePath : file of the connection, DBName or the path of DSN
+func (c Connection) filePath() string { // {{{
+	if c.DBName != "" {
+		return c.DBName
+	}
+	path, _, _ := strings.Cut(c.DSN, "?")
+	return path
+} // }}}
+
+/*
+fileOptions : read options of the file of the connection, parameters of DSN overridden by Params.
+Only params are accepted, delimiter, header and null are csv only
+
+	vendor.csv?delimiter=;&header=false&null=\N&columns=Employee No:emp_no,Comment:
+*/
+func (c Connection) fileOptions(params []string) (o fileOptions, err error) { // {{{
+	if c.Host != "" || c.Port != "" || c.Socket != "" {
+		return o, errors.New("a file is read from DBName or DSN, host, port and socket are not used")
+	}
+	if c.tlsMode() != "" {
+		return o, errors.New("a file is read locally, TLS settings are not used")
+	}
+	if c.Timeout != 0 || c.ReadTimeout != 0 || c.WriteTimeout != 0 {
+		return o, errors.New("a file is read locally, timeouts are not used")
+	}
+
+	_, query, _ := strings.Cut(c.DSN, "?")
+	// a ; is a delimiter here, not the separator url rejects
+	values, e := url.ParseQuery(strings.ReplaceAll(query, ";", "%3B"))
+	if e != nil {
+		return o, fmt.Errorf("invalid DSN parameters: %w", e)
+	}
+	for name, value := range c.Params {
+		values.Set(name, value)
+	}
+
+	known := map[string]bool{}
+	for _, param := range params {
+		known[param] = true
+	}
+	for name := range values {
+		if !known[name] {
+			return o, fmt.Errorf("unknown parameter %s, use one of %s", name, strings.Join(params, ", "))
+		}
+	}
+
+	o.delimiter, o.header = ',', true
+	if values.Has("delimiter") {
+		delimiter := []rune(values.Get("delimiter"))
+		if len(delimiter) != 1 {
+			return o, fmt.Errorf("delimiter should be one character, got %q", values.Get("delimiter"))
+		}
+		o.delimiter = delimiter[0]
+	}
+	if values.Has("header") {
+		if o.header, e = strconv.ParseBool(values.Get("header")); e != nil {
+			return o, fmt.Errorf("header should be true or false, got %s", values.Get("header"))
+		}
+	}
+	if values.Has("null") {
+		null := values.Get("null")
+		o.null = &null
+	}
+	if values.Has("columns") {
+		o.columns = map[string]string{}
+		for _, pair := range strings.Split(values.Get("columns"), ",") {
+			filecolumn, column, found := strings.Cut(pair, ":")
+			if !found || filecolumn == "" {
+				return o, fmt.Errorf("columns should be pairs of file column:table column, got %s", pair)
+			}
+			o.columns[filecolumn] = column
+		}
+	}
+
+	return
+} // }}}
+
+// fileDialect : csv or parquet file of format, rows are read by open and loaded into a temporary
+// SQLite database, queried like sqliteDialect
+func fileDialect(format string, params []string, open func(path string, o fileOptions, columns []string) (fileReader, error)) *dialect { // {{{
+	d := *sqliteDialect()
+	d.name = format
+	d.file = true
+	d.connector = func(c Connection) (driver.Connector, error) {
+		path := c.filePath()
+		if path == "" {
+			return nil, fmt.Errorf("%s file is not set, DBName or DSN is required", format)
+		}
+		if _, e := os.Stat(path); e != nil {
+			return nil, e
+		}
+		o, e := c.fileOptions(params)
+		if e != nil {
+			return nil, e
+		}
+		if e := sqliteRegister(); e != nil {
+			return nil, e
+		}
+		// the dfc_ functions are registered with the driver of database/sql
+		db, e := sql.Open("sqlite", "")
+		if e != nil {
+			return nil, e
+		}
+		defer db.Close()
+		return &fileConnector{path: path, options: o, open: open, driver: db.Driver()}, nil
+	}
+	d.describe = func(c Connection) string {
+		return format + "(" + c.filePath() + ")"
+	}
+
+	return &d
+} // }}}
+
+// fileColumn : column of the table of the other side, the loaded table has the same columns
+type fileColumn struct { // {{{
+	name       string
+	datatype   string // MySQL data type
+	columntype string
+	key        bool
+	index      int // of the value in the rows of the file, -1 if not in the file
+} // }}}
+
+// sqliteType : declared type of the column in the loaded table, by the affinity rules of SQLite.
+// Values of the file are converted on insert like the DB of the other side converts them, and
+// key columns compare like there
+func (c fileColumn) sqliteType() string { // {{{
+	switch {
+	case c.datatype == "bigint" && strings.Contains(c.columntype, "unsigned") && !c.key:
+		return "TEXT" // INTEGER would make values above the signed range REAL
+	case strings.Contains(c.datatype, "int") || c.datatype == "year":
+		return "INTEGER"
+	case c.datatype == "float" || c.datatype == "double" || c.datatype == "real":
+		return "REAL"
+	case c.datatype == "date":
+		return "DATE"
+	case c.datatype == "datetime" || c.datatype == "timestamp":
+		return "DATETIME"
+	case strings.Contains(c.datatype, "binary") || strings.Contains(c.datatype, "blob") || c.datatype == "bytea":
+		return "BLOB"
+	default: // decimals keep their digits as text
+		return "TEXT"
+	}
+} // }}}
+
+// typeArgs : arguments of columntype, the precision and scale of decimal(10,2)
+func typeArgs(columntype string) (args []string) { // {{{
+	_, list, found := strings.Cut(columntype, "(")
+	if !found {
+		return nil
+	}
+	list, _, _ = strings.Cut(list, ")")
+	for _, arg := range strings.Split(list, ",") {
+		args = append(args, strings.TrimSpace(arg))
+	}
+	return
+} // }}}
+
+// value : value v of the file as text of the column in the other DB, decimals get the digits of
+// their scale and times the digits of their fractional seconds, also when they are text of a csv
+func (c fileColumn) value(v any) any { // {{{
+	switch x := v.(type) {
+	case string:
+		if c.sqliteType() == "BLOB" {
+			return []byte(x)
+		}
+		if args := typeArgs(c.columntype); len(args) == 2 && c.datatype == "decimal" {
+			r, ok := new(big.Rat).SetString(x)
+			if scale, e := strconv.Atoi(args[1]); ok && e == nil {
+				return r.FloatString(scale)
+			}
+		}
+		if t := c.sqliteType(); t == "DATE" || t == "DATETIME" {
+			for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999Z07:00", "2006-01-02"} {
+				if tm, e := time.Parse(layout, x); e == nil {
+					return c.value(tm)
+				}
+			}
+		}
+	case time.Time:
+		layout := "2006-01-02 15:04:05"
+		switch c.datatype {
+		case "date":
+			return x.Format("2006-01-02")
+		case "time":
+			layout = "15:04:05"
+		}
+		if args := typeArgs(c.columntype); len(args) == 1 {
+			if digits, e := strconv.Atoi(args[0]); e == nil && digits > 0 && digits <= 9 {
+				layout += "." + strings.Repeat("0", digits)
+			}
+		}
+		return x.Format(layout)
+	}
+
+	return v
+} // }}}
+
+// fileColumns : columns of table of db with their place in the file columns. Mapped file columns
+// go to the table column of options, the others to the table column of the same name. Every
+// table column but ignored ones should be in the file
+func fileColumns(db *DB, table string, keycolumns []pkColumn, filecolumns []string, o fileOptions, ignored []string) (columns []fileColumn, err error) { // {{{
+	types, err := queryColumnTypes(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[string]int{}
+	for i, filecolumn := range filecolumns {
+		column, mapped := o.columns[filecolumn]
+		if !mapped {
+			column = filecolumn
+		}
+		if column == "" { // skipped
+			continue
+		}
+		if _, exists := types[strings.ToLower(column)]; !exists {
+			return nil, fmt.Errorf("file column %s is not a column of table %s, map it with columns=%s:column", filecolumn, table, filecolumn)
+		}
+		if _, exists := index[strings.ToLower(column)]; exists {
+			return nil, fmt.Errorf("column %s of table %s is more than one file column", column, table)
+		}
+		index[strings.ToLower(column)] = i
+	}
+	for filecolumn := range o.columns {
+		if !contains(filecolumns, filecolumn) {
+			return nil, fmt.Errorf("mapped column %s is not in the file", filecolumn)
+		}
+	}
+
+	iskey := map[string]bool{}
+	for _, key := range keycolumns {
+		iskey[strings.ToLower(key.ColumnName)] = true
+	}
+
+	names, err := GetTableColumns(db, table)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		i, exists := index[strings.ToLower(name)]
+		if !exists {
+			if !contains(ignored, name) {
+				return nil, fmt.Errorf("column %s of table %s is not in the file, map a file column to it or --ignore-fields it", name, table)
+			}
+			i = -1
+		}
+		types := types[strings.ToLower(name)]
+		columns = append(columns, fileColumn{
+			name:       name,
+			datatype:   db.dialect.dataType(strings.ToLower(types[0])),
+			columntype: strings.ToLower(types[1]),
+			key:        iskey[strings.ToLower(name)],
+			index:      i,
+		})
+	}
+
+	return
+} // }}}
+
+/*
+load : load the rows of the file into table, created with the columns of table tablelike of
+dblike and its key as primary key. Key columns compare in SQLite like in the other DB only for
+integer, float, text, date and binary types
+
+	CREATE TABLE table (column1 TYPE1 NOT NULL, ..., columnn TYPEN, PRIMARY KEY (pkcolumn1, ...))
+*/
+func (c *fileConnector) load(ctx context.Context, db *DB, table string, dblike *DB, tablelike string, arg *envarg, log *logrus.Logger) (err error) { // {{{
+	keycolumns, err := queryPKColumns(dblike, tablelike, arg.ArgKeyColumns)
+	if err != nil {
+		return err
+	}
+	for _, key := range keycolumns {
+		switch key.FieldType.(type) {
+		case *fieldtypeInt, *fieldtypeFloat, *fieldtypeChar, *fieldtypeDate, *fieldtypeBinary:
+		default:
+			return fmt.Errorf("%s key column %s.%s is not supported with a file", key.DataType, tablelike, key.ColumnName)
+		}
+	}
+
+	likecolumns, err := GetTableColumns(dblike, tablelike)
+	if err != nil {
+		return err
+	}
+	r, err := c.open(c.path, c.options, likecolumns)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := r.close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	columns, err := fileColumns(dblike, tablelike, keycolumns, r.columns(), c.options, arg.ArgIgnoreFields)
+	if err != nil {
+		return err
+	}
+
+	definitions := make([]string, len(columns))
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		definitions[i] = `"` + column.name + `" ` + column.sqliteType()
+		if column.key {
+			definitions[i] += " NOT NULL"
+		}
+		names[i] = `"` + column.name + `"`
+	}
+	keynames := make([]string, len(keycolumns))
+	for i, key := range keycolumns {
+		keynames[i] = key.ColumnName
+	}
+
+	query := `CREATE TABLE "` + table + `" (` + strings.Join(definitions, ", ") + `, PRIMARY KEY ("` + strings.Join(keynames, `", "`) + `"))`
+	log.Traceln(query)
+	if _, err = db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO "` + table + `" (` + strings.Join(names, ", ") + `) VALUES (` + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + `)`
+	log.Traceln(query)
+
+	var rows int
+	for done := false; !done; {
+		err = func() (err error) {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err != nil {
+					_ = tx.Rollback()
+				}
+			}()
+			stmt, err := tx.PrepareContext(ctx, query)
+			if err != nil {
+				return err
+			}
+			defer closeErr(stmt, &err)
+
+			values := make([]any, len(columns))
+			for n := 0; n < fileLoadBatchSize; n++ {
+				row, e := r.read()
+				if e == io.EOF {
+					done = true
+					break
+				}
+				if e != nil {
+					return e
+				}
+				rows++
+
+				for i, column := range columns {
+					values[i] = nil
+					if column.index >= 0 {
+						values[i] = column.value(row[column.index])
+					}
+				}
+				if _, e = stmt.ExecContext(ctx, values...); e != nil {
+					return fmt.Errorf("row %d of %s: %w", rows, c.path, e)
+				}
+			}
+
+			return tx.Commit()
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("loaded %d rows of %s as table %s, key columns: %s\n", rows, c.path, table, strings.Join(keynames, ", "))
+	return nil
+} // }}}
+
+// loadFileTable : load the file of a csv or parquet side as its table of arg, shaped like the
+// table of the other side. Both sides cannot be files, see New
+func loadFileTable(ctx context.Context, dbSrc *DB, dbTgt *DB, arg *envarg, log *logrus.Logger) error { // {{{
+	if dbSrc.file != nil {
+		return dbSrc.file.load(ctx, dbSrc, arg.ArgSrcTable, dbTgt, arg.ArgTgtTable, arg, log)
+	}
+	if dbTgt.file != nil {
+		return dbTgt.file.load(ctx, dbTgt, arg.ArgTgtTable, dbSrc, arg.ArgSrcTable, arg, log)
+	}
+	return nil
+} // }}}
+
+// LoadFile : load the file of a csv or parquet side as its table, like a run of tablesrc and
+// tabletgt with keycolumns and ignorefields loads it, for query to read the rows of a file source
+func LoadFile(dbSrc *DB, dbTgt *DB, tablesrc string, tabletgt string, keycolumns []string, ignorefields []string, log *logrus.Logger) error { // {{{
+	return loadFileTable(context.Background(), dbSrc, dbTgt, &envarg{
+		ArgSrcTable:     tablesrc,
+		ArgTgtTable:     tabletgt,
+		ArgKeyColumns:   keycolumns,
+		ArgIgnoreFields: orEmpty(ignorefields),
+	}, log)
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,319 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+func TestFileOptions(t *testing.T) { // {{{
+	null := `\N`
+	empty := ""
+
+	tests := []struct {
+		name    string
+		c       Connection
+		want    fileOptions
+		wantErr string
+	}{
+		{"defaults", Connection{DBName: "a.csv"}, fileOptions{delimiter: ',', header: true}, ""},
+		{
+			"DSN parameters",
+			Connection{DSN: `a.csv?delimiter=;&header=false&null=\N`},
+			fileOptions{delimiter: ';', header: false, null: &null},
+			"",
+		},
+		{
+			"params override DSN",
+			Connection{DSN: "a.csv?delimiter=|", Params: map[string]string{"delimiter": "\t", "null": ""}},
+			fileOptions{delimiter: '\t', header: true, null: &empty},
+			"",
+		},
+		{
+			"columns",
+			Connection{DBName: "a.csv", Params: map[string]string{"columns": "Employee No:emp_no,Comment:"}},
+			fileOptions{delimiter: ',', header: true, columns: map[string]string{"Employee No": "emp_no", "Comment": ""}},
+			"",
+		},
+		{"unknown parameter", Connection{DBName: "a.csv", Params: map[string]string{"quote": "'"}}, fileOptions{}, "unknown parameter quote"},
+		{"long delimiter", Connection{DBName: "a.csv", Params: map[string]string{"delimiter": "||"}}, fileOptions{}, "delimiter should be one character"},
+		{"bad header", Connection{DBName: "a.csv", Params: map[string]string{"header": "yes"}}, fileOptions{}, "header should be true or false"},
+		{"bad columns", Connection{DBName: "a.csv", Params: map[string]string{"columns": "emp_no"}}, fileOptions{}, "columns should be pairs"},
+		{"host", Connection{DBName: "a.csv", Host: "db1"}, fileOptions{}, "host, port and socket are not used"},
+		{"timeout", Connection{DBName: "a.csv", Timeout: time.Second}, fileOptions{}, "timeouts are not used"},
+	}
+
+	params := []string{"delimiter", "header", "null", "columns"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, e := tt.c.fileOptions(params)
+			if tt.wantErr != "" {
+				if e == nil || !strings.Contains(e.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", e, tt.wantErr)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fileOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+} // }}}
+
+func TestFileColumnValue(t *testing.T) { // {{{
+	tests := []struct {
+		name      string
+		column    fileColumn
+		v         any
+		wantType  string
+		wantValue any
+	}{
+		{"int", fileColumn{datatype: "int", columntype: "int(11)"}, "12", "INTEGER", "12"},
+		{"unsigned bigint", fileColumn{datatype: "bigint", columntype: "bigint(20) unsigned"}, "18446744073709551615", "TEXT", "18446744073709551615"},
+		{"unsigned bigint key", fileColumn{datatype: "bigint", columntype: "bigint(20) unsigned", key: true}, "1", "INTEGER", "1"},
+		{"year", fileColumn{datatype: "year", columntype: "year(4)"}, "2023", "INTEGER", "2023"},
+		{"double", fileColumn{datatype: "double", columntype: "double"}, 1.5, "REAL", 1.5},
+		{"decimal scale", fileColumn{datatype: "decimal", columntype: "decimal(10,2)"}, "12.3", "TEXT", "12.30"},
+		{"decimal rounded", fileColumn{datatype: "decimal", columntype: "decimal(10,2)"}, "1.005", "TEXT", "1.01"},
+		{"decimal not a number", fileColumn{datatype: "decimal", columntype: "decimal(10,2)"}, "n/a", "TEXT", "n/a"},
+		{"date", fileColumn{datatype: "date", columntype: "date"}, time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), "DATE", "2023-01-02"},
+		{"datetime", fileColumn{datatype: "datetime", columntype: "datetime"}, time.Date(2023, 1, 2, 3, 4, 5, 600000000, time.UTC), "DATETIME", "2023-01-02 03:04:05"},
+		{"datetime fraction", fileColumn{datatype: "datetime", columntype: "datetime(3)"}, time.Date(2023, 1, 2, 3, 4, 5, 600000000, time.UTC), "DATETIME", "2023-01-02 03:04:05.600"},
+		{"timestamp", fileColumn{datatype: "timestamp", columntype: "timestamp(6)"}, time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), "DATETIME", "2023-01-02 03:04:05.000000"},
+		{"datetime text", fileColumn{datatype: "datetime", columntype: "datetime(3)"}, "2023-01-02 03:04:05.6", "DATETIME", "2023-01-02 03:04:05.600"},
+		{"datetime text ISO", fileColumn{datatype: "timestamp", columntype: "timestamp"}, "2023-01-02T03:04:05Z", "DATETIME", "2023-01-02 03:04:05"},
+		{"date text", fileColumn{datatype: "date", columntype: "date"}, "2023-01-02", "DATE", "2023-01-02"},
+		{"datetime not a time", fileColumn{datatype: "datetime", columntype: "datetime"}, "0000-00-00 00:00:00", "DATETIME", "0000-00-00 00:00:00"},
+		{"time", fileColumn{datatype: "time", columntype: "time"}, time.Time{}.Add(90 * time.Minute), "TEXT", "01:30:00"},
+		{"binary", fileColumn{datatype: "varbinary", columntype: "varbinary(16)"}, "ab", "BLOB", []byte("ab")},
+		{"text", fileColumn{datatype: "varchar", columntype: "varchar(20)"}, "ab", "TEXT", "ab"},
+		{"NULL", fileColumn{datatype: "int", columntype: "int"}, nil, "INTEGER", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.column.sqliteType(); got != tt.wantType {
+				t.Errorf("sqliteType() = %s, want %s", got, tt.wantType)
+			}
+			if got := tt.column.value(tt.v); !reflect.DeepEqual(got, tt.wantValue) {
+				t.Errorf("value(%v) = %#v, want %#v", tt.v, got, tt.wantValue)
+			}
+		})
+	}
+} // }}}
+
+// parquetEmp : row of the parquet file of TestLoadFile
+type parquetEmp struct { // {{{
+	ID      int64   `parquet:"name=id, type=INT64"`
+	Amount  *int64  `parquet:"name=amount, type=INT64, convertedtype=DECIMAL, scale=2, precision=10, repetitiontype=OPTIONAL"`
+	Hired   int32   `parquet:"name=hired, type=INT32, convertedtype=DATE"`
+	Updated int64   `parquet:"name=updated, type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MILLIS"`
+	Note    *string `parquet:"name=note, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Big     int64   `parquet:"name=big, type=INT64, convertedtype=UINT_64"` // unsigned bits
+} // }}}
+
+// writeParquet : parquet file of rows
+func writeParquet(t *testing.T, path string, rows []parquetEmp) { // {{{
+	t.Helper()
+	f, e := os.Create(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer f.Close()
+
+	pw, e := writer.NewParquetWriter(parquetFile{f}, new(parquetEmp), 1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, row := range rows {
+		if e := pw.Write(row); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := pw.WriteStop(); e != nil {
+		t.Fatal(e)
+	}
+} // }}}
+
+func TestLoadFile(t *testing.T) { // {{{
+	amount, note := int64(1230), "x,y"
+	hired := int32(time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+	updated := time.Date(2023, 1, 2, 3, 4, 5, 600000000, time.UTC).UnixMilli()
+
+	// rows of the loaded table as SQL literals, datetimes of SQLite are text kept as in the csv
+	want := []string{
+		"1|'12.30'|'2023-01-02'|'2023-01-02 03:04:05.600'|'x,y'|'18446744073709551615'",
+		"2|NULL|'2023-01-02'|'2023-01-02 03:04:05.600'|NULL|'0'",
+	}
+
+	tests := []struct {
+		name    string
+		driver  string
+		params  map[string]string
+		content string       // csv file
+		rows    []parquetEmp // parquet file
+		keys    []string     // --key-columns
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "csv",
+			driver:  "csv",
+			params:  map[string]string{"null": ""},
+			content: "id,amount,hired,updated,note,big\n1,12.3,2023-01-02,2023-01-02 03:04:05.600,\"x,y\",18446744073709551615\n2,,2023-01-02,2023-01-02 03:04:05.600,,0\n",
+			want:    want,
+		},
+		{
+			name:    "csv without header",
+			driver:  "csv",
+			params:  map[string]string{"null": `\N`, "delimiter": ";", "header": "false"},
+			content: "1;12.30;2023-01-02;2023-01-02 03:04:05.600;x,y;18446744073709551615\n2;\\N;2023-01-02;2023-01-02 03:04:05.600;\\N;0\n",
+			want:    want,
+		},
+		{
+			name:    "csv columns mapped",
+			driver:  "csv",
+			params:  map[string]string{"null": "", "columns": "Amount:amount,Extra:"},
+			content: "id,Amount,hired,updated,note,big,Extra\n1,12.3,2023-01-02,2023-01-02 03:04:05.600,\"x,y\",18446744073709551615,e\n2,,2023-01-02,2023-01-02 03:04:05.600,,0,e\n",
+			want:    want,
+		},
+		{
+			name:   "parquet",
+			driver: "parquet",
+			rows: []parquetEmp{
+				{ID: 1, Amount: &amount, Hired: hired, Updated: updated, Note: &note, Big: -1},
+				{ID: 2, Hired: hired, Updated: updated},
+			},
+			want: want,
+		},
+		{
+			name:    "missing column",
+			driver:  "csv",
+			content: "id,amount\n1,2\n",
+			wantErr: "column hired of table emp is not in the file",
+		},
+		{
+			name:    "unknown column",
+			driver:  "csv",
+			content: "id,amount,hired,updated,note,big,bonus\n",
+			wantErr: "file column bonus is not a column of table emp",
+		},
+		{
+			name:    "duplicate key",
+			driver:  "csv",
+			params:  map[string]string{"null": ""},
+			content: "id,amount,hired,updated,note,big\n1,,2023-01-02,2023-01-02,,0\n1,,2023-01-02,2023-01-02,,0\n",
+			wantErr: "row 2 of",
+		},
+		{
+			name:    "text key columns",
+			driver:  "csv",
+			content: "id,amount,hired,updated,note,big\n",
+			keys:    []string{"note"},
+			want:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			fixture := filepath.Join(dir, "fixture.db")
+			db, e := sql.Open("sqlite", fixture)
+			if e == nil {
+				_, e = db.Exec("CREATE TABLE emp (id INT, amount DECIMAL(10,2), hired DATE, updated DATETIME(3), note VARCHAR(20), big BIGINT UNSIGNED, PRIMARY KEY (id))")
+			}
+			if e == nil {
+				e = db.Close()
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			path := filepath.Join(dir, "emp."+tt.driver)
+			if tt.driver == "parquet" {
+				writeParquet(t, path, tt.rows)
+			} else if e := os.WriteFile(path, []byte(tt.content), 0o600); e != nil {
+				t.Fatal(e)
+			}
+
+			dbLike, e := InitializeDBSettings(Connection{Driver: "sqlite", DBName: fixture})
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer func() {
+				if e := dbLike.Close(); e != nil {
+					t.Error(e)
+				}
+			}()
+			dbFile, e := InitializeDBSettings(Connection{Driver: tt.driver, DBName: path, Params: tt.params})
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer func() {
+				if e := dbFile.Close(); e != nil {
+					t.Error(e)
+				}
+			}()
+
+			e = LoadFile(dbFile, dbLike, "emp", "emp", tt.keys, nil, discardLogger())
+			if tt.wantErr != "" {
+				if e == nil || !strings.Contains(e.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", e, tt.wantErr)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			rows, e := dbFile.Query(`SELECT quote(id) || '|' || quote(amount) || '|' || quote(hired) || '|' || quote(updated) || '|' || quote(note) || '|' || quote(big) FROM emp ORDER BY id`)
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer rows.Close()
+			got := []string{}
+			for rows.Next() {
+				var row string
+				if e := rows.Scan(&row); e != nil {
+					t.Fatal(e)
+				}
+				got = append(got, row)
+			}
+			if e := rows.Err(); e != nil {
+				t.Fatal(e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loaded rows\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,135 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlDialect : MySQL and compatible servers, the SQL the queries are written in
+func mysqlDialect() *dialect { // {{{
+	return &dialect{
+		name: "mysql",
+		connector: func(c Connection) (driver.Connector, error) {
+			cfg, e := c.mysqlConfig()
+			if e != nil {
+				return nil, e
+			}
+			return mysql.NewConnector(cfg)
+		},
+		describe: func(c Connection) string {
+			cfg, e := c.mysqlConfig()
+			if e != nil {
+				return ""
+			}
+			return fmt.Sprintf("%s@%s(%s)/%s", cfg.User, cfg.Net, cfg.Addr, cfg.DBName)
+		},
+		hashAlgorithms:  hashAlgorithms(),
+		rowEncodings:    rowEncodings(),
+		chunkAggregates: mysqlChunkAggregates(),
+		textExpr: func(column string) string {
+			return "CONCAT(" + column + ")"
+		},
+		valuesList: parenthesizedList,
+		// text literals also read backslash escapes
+		literal: func(quoted string) string {
+			if strings.HasPrefix(quoted, "'") {
+				return strings.ReplaceAll(quoted, `\`, `\\`)
+			}
+			return quoted
+		},
+
+		columnsQuery: `
+    SELECT SQL_NO_CACHE COLUMN_NAME
+    FROM INFORMATION_SCHEMA.COLUMNS
+    WHERE TABLE_SCHEMA = database()
+      AND TABLE_NAME = ?
+    ORDER BY ORDINAL_POSITION
+    `,
+		baseTablesQuery: `
+    SELECT SQL_NO_CACHE TABLE_NAME
+    FROM INFORMATION_SCHEMA.TABLES
+    WHERE TABLE_SCHEMA = database()
+      AND TABLE_TYPE = 'BASE TABLE'
+    ORDER BY TABLE_NAME
+    `,
+		keyColumnsQuery: `
+    SELECT SQL_NO_CACHE
+      column_name,
+      data_type,
+      column_type
+    FROM information_schema.columns
+    WHERE table_schema = database()
+      and table_name = ?
+    `,
+		keyIndexQuery: `
+    SELECT SQL_NO_CACHE
+      sta.index_name,
+      sta.column_name,
+      col.is_nullable
+    FROM information_schema.statistics as sta
+    INNER JOIN information_schema.columns as col
+    ON sta.table_schema = col.table_schema
+      and sta.table_name = col.table_name
+      and sta.column_name = col.column_name
+    WHERE sta.table_schema = database()
+      and sta.table_name = ?
+      and sta.non_unique = 0
+    ORDER BY
+      sta.index_name,
+      sta.seq_in_index;
+    `,
+		chunkIndexQuery: `
+    SELECT SQL_NO_CACHE
+      sta.column_name,
+      col.is_nullable
+    FROM information_schema.statistics as sta
+    INNER JOIN information_schema.columns as col
+    ON sta.table_schema = col.table_schema
+      and sta.table_name = col.table_name
+      and sta.column_name = col.column_name
+    WHERE sta.table_schema = database()
+      and sta.table_name = ?
+      and sta.index_name = ?
+    ORDER BY sta.seq_in_index;
+    `,
+		tableRowsQuery: `
+    SELECT SQL_NO_CACHE COALESCE(table_rows, 0)
+    FROM information_schema.tables
+    WHERE table_schema = database()
+      and table_name = ?
+    `,
+
+		groupConcatMaxLenQuery: "SELECT @@SESSION.group_concat_max_len",
+		connectionIDQuery:      "SELECT CONNECTION_ID()",
+		killQuery:              "KILL QUERY %d",
+		snapshotStmts: []string{
+			"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ", // a consistent snapshot needs repeatable read
+			"START TRANSACTION WITH CONSISTENT SNAPSHOT",
+		},
+		snapshotPosition: true,
+		threadsRunning:   threadsRunning,
+		replicaLag:       replicaLag,
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
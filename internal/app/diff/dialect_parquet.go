@@ -0,0 +1,270 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/types"
+)
+
+// parquetFile : source.ParquetFile of a local file, opened again by the reader for each column
+type parquetFile struct { // {{{
+	*os.File
+} // }}}
+
+func (f parquetFile) Open(name string) (source.ParquetFile, error) { // {{{
+	if name == "" {
+		name = f.Name()
+	}
+	g, e := os.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	return parquetFile{g}, nil
+} // }}}
+
+func (f parquetFile) Create(name string) (source.ParquetFile, error) { // {{{
+	return nil, errors.New("parquet files are only read")
+} // }}}
+
+/*
+parquetConverter : converter of the values of a column of schema element se to the values of a
+MySQL column. Decimals are text of their scale, dates, times and timestamps are time.Time in UTC,
+unsigned integers stay unsigned and booleans are 1 and 0
+
+	DECIMAL(10,2) 1230 -> '12.30'
+	DATE 19000 -> 2022-01-08
+*/
+func parquetConverter(se *parquet.SchemaElement) func(v any) any { // {{{
+	lt := se.GetLogicalType()
+	if lt == nil {
+		lt = parquet.NewLogicalType()
+	}
+	converted := parquet.ConvertedType(-1)
+	if se.IsSetConvertedType() {
+		converted = se.GetConvertedType()
+	}
+
+	// unit : time unit of the logical type, or of the converted type if there is none
+	unit := func(tu *parquet.TimeUnit, millis bool) time.Duration {
+		switch {
+		case tu == nil && millis, tu != nil && tu.IsSetMILLIS():
+			return time.Millisecond
+		case tu != nil && tu.IsSetNANOS():
+			return time.Nanosecond
+		default:
+			return time.Microsecond
+		}
+	}
+
+	integer := func(v any) int64 {
+		if x, isint32 := v.(int32); isint32 {
+			return int64(x)
+		}
+		return v.(int64)
+	}
+
+	switch {
+	case lt.IsSetDECIMAL() || converted == parquet.ConvertedType_DECIMAL:
+		scale := se.GetScale()
+		if lt.IsSetDECIMAL() {
+			scale = lt.GetDECIMAL().GetScale()
+		}
+		denominator := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+		return func(v any) any {
+			unscaled := new(big.Int)
+			if b, isbytes := v.(string); isbytes { // big-endian two's complement
+				unscaled.SetBytes([]byte(b))
+				if len(b) > 0 && b[0]&0x80 != 0 {
+					unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+				}
+			} else {
+				unscaled.SetInt64(integer(v))
+			}
+			return new(big.Rat).SetFrac(unscaled, denominator).FloatString(int(scale))
+		}
+
+	case lt.IsSetDATE() || converted == parquet.ConvertedType_DATE:
+		return func(v any) any {
+			return time.Unix(integer(v)*24*60*60, 0).UTC()
+		}
+
+	case lt.IsSetTIMESTAMP() || converted == parquet.ConvertedType_TIMESTAMP_MILLIS || converted == parquet.ConvertedType_TIMESTAMP_MICROS:
+		var tu *parquet.TimeUnit
+		if lt.IsSetTIMESTAMP() {
+			tu = lt.GetTIMESTAMP().GetUnit()
+		}
+		u := unit(tu, converted == parquet.ConvertedType_TIMESTAMP_MILLIS)
+		return func(v any) any {
+			x := integer(v)
+			return time.Unix(x/int64(time.Second/u), x%int64(time.Second/u)*int64(u)).UTC()
+		}
+
+	case lt.IsSetTIME() || converted == parquet.ConvertedType_TIME_MILLIS || converted == parquet.ConvertedType_TIME_MICROS:
+		var tu *parquet.TimeUnit
+		if lt.IsSetTIME() {
+			tu = lt.GetTIME().GetUnit()
+		}
+		u := unit(tu, converted == parquet.ConvertedType_TIME_MILLIS)
+		return func(v any) any {
+			return time.Time{}.Add(time.Duration(integer(v)) * u)
+		}
+
+	case lt.IsSetINTEGER() && !lt.GetINTEGER().GetIsSigned(),
+		converted >= parquet.ConvertedType_UINT_8 && converted <= parquet.ConvertedType_UINT_64:
+		return func(v any) any {
+			if x, isint32 := v.(int32); isint32 {
+				return int64(uint32(x))
+			}
+			return strconv.FormatUint(uint64(v.(int64)), 10)
+		}
+
+	case se.GetType() == parquet.Type_INT96: // legacy timestamp
+		return func(v any) any {
+			return types.INT96ToTime(v.(string))
+		}
+	}
+
+	return func(v any) any {
+		switch x := v.(type) {
+		case bool:
+			if x {
+				return int64(1)
+			}
+			return int64(0)
+		case int32:
+			return int64(x)
+		case float32: // shortest text of the float, not of its double
+			f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(x), 'g', -1, 32), 64)
+			return f
+		}
+		return v // int64, float64 and byte arrays as string
+	}
+} // }}}
+
+// parquetReader : rows of a parquet file with flat schema, read a batch of each column at a time
+type parquetReader struct { // {{{
+	f          *os.File
+	pr         *reader.ParquetReader
+	names      []string
+	paths      []string
+	converters []func(v any) any
+	rows       int64   // rows of the file not read into batch
+	batch      [][]any // values of each column of the rows read
+	next       int     // row of batch read next
+} // }}}
+
+// openParquet : reader of the parquet file at path, columns are named by its schema
+func openParquet(path string, o fileOptions, columns []string) (fileReader, error) { // {{{
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+
+	pr, e := reader.NewParquetColumnReader(parquetFile{f}, 1)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, e)
+	}
+
+	r := &parquetReader{f: f, pr: pr, rows: pr.GetNumRows()}
+	sh := pr.SchemaHandler
+	for _, columnpath := range sh.ValueColumns {
+		i := sh.MapIndex[columnpath]
+		se := sh.SchemaElements[i]
+		if strings.Count(columnpath, common.PAR_GO_PATH_DELIMITER) != 1 ||
+			se.GetRepetitionType() == parquet.FieldRepetitionType_REPEATED {
+			r.close()
+			return nil, fmt.Errorf(
+				"column %s of %s is nested or repeated, only flat schemas are supported",
+				strings.Join(common.StrToPath(sh.InPathToExPath[columnpath])[1:], "."), path,
+			)
+		}
+
+		r.names = append(r.names, sh.GetExName(int(i)))
+		r.paths = append(r.paths, columnpath)
+		r.converters = append(r.converters, parquetConverter(se))
+	}
+	r.batch = make([][]any, len(r.paths))
+
+	return r, nil
+} // }}}
+
+func (r *parquetReader) columns() []string { // {{{
+	return r.names
+} // }}}
+
+func (r *parquetReader) read() (row []any, e error) { // {{{
+	if len(r.batch) == 0 || r.next == len(r.batch[0]) {
+		if r.rows == 0 {
+			return nil, io.EOF
+		}
+
+		n := r.rows
+		if n > fileLoadBatchSize {
+			n = fileLoadBatchSize
+		}
+		for c, columnpath := range r.paths {
+			values, _, _, e := r.pr.ReadColumnByPath(columnpath, n)
+			if e != nil {
+				return nil, e
+			}
+			if int64(len(values)) != n {
+				return nil, fmt.Errorf("column %s has %d values of %d rows", r.names[c], len(values), n)
+			}
+			r.batch[c] = values
+		}
+		r.rows -= n
+		r.next = 0
+	}
+
+	row = make([]any, len(r.paths))
+	for c, values := range r.batch {
+		if values[r.next] != nil {
+			row[c] = r.converters[c](values[r.next])
+		}
+	}
+	r.next++
+
+	return
+} // }}}
+
+func (r *parquetReader) close() error { // {{{
+	r.pr.ReadStop()
+	return r.f.Close()
+} // }}}
+
+// parquetDialect : parquet file of flat schema, values are converted by parquetConverter and then to
+// the column types of the table of the other side when loaded
+func parquetDialect() *dialect { // {{{
+	return fileDialect("parquet", []string{"columns"}, openParquet)
+} // }}}
+
+// vim: fdm=marker fdc=2
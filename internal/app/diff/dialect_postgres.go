@@ -0,0 +1,426 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresFoldHex : first 16 hex digits of hexexpr as unsigned 64 bit integer, like foldHex of
+// MySQL. The BIGINT of the bits is two's complement, it is made unsigned in NUMERIC
+func postgresFoldHex(hexexpr string) string { // {{{
+	return "MOD(CAST(CAST(CAST('x' || LEFT(" + hexexpr + ", 16) AS BIT(64)) AS BIGINT) AS NUMERIC) + 18446744073709551616, 18446744073709551616)"
+} // }}}
+
+// postgresSHA2 : hex digest of the UTF-8 bytes of expr, like SHA2 of MySQL
+func postgresSHA2(expr string, bits string) string { // {{{
+	return "ENCODE(SHA" + bits + "(CONVERT_TO(" + expr + ", 'UTF8')), 'hex')"
+} // }}}
+
+// postgresHashAlgorithms : --hash of PostgreSQL, same values as hashAlgorithms of MySQL. CRC32
+// and SHA1 are not built in
+func postgresHashAlgorithms() map[string]func(expr string) string { // {{{
+	return map[string]func(expr string) string{
+		"md5": func(expr string) string {
+			return postgresFoldHex("MD5(" + expr + ")")
+		},
+		"md5-full": func(expr string) string {
+			return "MD5(" + expr + ")"
+		},
+		"sha256": func(expr string) string {
+			return postgresFoldHex(postgresSHA2(expr, "256"))
+		},
+		"sha256-full": func(expr string) string {
+			return postgresSHA2(expr, "256")
+		},
+		"sha512-full": func(expr string) string {
+			return postgresSHA2(expr, "512")
+		},
+	}
+} // }}}
+
+// postgresRowEncodings : --row-encoding of PostgreSQL, same text as rowEncodings of MySQL for
+// values rendered alike by both engines
+func postgresRowEncodings() map[string]func(columns []string) string { // {{{
+	return map[string]func(columns []string) string{
+		"concat-ws": func(columns []string) string {
+			return "CONCAT_WS('#'," + strings.Join(columns, ",") + ")"
+		},
+		"null-safe": func(columns []string) string {
+			fields := make([]string, len(columns))
+			for i, column := range columns {
+				fields[i] = "CASE WHEN " + column + " IS NULL THEN 'N' ELSE CONCAT('V', OCTET_LENGTH(CAST(" + column + " AS TEXT)), ':', " + column + ") END"
+			}
+			return "CONCAT(" + strings.Join(fields, ",") + ")"
+		},
+	}
+} // }}}
+
+// postgresChunkAggregates : --chunk-aggregate of PostgreSQL. BIT_XOR is on signed BIGINT, it
+// cannot add up the unsigned row hashes
+func postgresChunkAggregates() map[string]aggregateExpr { // {{{
+	return map[string]aggregateExpr{
+		"group-concat": func(hash func(string) string, rowhash string, pkcolumns []string) string {
+			return hash(`
+          STRING_AGG(
+            CAST(` + rowhash + ` AS TEXT), ','
+            )
+          `)
+		},
+		"group-concat-ordered": func(hash func(string) string, rowhash string, pkcolumns []string) string {
+			return hash(`
+          STRING_AGG(
+            CAST(` + rowhash + ` AS TEXT), ','
+            ORDER BY ` + strings.Join(pkcolumns, ",") + `
+            )
+          `)
+		},
+		"sum": func(hash func(string) string, rowhash string, pkcolumns []string) string {
+			return "CAST(SUM(" + rowhash + ") AS DECIMAL(65,0))"
+		},
+	}
+} // }}}
+
+// postgresTLSModes : sslmode of the TLS modes of Connection, pq has no TLS with plaintext fallback
+func postgresTLSModes() map[string]string { // {{{
+	return map[string]string{
+		tlsDisabled:       "disable",
+		tlsRequired:       "require",
+		tlsVerifyCA:       "verify-ca",
+		tlsVerifyIdentity: "verify-full",
+	}
+} // }}}
+
+// parseConnInfo : key=value pairs of a libpq connection string, values may be single quoted with
+// backslash escapes
+func parseConnInfo(conninfo string) (opts map[string]string, err error) { // {{{
+	opts = map[string]string{}
+
+	s := []rune(conninfo)
+	i := 0
+	isSpace := func() bool {
+		return s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r'
+	}
+	skipSpaces := func() {
+		for i < len(s) && isSpace() {
+			i++
+		}
+	}
+
+	for skipSpaces(); i < len(s); skipSpaces() {
+		start := i
+		for i < len(s) && s[i] != '=' && !isSpace() {
+			i++
+		}
+		key := string(s[start:i])
+		skipSpaces()
+		if i == len(s) || s[i] != '=' {
+			return nil, fmt.Errorf(`missing "=" after %q in DSN`, key)
+		}
+		i++
+		skipSpaces()
+
+		var value []rune
+		quoted := i < len(s) && s[i] == '\''
+		if quoted {
+			i++
+		}
+		for ; i < len(s); i++ {
+			if quoted && s[i] == '\'' {
+				break
+			}
+			if !quoted && isSpace() {
+				break
+			}
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			value = append(value, s[i])
+		}
+		if quoted {
+			if i == len(s) {
+				return nil, errors.New("unterminated quoted value in DSN")
+			}
+			i++
+		}
+		opts[key] = string(value)
+	}
+
+	return
+} // }}}
+
+// postgresOptions : pq connection options. DSN is a postgres:// URL or a key=value connection
+// string, the other settings override its parts when set. Socket is the directory of the server
+// socket, ReadTimeout becomes statement_timeout
+func (c Connection) postgresOptions() (opts map[string]string, err error) { // {{{
+	dsn := c.DSN
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DSN: %w", err)
+		}
+	}
+	opts, err = parseConnInfo(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	set := func(key string, value string) {
+		if value != "" {
+			opts[key] = value
+		}
+	}
+	set("user", c.Username)
+	set("password", c.Password)
+	set("dbname", c.DBName)
+	if c.Socket != "" {
+		if c.Host != "" {
+			return nil, errors.New("socket and host are mutual exclusive")
+		}
+		opts["host"] = c.Socket
+	}
+	set("host", c.Host)
+	set("port", c.Port)
+
+	if c.Timeout > 0 {
+		opts["connect_timeout"] = strconv.Itoa(int(math.Ceil(c.Timeout.Seconds())))
+	}
+	if c.ReadTimeout > 0 {
+		opts["statement_timeout"] = strconv.FormatInt(c.ReadTimeout.Milliseconds(), 10)
+	}
+	if c.WriteTimeout > 0 {
+		return nil, errors.New("write timeout is not supported by postgres")
+	}
+
+	// other parameters are server settings of the session, e.g. search_path
+	for name, value := range c.Params {
+		opts[name] = value
+	}
+
+	if mode := c.tlsMode(); mode != "" {
+		if (c.TLSCert == "") != (c.TLSKey == "") {
+			return nil, errors.New("TLS client certificate and key should be set together")
+		}
+		sslmode, exists := postgresTLSModes()[mode]
+		if !exists {
+			return nil, fmt.Errorf("TLS mode %s is not supported by postgres", mode)
+		}
+		if mode == tlsDisabled && (c.TLSCA != "" || c.TLSCert != "") {
+			return nil, errors.New("TLS CA and client certificate require a TLS mode other than disabled")
+		}
+		opts["sslmode"] = sslmode
+		set("sslrootcert", c.TLSCA)
+		set("sslcert", c.TLSCert)
+		set("sslkey", c.TLSKey)
+	}
+
+	return
+} // }}}
+
+// postgresConnInfo : opts as key=value connection string of pq
+func postgresConnInfo(opts map[string]string) string { // {{{
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "='" + escape.Replace(opts[key]) + "'"
+	}
+
+	return strings.Join(pairs, " ")
+} // }}}
+
+// postgresThreadsRunning : sessions running a query, like Threads_running of MySQL
+func postgresThreadsRunning(db *sql.DB) (threads int, err error) { // {{{
+	err = db.QueryRow("SELECT COUNT(1) FROM pg_stat_activity WHERE state = 'active'").Scan(&threads)
+
+	return
+} // }}}
+
+// postgresReplicaLag : time since the last transaction replayed by the standby db, running is
+// false if db is not a standby
+func postgresReplicaLag(db *sql.DB) (lag time.Duration, running bool, err error) { // {{{
+	var seconds float64
+	err = db.QueryRow(`
+    SELECT
+      pg_is_in_recovery(),
+      COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+    `).Scan(&running, &seconds)
+	if err != nil || !running {
+		return 0, false, err
+	}
+	return time.Duration(seconds * float64(time.Second)), true, nil
+} // }}}
+
+// postgresKeyIndexes : key columns of the indexes of a table, expression and partial indexes are
+// left out, their columns are no key of the rows
+const postgresKeyIndexes = `
+    FROM pg_index AS ix
+    INNER JOIN pg_class AS tc ON tc.oid = ix.indrelid
+    INNER JOIN pg_class AS ic ON ic.oid = ix.indexrelid
+    CROSS JOIN LATERAL unnest(CAST(ix.indkey AS SMALLINT[])) WITH ORDINALITY AS k(attnum, seq)
+    INNER JOIN pg_attribute AS att ON att.attrelid = tc.oid AND att.attnum = k.attnum
+    WHERE tc.relnamespace = CAST(current_schema() AS REGNAMESPACE)
+      and ix.indexprs IS NULL
+      and ix.indpred IS NULL
+      and k.seq <= ix.indnkeyatts`
+
+// postgresDialect : PostgreSQL 11 or later through lib/pq. Queries get numbered placeholders, and
+// a query is cancelled by the driver once its context is done
+func postgresDialect() *dialect { // {{{
+	return &dialect{
+		name: "postgres",
+		connector: func(c Connection) (driver.Connector, error) {
+			opts, e := c.postgresOptions()
+			if e != nil {
+				return nil, e
+			}
+			connector, e := pq.NewConnector(postgresConnInfo(opts))
+			if e != nil {
+				return nil, e
+			}
+			return rewriteConnector{Connector: connector, rewrite: numberedPlaceholders}, nil
+		},
+		describe: func(c Connection) string {
+			opts, e := c.postgresOptions()
+			if e != nil {
+				return ""
+			}
+			host, port := opts["host"], opts["port"]
+			if host == "" {
+				host = "localhost"
+			}
+			if port == "" {
+				port = "5432"
+			}
+			if strings.HasPrefix(host, "/") {
+				return fmt.Sprintf("%s@unix(%s)/%s", opts["user"], host, opts["dbname"])
+			}
+			return fmt.Sprintf("%s@tcp(%s)/%s", opts["user"], host+":"+port, opts["dbname"])
+		},
+		hashAlgorithms:  postgresHashAlgorithms(),
+		rowEncodings:    postgresRowEncodings(),
+		chunkAggregates: postgresChunkAggregates(),
+		textExpr: func(column string) string {
+			return "CAST(" + column + " AS TEXT)"
+		},
+		valuesList: parenthesizedList,
+		// bytea has no X'' literal, standard_conforming_strings keeps backslashes of text as is
+		literal: func(quoted string) string {
+			if strings.HasPrefix(quoted, "X'") {
+				return `'\x` + quoted[2:] + "::bytea"
+			}
+			return quoted
+		},
+		dataTypes: map[string]string{
+			"text":                        "varchar",
+			"uuid":                        "char",
+			"bytea":                       "varbinary",
+			"numeric":                     "decimal",
+			"real":                        "float",
+			"double precision":            "double",
+			"timestamp without time zone": "datetime",
+			"timestamp with time zone":    "timestamp",
+		},
+		unlikeTypes: map[string]string{
+			"boolean":                  "true and false are t and f",
+			"real":                     "floats have other digits and exponents",
+			"double precision":         "floats have other digits and exponents",
+			"timestamp with time zone": "values have their UTC offset",
+			"time with time zone":      "values have their UTC offset",
+			"bytea":                    "bytes are \\x hex",
+			"bit":                      "bits are 0 and 1 digits",
+			"bit varying":              "bits are 0 and 1 digits",
+			"interval":                 "intervals are PostgreSQL text",
+			"money":                    "amounts have the currency symbol",
+		},
+
+		columnsQuery: `
+    SELECT column_name
+    FROM information_schema.columns
+    WHERE table_schema = current_schema()
+      and table_name = ?
+    ORDER BY ordinal_position
+    `,
+		baseTablesQuery: `
+    SELECT table_name
+    FROM information_schema.tables
+    WHERE table_schema = current_schema()
+      and table_type = 'BASE TABLE'
+    ORDER BY table_name
+    `,
+		keyColumnsQuery: `
+    SELECT
+      column_name,
+      data_type,
+      udt_name
+    FROM information_schema.columns
+    WHERE table_schema = current_schema()
+      and table_name = ?
+    `,
+		keyIndexQuery: `
+    SELECT
+      CASE WHEN ix.indisprimary THEN 'PRIMARY' ELSE CAST(ic.relname AS TEXT) END AS index_name,
+      CAST(att.attname AS TEXT) AS column_name,
+      CASE WHEN att.attnotnull THEN 'NO' ELSE 'YES' END AS is_nullable` + postgresKeyIndexes + `
+      and tc.relname = ?
+      and ix.indisunique
+    ORDER BY
+      index_name,
+      k.seq
+    `,
+		chunkIndexQuery: `
+    SELECT
+      CAST(att.attname AS TEXT) AS column_name,
+      CASE WHEN att.attnotnull THEN 'NO' ELSE 'YES' END AS is_nullable` + postgresKeyIndexes + `
+      and tc.relname = ?
+      and ic.relname = ?
+    ORDER BY k.seq
+    `,
+		tableRowsQuery: `
+    SELECT CAST(GREATEST(reltuples, 0) AS BIGINT)
+    FROM pg_class
+    WHERE relnamespace = CAST(current_schema() AS REGNAMESPACE)
+      and relname = ?
+      and relkind IN ('r', 'p')
+    `,
+
+		snapshotStmts: []string{
+			"START TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY",
+			"SELECT 1", // the snapshot is taken by the first query of the transaction
+		},
+		threadsRunning: postgresThreadsRunning,
+		replicaLag:     postgresReplicaLag,
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,152 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConnInfo(t *testing.T) { // {{{
+	tests := []struct {
+		name     string
+		conninfo string
+		want     map[string]string
+		wantErr  string
+	}{
+		{"empty", "", map[string]string{}, ""},
+		{"pairs", "host=db1 port=5432 dbname=src", map[string]string{"host": "db1", "port": "5432", "dbname": "src"}, ""},
+		{"spaces around =", " host = db1\tport =5432\n", map[string]string{"host": "db1", "port": "5432"}, ""},
+		{"quoted", `password='a b' user=''`, map[string]string{"password": "a b", "user": ""}, ""},
+		{"escapes", `password='it\'s \\' user=a\ b`, map[string]string{"password": `it's \`, "user": "a b"}, ""},
+		{"unicode", "dbname=größe", map[string]string{"dbname": "größe"}, ""},
+		{"missing =", "host db1", nil, `missing "=" after "host"`},
+		{"unterminated quote", "password='abc", nil, "unterminated quoted value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, e := parseConnInfo(tt.conninfo)
+			if tt.wantErr != "" {
+				if e == nil || !strings.Contains(e.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", e, tt.wantErr)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConnInfo(%q) = %v, want %v", tt.conninfo, got, tt.want)
+			}
+
+			// the connection string given to pq parses back to the same options
+			back, e := parseConnInfo(postgresConnInfo(got))
+			if e != nil || !reflect.DeepEqual(back, got) {
+				t.Errorf("parseConnInfo(%q) = %v, %v, want %v", postgresConnInfo(got), back, e, got)
+			}
+		})
+	}
+} // }}}
+
+func TestPostgresOptions(t *testing.T) { // {{{
+	tests := []struct {
+		name    string
+		c       Connection
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "settings",
+			c:    Connection{Username: "u", Password: "p", Host: "db1", Port: "5432", DBName: "src"},
+			want: map[string]string{"user": "u", "password": "p", "host": "db1", "port": "5432", "dbname": "src"},
+		},
+		{
+			name: "URL DSN overridden",
+			c:    Connection{DSN: "postgres://u:p@db1:5432/src?sslmode=disable", DBName: "tgt"},
+			want: map[string]string{"user": "u", "password": "p", "host": "db1", "port": "5432", "dbname": "tgt", "sslmode": "disable"},
+		},
+		{
+			name: "conninfo DSN",
+			c:    Connection{DSN: "host=db1 dbname=src", Port: "6432"},
+			want: map[string]string{"host": "db1", "port": "6432", "dbname": "src"},
+		},
+		{
+			name: "socket directory",
+			c:    Connection{Socket: "/var/run/postgresql", DBName: "src"},
+			want: map[string]string{"host": "/var/run/postgresql", "dbname": "src"},
+		},
+		{
+			name: "timeouts and params",
+			c:    Connection{Host: "db1", Timeout: 1500 * time.Millisecond, ReadTimeout: 30 * time.Second, Params: map[string]string{"search_path": "hr"}},
+			want: map[string]string{"host": "db1", "connect_timeout": "2", "statement_timeout": "30000", "search_path": "hr"},
+		},
+		{
+			name: "TLS",
+			c:    Connection{Host: "db1", TLSCA: "ca.pem", TLSCert: "client.pem", TLSKey: "client.key"},
+			want: map[string]string{"host": "db1", "sslmode": "verify-ca", "sslrootcert": "ca.pem", "sslcert": "client.pem", "sslkey": "client.key"},
+		},
+		{
+			name: "TLS verify-identity",
+			c:    Connection{Host: "db1", TLSMode: tlsVerifyIdentity},
+			want: map[string]string{"host": "db1", "sslmode": "verify-full"},
+		},
+		{
+			name:    "socket and host",
+			c:       Connection{Socket: "/var/run/postgresql", Host: "db1"},
+			wantErr: "socket and host are mutual exclusive",
+		},
+		{
+			name:    "write timeout",
+			c:       Connection{Host: "db1", WriteTimeout: time.Second},
+			wantErr: "write timeout is not supported",
+		},
+		{
+			name:    "TLS preferred",
+			c:       Connection{Host: "db1", TLSMode: tlsPreferred},
+			wantErr: "TLS mode preferred is not supported",
+		},
+		{
+			name:    "invalid URL DSN",
+			c:       Connection{DSN: "postgres://db1:port/src"},
+			wantErr: "invalid DSN",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, e := tt.c.postgresOptions()
+			if tt.wantErr != "" {
+				if e == nil || !strings.Contains(e.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", e, tt.wantErr)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("postgresOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,555 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math/big"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"modernc.org/sqlite"
+)
+
+// sqliteMaxArgs : arguments of one SQLite function call, SQLite allows 127
+const sqliteMaxArgs = 100
+
+// sqliteText : value as MySQL CONCAT renders it, nil for NULL
+func sqliteText(v driver.Value) (text string, isnull bool) { // {{{
+	switch x := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return x, false
+	case int64:
+		return strconv.FormatInt(x, 10), false
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), false
+	case []byte:
+		return string(x), false
+	default:
+		return fmt.Sprint(x), false
+	}
+} // }}}
+
+// sqliteUint64 : unsigned 64 bit row hash of an integer or its decimal text
+func sqliteUint64(v driver.Value) (u uint64, isnull bool, err error) { // {{{
+	text, isnull := sqliteText(v)
+	if isnull {
+		return 0, true, nil
+	}
+	u, err = strconv.ParseUint(text, 10, 64)
+	return
+} // }}}
+
+// sqliteDigest : scalar function of the hex digest of the text of its argument, like MD5 of MySQL
+func sqliteDigest(newHash func() hash.Hash) func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) { // {{{
+	return func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		text, isnull := sqliteText(args[0])
+		if isnull {
+			return nil, nil
+		}
+		h := newHash()
+		h.Write([]byte(text))
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+} // }}}
+
+// sqliteFunction : scalar function of nargs arguments, -1 for any number
+type sqliteFunction struct { // {{{
+	nargs  int32
+	scalar func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error)
+} // }}}
+
+// sqliteScalarFunctions : MySQL functions of the hash and row encoding expressions, built into
+// SQLite under dfc_ names not to clash with functions registered by other users of the driver
+func sqliteScalarFunctions() map[string]sqliteFunction { // {{{
+	return map[string]sqliteFunction{
+		// dfc_text(x) : CONCAT(x)
+		"dfc_text": {1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			text, isnull := sqliteText(args[0])
+			if isnull {
+				return nil, nil
+			}
+			return text, nil
+		}},
+		// dfc_concat_ws(separator, x, ...) : CONCAT_WS, NULL if every x is NULL
+		"dfc_concat_ws": {-1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			separator, _ := sqliteText(args[0])
+			var texts []string
+			for _, arg := range args[1:] {
+				if text, isnull := sqliteText(arg); !isnull {
+					texts = append(texts, text)
+				}
+			}
+			if texts == nil {
+				return nil, nil
+			}
+			return strings.Join(texts, separator), nil
+		}},
+		// dfc_null_safe(x, ...) : null-safe row encoding of x, ...
+		"dfc_null_safe": {-1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			var b strings.Builder
+			for _, arg := range args {
+				text, isnull := sqliteText(arg)
+				if isnull {
+					b.WriteString("N")
+					continue
+				}
+				fmt.Fprintf(&b, "V%d:%s", len(text), text)
+			}
+			return b.String(), nil
+		}},
+		// dfc_crc32(x) : CRC32
+		"dfc_crc32": {1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			text, isnull := sqliteText(args[0])
+			if isnull {
+				return nil, nil
+			}
+			return int64(crc32.ChecksumIEEE([]byte(text))), nil
+		}},
+		"dfc_md5":  {1, sqliteDigest(md5.New)},
+		"dfc_sha1": {1, sqliteDigest(sha1.New)},
+		// dfc_sha2(x, bits) : SHA2, NULL for unknown bits
+		"dfc_sha2": {2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			bits, _ := sqliteText(args[1])
+			newHash, exists := map[string]func() hash.Hash{
+				"0":   sha256.New,
+				"224": sha256.New224,
+				"256": sha256.New,
+				"384": sha512.New384,
+				"512": sha512.New,
+			}[bits]
+			if !exists {
+				return nil, nil
+			}
+			return sqliteDigest(newHash)(ctx, args[:1])
+		}},
+		// dfc_fold(hex) : foldHex, as decimal text since SQLite integers are signed
+		"dfc_fold": {1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			text, isnull := sqliteText(args[0])
+			if isnull {
+				return nil, nil
+			}
+			if len(text) > 16 {
+				text = text[:16]
+			}
+			u, e := strconv.ParseUint(text, 16, 64)
+			if e != nil {
+				return nil, e
+			}
+			return strconv.FormatUint(u, 10), nil
+		}},
+	}
+} // }}}
+
+// sqliteBitXor : BIT_XOR of unsigned 64 bit row hashes, 0 of no rows
+type sqliteBitXor struct { // {{{
+	xor uint64
+} // }}}
+
+func (a *sqliteBitXor) Step(ctx *sqlite.FunctionContext, rowArgs []driver.Value) error { // {{{
+	u, _, e := sqliteUint64(rowArgs[0])
+	a.xor ^= u
+	return e
+} // }}}
+
+func (a *sqliteBitXor) WindowInverse(ctx *sqlite.FunctionContext, rowArgs []driver.Value) error { // {{{
+	return a.Step(ctx, rowArgs)
+} // }}}
+
+func (a *sqliteBitXor) WindowValue(ctx *sqlite.FunctionContext) (driver.Value, error) { // {{{
+	return strconv.FormatUint(a.xor, 10), nil
+} // }}}
+
+func (a *sqliteBitXor) Final(ctx *sqlite.FunctionContext) {}
+
+// sqliteSum : exact SUM of unsigned 64 bit row hashes, NULL of no rows
+type sqliteSum struct { // {{{
+	sum  big.Int
+	rows int
+} // }}}
+
+func (a *sqliteSum) add(rowArgs []driver.Value, sign int) error { // {{{
+	u, isnull, e := sqliteUint64(rowArgs[0])
+	if e != nil || isnull {
+		return e
+	}
+	var x big.Int
+	x.SetUint64(u)
+	if sign < 0 {
+		x.Neg(&x)
+	}
+	a.sum.Add(&a.sum, &x)
+	a.rows += sign
+	return nil
+} // }}}
+
+func (a *sqliteSum) Step(ctx *sqlite.FunctionContext, rowArgs []driver.Value) error { // {{{
+	return a.add(rowArgs, 1)
+} // }}}
+
+func (a *sqliteSum) WindowInverse(ctx *sqlite.FunctionContext, rowArgs []driver.Value) error { // {{{
+	return a.add(rowArgs, -1)
+} // }}}
+
+func (a *sqliteSum) WindowValue(ctx *sqlite.FunctionContext) (driver.Value, error) { // {{{
+	if a.rows == 0 {
+		return nil, nil
+	}
+	return a.sum.String(), nil
+} // }}}
+
+func (a *sqliteSum) Final(ctx *sqlite.FunctionContext) {}
+
+// sqliteAggregateFunctions : MySQL aggregates of the chunk aggregate expressions, see
+// sqliteScalarFunctions
+func sqliteAggregateFunctions() map[string]func() sqlite.AggregateFunction { // {{{
+	return map[string]func() sqlite.AggregateFunction{
+		"dfc_bit_xor": func() sqlite.AggregateFunction { return new(sqliteBitXor) },
+		"dfc_sum":     func() sqlite.AggregateFunction { return new(sqliteSum) },
+	}
+} // }}}
+
+// the driver keeps its functions in a process wide registry that fails on a second registration of
+// a name, so they are registered once per process
+var (
+	sqliteRegisterOnce sync.Once
+	sqliteRegisterErr  error
+)
+
+// sqliteRegister : register the dfc_ functions with the driver once, before the first connection
+func sqliteRegister() error { // {{{
+	sqliteRegisterOnce.Do(func() {
+		functions := sqliteScalarFunctions()
+		var names []string
+		for name := range functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := functions[name]
+			if sqliteRegisterErr = sqlite.RegisterFunction(name, &sqlite.FunctionImpl{
+				NArgs:         f.nargs,
+				Deterministic: true,
+				Scalar:        f.scalar,
+			}); sqliteRegisterErr != nil {
+				return
+			}
+		}
+
+		for name, newAggregate := range sqliteAggregateFunctions() {
+			newAggregate := newAggregate
+			if sqliteRegisterErr = sqlite.RegisterFunction(name, &sqlite.FunctionImpl{
+				NArgs:         1,
+				Deterministic: true,
+				MakeAggregate: func(ctx sqlite.FunctionContext) (sqlite.AggregateFunction, error) {
+					return newAggregate(), nil
+				},
+			}); sqliteRegisterErr != nil {
+				return
+			}
+		}
+	})
+
+	return sqliteRegisterErr
+} // }}}
+
+/*
+sqliteCall : call of function on args, split into nested calls of at most sqliteMaxArgs args,
+joined by outer if there is more than one
+
+	dfc_concat_ws('#', dfc_concat_ws('#', c1, ..., c100), dfc_concat_ws('#', c101, ...))
+*/
+func sqliteCall(function string, prefix []string, args []string, outer func(calls []string) string) string { // {{{
+	var calls []string
+	for len(args) > 0 {
+		n := len(args)
+		if n > sqliteMaxArgs {
+			n = sqliteMaxArgs
+		}
+		calls = append(calls, function+"("+strings.Join(append(append([]string(nil), prefix...), args[:n]...), ",")+")")
+		args = args[n:]
+	}
+	if len(calls) == 1 {
+		return calls[0]
+	}
+
+	return outer(calls)
+} // }}}
+
+// sqliteHashAlgorithms : --hash of SQLite, same values as hashAlgorithms of MySQL. Integer
+// hashes above the signed 64 bit range are decimal text
+func sqliteHashAlgorithms() map[string]func(expr string) string { // {{{
+	return map[string]func(expr string) string{
+		"crc32": func(expr string) string {
+			return "dfc_crc32(" + expr + ")"
+		},
+		"md5": func(expr string) string {
+			return "dfc_fold(dfc_md5(" + expr + "))"
+		},
+		"md5-full": func(expr string) string {
+			return "dfc_md5(" + expr + ")"
+		},
+		"sha1": func(expr string) string {
+			return "dfc_fold(dfc_sha1(" + expr + "))"
+		},
+		"sha1-full": func(expr string) string {
+			return "dfc_sha1(" + expr + ")"
+		},
+		"sha256": func(expr string) string {
+			return "dfc_fold(dfc_sha2(" + expr + ", 256))"
+		},
+		"sha256-full": func(expr string) string {
+			return "dfc_sha2(" + expr + ", 256)"
+		},
+		"sha512-full": func(expr string) string {
+			return "dfc_sha2(" + expr + ", 512)"
+		},
+		"dual": func(expr string) string {
+			return "dfc_crc32(" + expr + ") || ':' || dfc_md5(" + expr + ")"
+		},
+	}
+} // }}}
+
+// sqliteRowEncodings : --row-encoding of SQLite, same text as rowEncodings of MySQL
+func sqliteRowEncodings() map[string]func(columns []string) string { // {{{
+	return map[string]func(columns []string) string{
+		"concat-ws": func(columns []string) string {
+			return sqliteCall("dfc_concat_ws", []string{"'#'"}, columns, func(calls []string) string {
+				return "dfc_concat_ws('#'," + strings.Join(calls, ",") + ")" // NULL of all NULL columns is skipped
+			})
+		},
+		"null-safe": func(columns []string) string {
+			return sqliteCall("dfc_null_safe", nil, columns, func(calls []string) string {
+				return strings.Join(calls, " || ")
+			})
+		},
+	}
+} // }}}
+
+// sqliteChunkAggregates : --chunk-aggregate of SQLite, GROUP_CONCAT has no ORDER BY before SQLite
+// 3.44 so group-concat-ordered is missing
+func sqliteChunkAggregates() map[string]aggregateExpr { // {{{
+	return map[string]aggregateExpr{
+		"group-concat": chunkAggregates()["group-concat"].expr,
+		"bit-xor": func(hash func(string) string, rowhash string, pkcolumns []string) string {
+			return "dfc_bit_xor(" + rowhash + ")"
+		},
+		"sum": func(hash func(string) string, rowhash string, pkcolumns []string) string {
+			return "dfc_sum(" + rowhash + ")"
+		},
+	}
+} // }}}
+
+// sqliteFile : database file of the connection, DBName or the file of DSN
+func (c Connection) sqliteFile() string { // {{{
+	if c.DBName != "" {
+		return c.DBName
+	}
+	file, _, _ := strings.Cut(strings.TrimPrefix(c.DSN, "file:"), "?")
+	return file
+} // }}}
+
+/*
+sqliteDSN : file: URI of the database file opened read only, DBName overrides the file of DSN.
+Timeout waits for locks of writers, Params are URI parameters like _pragma=cache_size(-20000)
+
+	file:/path/to/fixture.db?mode=ro&_pragma=busy_timeout(10000)
+*/
+func (c Connection) sqliteDSN() (string, error) { // {{{
+	if c.Host != "" || c.Port != "" || c.Socket != "" {
+		return "", errors.New("sqlite opens the database file of DBName or DSN, host, port and socket are not used")
+	}
+	if c.tlsMode() != "" {
+		return "", errors.New("sqlite opens a local file, TLS settings are not used")
+	}
+	if c.ReadTimeout != 0 || c.WriteTimeout != 0 {
+		return "", errors.New("sqlite has no I/O timeouts, use timeout for the busy timeout")
+	}
+
+	file := c.sqliteFile()
+	if file == "" {
+		return "", errors.New("database file of sqlite is not set, DBName or DSN is required")
+	}
+
+	_, query, _ := strings.Cut(c.DSN, "?")
+	values, e := url.ParseQuery(query)
+	if e != nil {
+		return "", fmt.Errorf("invalid DSN parameters: %w", e)
+	}
+	if values.Get("mode") == "" {
+		values.Set("mode", "ro")
+	}
+	if values.Get("mode") == "ro" {
+		if _, e := os.Stat(file); e != nil {
+			return "", e // SQLite reports a missing file as out of memory
+		}
+	}
+	if c.Timeout > 0 {
+		values.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", c.Timeout.Milliseconds()))
+	}
+	for name, value := range c.Params {
+		values.Set(name, value)
+	}
+
+	return "file:" + (&url.URL{Path: file}).EscapedPath() + "?" + values.Encode(), nil
+} // }}}
+
+// sqliteConnector : connector of the sqlite driver, which opens connections by DSN only
+type sqliteConnector struct { // {{{
+	driver driver.Driver
+	dsn    string
+} // }}}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) { // {{{
+	return c.driver.Open(c.dsn)
+} // }}}
+
+func (c sqliteConnector) Driver() driver.Driver { // {{{
+	return c.driver
+} // }}}
+
+// sqliteDialect : SQLite database file, e.g. a fixture of production tables. MySQL functions of
+// the hashes are Go functions, see sqliteScalarFunctions
+func sqliteDialect() *dialect { // {{{
+	return &dialect{
+		name: "sqlite",
+		connector: func(c Connection) (driver.Connector, error) {
+			dsn, e := c.sqliteDSN()
+			if e != nil {
+				return nil, e
+			}
+			if e := sqliteRegister(); e != nil {
+				return nil, e
+			}
+			// the dfc_ functions are registered with the driver of database/sql
+			db, e := sql.Open("sqlite", dsn)
+			if e != nil {
+				return nil, e
+			}
+			defer db.Close()
+			return rewriteConnector{Connector: sqliteConnector{driver: db.Driver(), dsn: dsn}, rewrite: withoutHints}, nil
+		},
+		describe: func(c Connection) string {
+			return "file(" + c.sqliteFile() + ")"
+		},
+		hashAlgorithms:  sqliteHashAlgorithms(),
+		rowEncodings:    sqliteRowEncodings(),
+		chunkAggregates: sqliteChunkAggregates(),
+		textExpr: func(column string) string {
+			return "dfc_text(" + column + ")"
+		},
+		valuesList: func(rows []string) string {
+			return "(VALUES " + strings.Join(rows, ",") + ")"
+		},
+		literal: func(quoted string) string {
+			return quoted
+		},
+		// text date times compare as text with the boundaries, which are not in the format of SQLite
+		dataTypes: map[string]string{
+			"datetime": "",
+		},
+
+		columnsQuery: `
+    SELECT name
+    FROM pragma_table_info(?)
+    ORDER BY cid
+    `,
+		baseTablesQuery: `
+    SELECT name
+    FROM sqlite_schema
+    WHERE type = 'table'
+      and name NOT LIKE 'sqlite\_%' ESCAPE '\'
+    ORDER BY name
+    `,
+		// declared types by the affinity rules of SQLite, as MySQL data types
+		keyColumnsQuery: `
+    SELECT
+      name,
+      CASE
+        WHEN type LIKE '%INT%' THEN 'bigint'
+        WHEN type LIKE '%CHAR%' OR type LIKE '%CLOB%' OR type LIKE '%TEXT%' THEN 'varchar'
+        WHEN type LIKE '%BLOB%' OR type = '' THEN 'varbinary'
+        WHEN type LIKE '%REAL%' OR type LIKE '%FLOA%' OR type LIKE '%DOUB%' THEN 'double'
+        WHEN type LIKE '%DATETIME%' OR type LIKE '%TIMESTAMP%' THEN 'datetime'
+        WHEN type LIKE '%DATE%' THEN 'date'
+        ELSE 'decimal'
+      END AS data_type,
+      LOWER(type) AS column_type
+    FROM pragma_table_info(?)
+    `,
+		// INTEGER PRIMARY KEY is the rowid, it has no index
+		keyIndexQuery: `
+    WITH p(tbl) AS (SELECT ?)
+    SELECT index_name, column_name, is_nullable
+    FROM (
+      SELECT 'PRIMARY' AS index_name, ti.name AS column_name, 'NO' AS is_nullable, ti.pk AS seq
+      FROM p
+      JOIN pragma_table_info(p.tbl) AS ti
+      WHERE ti.pk > 0
+      UNION ALL
+      SELECT il.name, ti.name, CASE WHEN ti."notnull" = 1 OR ti.pk > 0 THEN 'NO' ELSE 'YES' END, ii.seqno
+      FROM p
+      JOIN pragma_index_list(p.tbl) AS il
+      JOIN pragma_index_info(il.name) AS ii
+      JOIN pragma_table_info(p.tbl) AS ti ON ti.name = ii.name
+      WHERE il."unique" = 1
+        and il.partial = 0
+        and il.origin <> 'pk'
+        and NOT EXISTS (SELECT 1 FROM pragma_index_info(il.name) WHERE name IS NULL)
+    )
+    ORDER BY
+      index_name,
+      seq
+    `,
+		chunkIndexQuery: `
+    WITH p(tbl, idx) AS (SELECT ?, ?)
+    SELECT
+      ti.name,
+      CASE WHEN ti."notnull" = 1 OR ti.pk > 0 THEN 'NO' ELSE 'YES' END
+    FROM p
+    JOIN pragma_index_list(p.tbl) AS il ON il.name = p.idx
+    JOIN pragma_index_info(il.name) AS ii
+    JOIN pragma_table_info(p.tbl) AS ti ON ti.name = ii.name
+    ORDER BY ii.seqno
+    `,
+
+		snapshotStmts: []string{
+			"BEGIN",
+			"SELECT COUNT(1) FROM sqlite_schema", // the read transaction starts at the first read
+		},
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
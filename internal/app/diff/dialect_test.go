@@ -0,0 +1,90 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"testing"
+)
+
+func TestNumberedPlaceholders(t *testing.T) { // {{{
+	// -F filter of a table run as in its queries
+	filter := func(sql string) string {
+		return (&pkTable{arg: &envarg{ArgAdditionalFilter: sql}}).additionalFilterStmt()
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"none", "SELECT a FROM t", "SELECT a FROM t"},
+		{"in order", "SELECT a FROM t WHERE a >= ? AND a <= ?", "SELECT a FROM t WHERE a >= $1 AND a <= $2"},
+		{"hint dropped", "SELECT SQL_NO_CACHE a FROM t WHERE a = ?", "SELECT a FROM t WHERE a = $1"},
+		{"hint on its own line dropped", "SELECT SQL_NO_CACHE\n  a FROM t", "SELECT \n  a FROM t"},
+		{"quoted kept", `SELECT '?', "?" FROM t WHERE a = ?`, `SELECT '?', "?" FROM t WHERE a = $1`},
+		{"escaped quote", `SELECT 'it''s ?' FROM t WHERE a = ?`, `SELECT 'it''s ?' FROM t WHERE a = $1`},
+		{"multibyte text", `SELECT 'é?' FROM t WHERE a = ? AND b = 'ü'`, `SELECT 'é?' FROM t WHERE a = $1 AND b = 'ü'`},
+		{
+			"filter kept",
+			"SELECT a FROM t WHERE a >= ?" + filter("c ? 'k' AND d ?| array['x']") + " AND a <= ?",
+			"SELECT a FROM t WHERE a >= $1 AND /*dfc:filter*/c ? 'k' AND d ?| array['x']/*dfc:filter*/ AND a <= $2",
+		},
+		{
+			"filter quotes",
+			"SELECT a FROM t WHERE a >= ?" + filter("c = '/*dfc:filter*/?'") + " AND a <= ?",
+			"SELECT a FROM t WHERE a >= $1 AND /*dfc:filter*/c = '/*dfc:filter*/?'/*dfc:filter*/ AND a <= $2",
+		},
+		{"no filter", "SELECT a FROM t WHERE a = ?" + filter(""), "SELECT a FROM t WHERE a = $1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := numberedPlaceholders(tt.query); got != tt.want {
+				t.Errorf("numberedPlaceholders(%q)\n = %q\nwant %q", tt.query, got, tt.want)
+			}
+		})
+	}
+} // }}}
+
+func TestLiteral(t *testing.T) { // {{{
+	tests := []struct {
+		driver string
+		quoted string
+		want   string
+	}{
+		{"mysql", "NULL", "NULL"},
+		{"mysql", "12.5", "12.5"},
+		{"mysql", `'it''s a\b'`, `'it''s a\\b'`},
+		{"mysql", "X'00FF'", "X'00FF'"},
+		{"postgres", `'it''s a\b'`, `'it''s a\b'`},
+		{"postgres", "X'00FF'", `'\x00FF'::bytea`},
+		{"postgres", "NULL", "NULL"},
+		{"sqlite", `'a\b'`, `'a\b'`},
+		{"sqlite", "X'00FF'", "X'00FF'"},
+		{"csv", `'a\b'`, `'a\b'`},
+	}
+
+	for _, tt := range tests {
+		db := &DB{dialect: dialects()[tt.driver]()}
+		if got := db.Literal(tt.quoted); got != tt.want {
+			t.Errorf("%s: Literal(%s) = %s, want %s", tt.driver, tt.quoted, got, tt.want)
+		}
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -15,21 +15,18 @@ You should have received a copy of the GNU General Public License
 along with this program.  If not, see <https://www.gnu.org/licenses/>.
 */
 
-// Package diff is a tool to compare hashes between two MySQL compatible database tables
+// Package diff is a tool to compare hashes between two MySQL compatible or PostgreSQL database tables
 package diff
 
 // Importing fmt package for the sake of printing
 import (
 	"database/sql"
-	"diffchecker/internal/pkg/common"
 	"fmt"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 type envarg struct { // {{{
@@ -41,383 +38,546 @@ type envarg struct { // {{{
 	ArgTgtTable           string
 	ArgChunksize          int
 	ArgPKColumnSequence   []string
+	ArgKeyColumns         []string
+	ArgChunkIndex         string
 	ArgIgnoreFields       []string
 	ArgAdditionalFilter   string
+	ArgHash               string
+	ArgRowEncoding        string
+	ArgChunkAggregate     string
+	ArgBisect             int
+	ArgRecheck            int
+	ArgRecheckDelay       time.Duration
+	ArgDiffColumns        bool
+	ArgDiffValues         bool
+	ArgParallel           int
+	ArgSrcConcurrency     int
+	ArgTgtConcurrency     int
+	ArgResume             bool
+	ArgAllTables          bool
+	ArgIncludeTables      []string
+	ArgExcludeTables      []string
+	ArgTableMap           map[string]string
+	ArgTableParallel      int
+	ArgFormat             string
 	ArgOutputfile         *os.File
 	ArgOutputRowLevelfile *os.File
+	run                   *runner // state shared by the tables of the run
 } // }}}
 
-// envArg is the package variable that holds the arg variables
-var envArg = envarg{}
+// maxOpenConns is the connection pool size of each side DB
+const maxOpenConns = 25
 
-// envVar is the package variable that holds the environment variables
-var envVar = common.GetEnvVar()
-
-func errorCheck(err error) { // {{{
-	if err != nil {
-		panic(err.Error())
-	}
+// DB : connection pool of one side opened by InitializeDBSettings, the queries on it are in the
+// dialect of its Connection.Driver
+type DB struct { // {{{
+	*sql.DB
+	dialect *dialect
+	file    *fileConnector // nil if the side is not a csv or parquet file
 } // }}}
 
-// InitializeDBSettings is to initialize the database connection
-func InitializeDBSettings(host, port, username, password, dbname string) *sql.DB { // {{{
-	conn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?parseTime=true&group_concat_max_len=1000000",
-		username,
-		password,
-		host,
-		port,
-		dbname,
-	)
-	db, e := sql.Open("mysql", conn)
-	errorCheck(e)
+// InitializeDBSettings is to initialize the database connection, the queries on it are in the
+// dialect of the Driver of c. Close it with Close
+func InitializeDBSettings(c Connection) (*DB, error) { // {{{
+	connector, d, e := c.connector()
+	if e != nil {
+		return nil, e
+	}
+	db := &DB{DB: sql.OpenDB(connector), dialect: d}
+	db.file, _ = connector.(*fileConnector)
 
-	db.SetMaxOpenConns(25)
+	db.SetMaxOpenConns(maxOpenConns)
 	db.SetMaxIdleConns(5)
 	db.SetConnMaxLifetime(5 * time.Minute)
 	db.SetConnMaxIdleTime(5 * time.Minute)
 
-	e = db.Ping()
-	errorCheck(e)
+	if e := db.Ping(); e != nil {
+		_ = db.Close()
+		return nil, e
+	}
 
-	return db
+	return db, nil
+} // }}}
+
+// Close : close db, the temporary database of a file is removed
+func (db *DB) Close() error { // {{{
+	e := db.DB.Close()
+	if db.file != nil && e == nil {
+		e = db.file.remove()
+	}
+	return e
+} // }}}
+
+// Literal : quoted, a standard SQL literal of SQLite quote(), as literal of the engine of db
+func (db *DB) Literal(quoted string) string { // {{{
+	return db.dialect.literal(quoted)
 } // }}}
 
 func singleTableColumnResult(
-	db *sql.DB,
+	db *DB,
 	table string,
 	query string,
-) (fieldcolumns []string) { // {{{
-	stmt, e := db.Prepare(query)
-	errorCheck(e)
-	defer func() {
-		e := stmt.Close()
-		errorCheck(e)
-	}()
+) (fieldcolumns []string, err error) { // {{{
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(stmt, &err)
 
-	result, e := stmt.Query(table)
-	errorCheck(e)
+	result, err := stmt.Query(table)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(result, &err)
 
 	for result.Next() {
 		var columnname string
-		e = result.Scan(&columnname)
-		errorCheck(e)
+		if err = result.Scan(&columnname); err != nil {
+			return nil, err
+		}
 		fieldcolumns = append(fieldcolumns, columnname)
 	}
 
-	log.Debugln(fieldcolumns)
-
-	return
+	return fieldcolumns, result.Err()
 } // }}}
 
 // GetTableColumns returns table column names for a given table
-func GetTableColumns(db *sql.DB, table string) (fieldcolumns []string) { // {{{
-	query := `
-    SELECT SQL_NO_CACHE COLUMN_NAME
-    FROM INFORMATION_SCHEMA.COLUMNS
-    WHERE TABLE_SCHEMA = database()
-      AND TABLE_NAME = ?
-    ORDER BY ORDINAL_POSITION
-    `
-	fieldcolumns = singleTableColumnResult(db, table, query)
+func GetTableColumns(db *DB, table string) (fieldcolumns []string, err error) { // {{{
+	return singleTableColumnResult(db, table, db.dialect.columnsQuery)
+} // }}}
+
+// fieldTypeOf : iFieldType of a key column data type, nil if the data type is not supported
+func fieldTypeOf(datatype string, columntype string) (ft iFieldType) { // {{{
+	if strings.Contains(datatype, "binary") {
+		ft = new(fieldtypeBinary)
+	} else if strings.Contains(datatype, "char") {
+		ft = new(fieldtypeChar)
+	} else if strings.Contains(datatype, "int") || datatype == "year" {
+		ft = new(fieldtypeInt)
+	} else if datatype == "decimal" {
+		ft = new(fieldtypeDecimal)
+	} else if datatype == "float" || datatype == "double" {
+		ft = new(fieldtypeFloat)
+	} else if datatype == "enum" {
+		ft = newFieldtypeEnum(columntype)
+	} else if datatype == "bit" {
+		ft = new(fieldtypeBit)
+	} else if strings.Contains(datatype, "time") {
+		ft = new(fieldtypeTime)
+	} else if strings.Contains(datatype, "date") {
+		ft = new(fieldtypeDate)
+	}
+	// TODO: add support for other data types
 
 	return
 } // }}}
 
-// allPKColumns populate pkcolumn struct
-func allPKColumns(db *sql.DB, table string) (allpkcolumns []pkColumn) { // {{{
-	query := `
-    SELECT SQL_NO_CACHE
-      col.column_name,
-      col.data_type
-    FROM information_schema.tables as tab
-    INNER JOIN information_schema.statistics as sta
-    ON sta.table_schema = tab.table_schema
-      and sta.table_name = tab.table_name
-      and sta.index_name = 'primary'
-    INNER JOIN information_schema.columns as col
-    ON sta.table_schema = col.table_schema
-      and sta.table_name = col.table_name
-      and sta.column_name = col.column_name
-    WHERE tab.table_schema = database()
-      and tab.table_type = 'BASE TABLE'
-      and tab.table_name = ?
-    ORDER BY
-      tab.table_name,
-      sta.seq_in_index;
-    `
-
-	stmt, e := db.Prepare(query)
-	errorCheck(e)
-	defer func() {
-		e := stmt.Close()
-		errorCheck(e)
-	}()
-
-	result, e := stmt.Query(table)
-	errorCheck(e)
+// queryColumnTypes : data type and column type of the engine by lower case column name of table,
+// works on views too
+func queryColumnTypes(db *DB, table string) (columns map[string][2]string, err error) { // {{{
+	stmt, err := db.Prepare(db.dialect.keyColumnsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(stmt, &err)
 
+	result, err := stmt.Query(table)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(result, &err)
+
+	columns = map[string][2]string{}
 	for result.Next() {
-		var columnname string
-		var datatype string
-		e = result.Scan(&columnname, &datatype)
-		errorCheck(e)
-
-		var ft iFieldType
-
-		if strings.Contains(datatype, "char") {
-			ft = new(fieldtypeChar)
-		} else if strings.Contains(datatype, "int") {
-			ft = new(fieldtypeInt)
-		} else if strings.Contains(datatype, "time") {
-			ft = new(fieldtypeTime)
-		} else if strings.Contains(datatype, "date") {
-			ft = new(fieldtypeDate)
-		} else {
-			// TODO: add support for other data types
-			log.Fatalf("Unsupported data type: %s\n", datatype)
+		var columnname, datatype, columntype string
+		if err = result.Scan(&columnname, &datatype, &columntype); err != nil {
+			return nil, err
 		}
+		columns[strings.ToLower(columnname)] = [2]string{datatype, columntype}
+	}
+	if err = result.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s not found", table)
+	}
+
+	return
+} // }}}
+
+// queryKeyColumns : key columns of table in the order of columnnames, works on views too. Data
+// types of the engine are normalized to the MySQL names of fieldTypeOf
+func queryKeyColumns(db *DB, table string, columnnames []string, keyname string) (keycolumns []pkColumn, err error) { // {{{
+	columns, err := queryColumnTypes(db, table)
+	if err != nil {
+		return nil, err
+	}
 
-		allpkcolumns = append(
-			allpkcolumns,
+	for _, columnname := range columnnames {
+		types, exists := columns[strings.ToLower(columnname)]
+		if !exists {
+			return nil, fmt.Errorf("key column %s not found in table %s", columnname, table)
+		}
+
+		ft := fieldTypeOf(db.dialect.dataType(strings.ToLower(types[0])), strings.ToLower(types[1]))
+		if ft == nil {
+			return nil, fmt.Errorf("unsupported data type: %s of key column %s.%s", types[0], table, columnname)
+		}
+
+		keycolumns = append(
+			keycolumns,
 			pkColumn{
 				ColumnName:  columnname,
-				DataType:    datatype,
+				DataType:    types[0],
 				FieldType:   ft,
 				IsLastField: false,
+				KeyName:     keyname,
 			},
 		)
 	}
-	// flag last field
-	allpkcolumns[len(allpkcolumns)-1].IsLastField = true
 
-	log.Debugln(allpkcolumns)
+	// flag last field
+	keycolumns[len(keycolumns)-1].IsLastField = true
 
 	return
 } // }}}
 
-// FindAllPKColumnNames find table's all PK column names
-func FindAllPKColumnNames(db *sql.DB, table string) []string { // {{{
-	allpkcolumns := allPKColumns(db, table)
-
-	pkColumnNames := make([]string, len(allpkcolumns))
+// queryKeyIndex : primary key of table, or its unique index with the fewest columns that are all
+// NOT NULL. Returns the index name and its columns, PRIMARY for the primary key, empty name if
+// there is no such index
+func queryKeyIndex(db *DB, table string) (keyname string, columnnames []string, err error) { // {{{
+	stmt, err := db.Prepare(db.dialect.keyIndexQuery)
+	if err != nil {
+		return "", nil, err
+	}
+	defer closeErr(stmt, &err)
 
-	for i, pkcolumn := range allpkcolumns {
-		pkColumnNames[i] = pkcolumn.ColumnName
+	result, err := stmt.Query(table)
+	if err != nil {
+		return "", nil, err
 	}
+	defer closeErr(result, &err)
 
-	return pkColumnNames
-} // }}}
+	var indexnames []string
+	indexcolumns := map[string][]string{}
+	nullable := map[string]bool{}
+	for result.Next() {
+		var indexname, columnname, isnullable string
+		if err = result.Scan(&indexname, &columnname, &isnullable); err != nil {
+			return "", nil, err
+		}
 
-// FindAllPKColumnQuotes find table's all PK column quotes
-func FindAllPKColumnQuotes(db *sql.DB, table string) []string { // {{{
-	allpkcolumns := allPKColumns(db, table)
+		if _, exists := indexcolumns[indexname]; !exists {
+			indexnames = append(indexnames, indexname)
+		}
+		indexcolumns[indexname] = append(indexcolumns[indexname], columnname)
+		nullable[indexname] = nullable[indexname] || strings.EqualFold(isnullable, "yes")
+	}
+	if err = result.Err(); err != nil {
+		return "", nil, err
+	}
 
-	pkColumnValuesQuotes := make([]string, len(allpkcolumns))
+	for _, indexname := range indexnames {
+		if strings.EqualFold(indexname, "primary") {
+			return indexname, indexcolumns[indexname], nil
+		}
+	}
 
-	for i, pkcolumn := range allpkcolumns {
-		if pkcolumn.FieldType.withQuote() {
-			pkColumnValuesQuotes[i] = "'"
-		} else {
-			pkColumnValuesQuotes[i] = ""
+	// rows with NULL in a unique index are not unique, such indexes cannot be the key
+	for _, indexname := range indexnames {
+		if !nullable[indexname] && (keyname == "" || len(indexcolumns[indexname]) < len(columnnames)) {
+			keyname, columnnames = indexname, indexcolumns[indexname]
 		}
 	}
 
-	return pkColumnValuesQuotes
+	return
 } // }}}
 
-// SetArgs : assign CLI arguments
-func SetArgs(
-	argDebug bool,
-	argTrace bool,
-	argLowerboundary string,
-	argUpperboundary string,
-	argTable string,
-	argSrcTable string,
-	argTgtTable string,
-	argChunksize int,
-	argPKColumnSequence string,
-	argIgnoreFields string,
-	argAdditionalFilter string,
-) { // {{{
-
-	envArg.ArgDebug = argDebug
-	envArg.ArgTrace = argTrace
-	envArg.ArgLowerBoundary = strings.Split(argLowerboundary, ",")
-	envArg.ArgUpperBoundary = strings.Split(argUpperboundary, ",")
-	if argChunksize <= 1 {
-		envArg.ArgChunksize = 2
-	} else {
-		envArg.ArgChunksize = argChunksize
+// queryPKColumns populate pkcolumn struct from the declared --key-columns, the primary key, or
+// the unique not null index with fewest columns. Returns error if the table has no usable key
+func queryPKColumns(db *DB, table string, keycolumns []string) (allpkcolumns []pkColumn, err error) { // {{{
+	if len(keycolumns) > 0 {
+		return queryKeyColumns(db, table, keycolumns, "")
+	}
+
+	keyname, columnnames, err := queryKeyIndex(db, table)
+	if err != nil {
+		return nil, err
+	}
+	if keyname == "" {
+		return nil, fmt.Errorf(
+			"table %s has no primary key or unique index on NOT NULL columns, declare one with --key-columns",
+			table,
+		)
+	}
+
+	return queryKeyColumns(db, table, columnnames, keyname)
+} // }}}
+
+// queryChunkIndexColumns : columns of index followed by the key columns not in the index, chunks
+// walk the index with the key as tiebreaker. Returns error if the index is not found or has
+// nullable columns, rows with NULL would fall outside of every chunk
+func queryChunkIndexColumns(db *DB, table string, index string, keycolumns []string) (columnnames []string, err error) { // {{{
+	stmt, err := db.Prepare(db.dialect.chunkIndexQuery)
+	if err != nil {
+		return nil, err
 	}
-	envArg.ArgPKColumnSequence = strings.Split(argPKColumnSequence, ",")
-	envArg.ArgIgnoreFields = strings.Split(argIgnoreFields, ",")
-	envArg.ArgAdditionalFilter = argAdditionalFilter
+	defer closeErr(stmt, &err)
 
-	if argLowerboundary != "" && argUpperboundary != "" &&
-		len(envArg.ArgLowerBoundary) != len(envArg.ArgUpperBoundary) {
-		log.Fatalln("-l and -u should have same number of elements")
+	result, err := stmt.Query(table, index)
+	if err != nil {
+		return nil, err
 	}
+	defer closeErr(result, &err)
 
-	if argPKColumnSequence != "" {
-		if argLowerboundary != "" &&
-			len(envArg.ArgLowerBoundary) != len(envArg.ArgPKColumnSequence) {
-			log.Fatalln("-l and -S should have same number of elements")
+	inindex := map[string]bool{}
+	for result.Next() {
+		var columnname, isnullable string
+		if err = result.Scan(&columnname, &isnullable); err != nil {
+			return nil, err
 		}
-		if argUpperboundary != "" &&
-			len(envArg.ArgUpperBoundary) != len(envArg.ArgPKColumnSequence) {
-			log.Fatalln("-u and -S should have same number of elements")
+
+		if strings.EqualFold(isnullable, "yes") {
+			return nil, fmt.Errorf("column %s of chunk index %s is nullable", columnname, index)
 		}
+		columnnames = append(columnnames, columnname)
+		inindex[strings.ToLower(columnname)] = true
+	}
+	if err = result.Err(); err != nil {
+		return nil, err
+	}
+	if len(columnnames) == 0 {
+		return nil, fmt.Errorf("index %s not found in table %s", index, table)
 	}
 
-	if argTable == "" && argSrcTable == "" && argTgtTable == "" {
-		log.Fatalln("--table or -s/-t is required")
+	keys, err := queryPKColumns(db, table, keycolumns)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if !inindex[strings.ToLower(key.ColumnName)] {
+			columnnames = append(columnnames, key.ColumnName)
+		}
 	}
 
-	if !((argTable != "" && argSrcTable == "" && argTgtTable == "") || (argTable == "" && argSrcTable != "" && argTgtTable != "")) {
-		log.Fatalln("--table and -s/-t are mutual exclusive")
+	return
+} // }}}
+
+// FindAllPKColumnNames find table's all PK column names, keycolumns are the declared
+// --key-columns of the diff run if any
+func FindAllPKColumnNames(db *DB, table string, keycolumns []string) ([]string, error) { // {{{
+	allpkcolumns, e := queryPKColumns(db, table, keycolumns)
+	if e != nil {
+		return nil, e
 	}
 
-	if argTable != "" {
-		envArg.ArgSrcTable = argTable
-		envArg.ArgTgtTable = argTable
-	} else {
-		envArg.ArgSrcTable = argSrcTable
-		envArg.ArgTgtTable = argTgtTable
+	pkColumnNames := make([]string, len(allpkcolumns))
+
+	for i, pkcolumn := range allpkcolumns {
+		pkColumnNames[i] = pkcolumn.ColumnName
 	}
+
+	return pkColumnNames, nil
+} // }}}
+
+// FindAllPKColumnQuotes find table's all PK column quotes, keycolumns are the declared
+// --key-columns of the diff run if any
+func FindAllPKColumnQuotes(db *DB, table string, keycolumns []string) ([]string, error) { // {{{
+	allpkcolumns, e := queryPKColumns(db, table, keycolumns)
+	if e != nil {
+		return nil, e
+	}
+
+	pkColumnValuesQuotes := make([]string, len(allpkcolumns))
+
+	for i, pkcolumn := range allpkcolumns {
+		if pkcolumn.FieldType.withQuote() {
+			pkColumnValuesQuotes[i] = "'"
+		} else {
+			pkColumnValuesQuotes[i] = ""
+		}
+	}
+
+	return pkColumnValuesQuotes, nil
 } // }}}
 
-func setLogSettings() { // {{{
+// newLogger : text logger of a run on stderr, at trace or debug level if enabled
+func newLogger(debug bool, trace bool) *logrus.Logger { // {{{
 	// https://www.golinuxcloud.com/golang-logrus/
+	log := logrus.New()
 
-	// log.SetFormatter(&log.JSONFormatter{
+	// log.SetFormatter(&logrus.JSONFormatter{
 	//   TimestampFormat: "2006-01-02T15:04:05.9999999Z07:00",
 	//   DisableHTMLEscape: true,
 	// })
-	log.SetFormatter(&log.TextFormatter{
+	log.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp:   true,
 		TimestampFormat: "2006-01-02 15:04:05",
 		ForceColors:     true,
 		DisableColors:   false,
 	})
 
-	log.WithFields(log.Fields{
-		"F": envArg.ArgAdditionalFilter,
-		"I": strings.Join(envArg.ArgIgnoreFields, ","),
-		"S": strings.Join(envArg.ArgPKColumnSequence, ","),
-		"c": envArg.ArgChunksize,
-		"l": strings.Join(envArg.ArgLowerBoundary, ","),
-		"o": envArg.ArgOutputfile.Name() + ", " + envArg.ArgOutputRowLevelfile.Name(),
-		"s": envArg.ArgSrcTable,
-		"t": envArg.ArgTgtTable,
-		"u": strings.Join(envArg.ArgUpperBoundary, ","),
-	},
-	).Infoln("[match]=[index]=[lowerboundary]=[upperboundary]===[rowstats]===")
-
 	log.SetReportCaller(true) // show line number
 
-	if envArg.ArgTrace {
-		log.SetLevel(log.TraceLevel)
-	} else if envArg.ArgDebug {
-		log.SetLevel(log.DebugLevel)
+	if trace {
+		log.SetLevel(logrus.TraceLevel)
+	} else if debug {
+		log.SetLevel(logrus.DebugLevel)
 	} else {
-		log.SetLevel(log.InfoLevel)
+		log.SetLevel(logrus.InfoLevel)
 	}
+
+	return log
+} // }}}
+
+// logArgs : log the args of a table run as header of its chunk log lines
+func logArgs(arg *envarg) { // {{{
+	arg.run.chunkLog.WithFields(logrus.Fields{
+		"F": arg.ArgAdditionalFilter,
+		"H": arg.ArgHash,
+		"I": strings.Join(arg.ArgIgnoreFields, ","),
+		"K": strings.Join(arg.ArgKeyColumns, ","),
+		"X": arg.ArgChunkIndex,
+		"S": strings.Join(arg.ArgPKColumnSequence, ","),
+		"c": arg.ArgChunksize,
+		"l": strings.Join(arg.ArgLowerBoundary, ","),
+		"o": arg.ArgOutputfile.Name() + ", " + arg.ArgOutputRowLevelfile.Name(),
+		"p": fmt.Sprintf("%d (src: %d, tgt: %d)", arg.ArgParallel, arg.ArgSrcConcurrency, arg.ArgTgtConcurrency),
+		"s": arg.ArgSrcTable,
+		"t": arg.ArgTgtTable,
+		"u": strings.Join(arg.ArgUpperBoundary, ","),
+	},
+	).Infoln("[match]=[index]=[lowerboundary]=[upperboundary]===[rowstats]===")
 } // }}}
 
-// RunTable : calculate hash for a table
-func RunTable(outputfile string) { // {{{
-	removeFile := func(filename string) { // {{{
-		var e error
-		_, e = os.Stat(filename)
+// runTable : diff source and target table of arg, chunk results go to outputfile and its
+// rowlevel file
+func runTable(dbSrc *DB, dbTgt *DB, arg *envarg, outputfile string) (ts *TableSummary, err error) { // {{{
+	removeFile := func(filename string) error { // {{{
+		_, e := os.Stat(filename)
 
 		// if file exists, remove it
 		if e == nil {
-			e = os.Remove(filename)
-			errorCheck(e)
+			return os.Remove(filename)
 		}
+		return nil
 	} // }}}
 
-	re := regexp.MustCompile(`\.json`)
-	rowlevelfile := re.ReplaceAllString(outputfile, ".rowlevel.json")
+	log := arg.run.log
+	rowlevelfile := OutputFile(outputfile, arg.ArgFormat, "rowlevel")
 
-	removeFile(outputfile)
-	removeFile(rowlevelfile)
+	// resumed run appends to the outputs of the interrupted run
+	var checkpoint *tableChunkInfo
+	openflag := os.O_CREATE | os.O_WRONLY | os.O_SYNC
+	if arg.ArgResume {
+		if checkpoint, err = LastChunkCheckpoint(outputfile, log); err != nil {
+			return nil, err
+		}
+		if checkpoint != nil {
+			err = TrimRowLevelLog(rowlevelfile, checkpoint.ChunkIdx, log)
+		} else {
+			err = removeFile(rowlevelfile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		openflag |= os.O_APPEND
+	} else {
+		if err = removeFile(outputfile); err != nil {
+			return nil, err
+		}
+		if err = removeFile(rowlevelfile); err != nil {
+			return nil, err
+		}
+	}
 
-	var e error
-	envArg.ArgOutputfile, e = os.OpenFile(
+	arg.ArgOutputfile, err = os.OpenFile(
 		outputfile,
-		os.O_CREATE|os.O_WRONLY|os.O_SYNC,
+		openflag,
 		0o666,
 	)
-	errorCheck(e)
-	defer func() {
-		e := envArg.ArgOutputfile.Close()
-		errorCheck(e)
-	}()
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(arg.ArgOutputfile, &err)
 
-	envArg.ArgOutputRowLevelfile, e = os.OpenFile(
+	arg.ArgOutputRowLevelfile, err = os.OpenFile(
 		rowlevelfile,
-		os.O_CREATE|os.O_WRONLY|os.O_SYNC,
+		openflag,
 		0o666,
 	)
-	errorCheck(e)
-	defer func() {
-		e := envArg.ArgOutputRowLevelfile.Close()
-		errorCheck(e)
-	}()
-
-	setLogSettings()
-
-	dbSrc := InitializeDBSettings(
-		envVar.DfcSrcHost,
-		envVar.DfcSrcPort,
-		envVar.DfcSrcUsername,
-		envVar.DfcSrcPassword,
-		envVar.DfcSrcDbname,
-	)
-	defer func() {
-		e := dbSrc.Close()
-		errorCheck(e)
-	}()
-
-	dbTgt := InitializeDBSettings(
-		envVar.DfcTgtHost,
-		envVar.DfcTgtPort,
-		envVar.DfcTgtUsername,
-		envVar.DfcTgtPassword,
-		envVar.DfcTgtDbname,
-	)
-	defer func() {
-		e := dbTgt.Close()
-		errorCheck(e)
-	}()
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(arg.ArgOutputRowLevelfile, &err)
+
+	logArgs(arg)
 
-	allpkcolumns := allPKColumns(dbSrc, envArg.ArgSrcTable)
+	if arg.ArgResume && checkpoint == nil {
+		log.Infof("no checkpoint found in %s, start from the beginning\n", outputfile)
+	}
+
+	if arg.ArgChunkIndex != "" {
+		keycolumns, e := queryChunkIndexColumns(dbSrc, arg.ArgSrcTable, arg.ArgChunkIndex, arg.ArgKeyColumns)
+		if e != nil {
+			return nil, e
+		}
+		log.Infof("chunking on index %s, key columns: %s\n", arg.ArgChunkIndex, strings.Join(keycolumns, ", "))
+		arg.ArgKeyColumns = keycolumns // recorded in chunk logs for query and --resume
+	}
+
+	allpkcolumns, err := queryPKColumns(dbSrc, arg.ArgSrcTable, arg.ArgKeyColumns)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCrossEngine(dbSrc, dbTgt, arg, allpkcolumns); err != nil {
+		return nil, err
+	}
+	if keyname := allpkcolumns[0].KeyName; keyname != "" && !strings.EqualFold(keyname, "primary") {
+		log.Infof("table %s has no primary key, chunking on unique index %s\n", arg.ArgSrcTable, keyname)
+	}
 
 	var t ipkTable
 	switch len(allpkcolumns) {
 	case 1:
-		t = new(pkTableSingle).Init(allpkcolumns)
+		t = new(pkTableSingle).Init(arg, allpkcolumns)
 	default:
-		t = new(pkTableMulti).Init(allpkcolumns)
+		t = new(pkTableMulti).Init(arg, allpkcolumns)
+	}
+
+	if arg.run.progress != nil {
+		estimate, e := t.EstimateRows(dbSrc)
+		if e != nil {
+			return nil, e
+		}
+		arg.run.progress.setEstimate(arg.ArgSrcTable, estimate)
 	}
 
-	// abort if:
+	// fail if:
 	// 1. argPKColumnSequence is less than actual pk columns
 	// 2. chunksize < top 1 count of group by argPKColumnSequence columns
 	if len(t.GetPKColumnNames()) < len(allpkcolumns) {
-		maxgroupcount := t.PKColumnMaxGroupCount(dbSrc)
-		if envArg.ArgChunksize <= maxgroupcount {
-			log.Fatalf(
-				"chunksize should be greater than max count(%d) of group by (%s) columns\n",
+		maxgroupcount, e := t.PKColumnMaxGroupCount(dbSrc)
+		if e != nil {
+			return nil, e
+		}
+		if arg.ArgChunksize <= maxgroupcount {
+			return nil, fmt.Errorf(
+				"chunksize should be greater than max count(%d) of group by (%s) columns",
 				maxgroupcount,
 				strings.Join(t.GetPKColumnNames(), ", "),
 			)
 		}
 	}
 
-	t.RunTableRoutine(dbSrc, dbTgt, t)
+	if ts, err = t.RunTableRoutine(dbSrc, dbTgt, t, checkpoint); err != nil {
+		return nil, err
+	}
+	ts.Outputfile = outputfile
+	ts.RowLevelfile = rowlevelfile
+	ts.Args = newTableArgs(arg)
+
+	return
 } // }}}
 
 // vim: fdm=marker fdc=2
@@ -18,9 +18,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package diff
 
 import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/big"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -32,8 +38,8 @@ import (
 
 // iFieldType : field type attribute interface
 type iFieldType interface {
-	transformDBResultType(v any) any
-	transformFieldType(v any) any
+	transformDBResultType(v any) (any, error)
+	transformFieldType(v any) (any, error)
 	lowestFieldData() any
 	greaterThan(v1 any, v2 any) bool
 	equals(v1 any, v2 any) bool
@@ -47,13 +53,18 @@ type fieldtypeInt struct{}
 
 // implement interface {{{
 
-func (t *fieldtypeInt) transformDBResultType(v any) any { // {{{
-	return v
+func (t *fieldtypeInt) transformDBResultType(v any) (any, error) { // {{{
+	return v, nil
 } // }}}
 
-func (t *fieldtypeInt) transformFieldType(v any) any { // {{{
+func (t *fieldtypeInt) transformFieldType(v any) (any, error) { // {{{
 	v2, _ := strconv.ParseInt(fmt.Sprint(v), 10, 64)
-	return v2
+	return v2, nil
+} // }}}
+
+func (t *fieldtypeInt) value(v any) int64 { // {{{
+	v2, _ := t.transformFieldType(v)
+	return v2.(int64)
 } // }}}
 
 func (t *fieldtypeInt) lowestFieldData() any { // {{{
@@ -61,11 +72,11 @@ func (t *fieldtypeInt) lowestFieldData() any { // {{{
 } // }}}
 
 func (t *fieldtypeInt) greaterThan(v1 any, v2 any) bool { // {{{
-	return t.transformFieldType(v1).(int64) > t.transformFieldType(v2).(int64)
+	return t.value(v1) > t.value(v2)
 } // }}}
 
 func (t *fieldtypeInt) equals(v1 any, v2 any) bool { // {{{
-	return t.transformFieldType(v1).(int64) == t.transformFieldType(v2).(int64)
+	return t.value(v1) == t.value(v2)
 } // }}}
 
 func (t *fieldtypeInt) withQuote() bool { // {{{
@@ -83,12 +94,15 @@ type fieldtypeChar struct{}
 
 // implement interface {{{
 
-func (t *fieldtypeChar) transformDBResultType(v any) any { // {{{
-	return string(v.([]uint8))
+func (t *fieldtypeChar) transformDBResultType(v any) (any, error) { // {{{
+	if s, isstring := v.(string); isstring { // lib/pq
+		return s, nil
+	}
+	return string(v.([]uint8)), nil
 } // }}}
 
-func (t *fieldtypeChar) transformFieldType(v any) any { // {{{
-	return v.(string)
+func (t *fieldtypeChar) transformFieldType(v any) (any, error) { // {{{
+	return v.(string), nil
 } // }}}
 
 func (t *fieldtypeChar) lowestFieldData() any { // {{{
@@ -118,11 +132,19 @@ type fieldtypeTime struct{}
 
 // implement interface {{{
 
-func (t *fieldtypeTime) transformDBResultType(v any) any { // {{{
-	return t.transformFieldType(v).(time.Time).Format("2006-01-02T15:04:05-07:00")
+func (t *fieldtypeTime) transformDBResultType(v any) (any, error) { // {{{
+	r, e := t.transformFieldType(v)
+	if e != nil {
+		return "", e
+	}
+	return r.(time.Time).Format("2006-01-02T15:04:05-07:00"), nil
 } // }}}
 
-func (t *fieldtypeTime) transformFieldType(v any) any { // {{{
+func (t *fieldtypeTime) transformFieldType(v any) (any, error) { // {{{
+	if r, istime := v.(time.Time); istime { // parsed by the driver
+		return r, nil
+	}
+
 	r, e := time.Parse("2006-01-02", fmt.Sprint(v))
 	if e != nil {
 		r, e = time.Parse("2006-01-02 15:04:05", fmt.Sprint(v))
@@ -134,26 +156,34 @@ func (t *fieldtypeTime) transformFieldType(v any) any { // {{{
 					r, e = time.Parse("2006-01-02 15:04:05 -0700 MST", fmt.Sprint(v))
 					if e != nil {
 						r, e = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", fmt.Sprint(v))
-						errorCheck(e)
+						if e != nil {
+							return time.Time{}, e
+						}
 					}
 				}
 			}
 		}
 	}
-	return r
+	return r, nil
+} // }}}
+
+func (t *fieldtypeTime) value(v any) time.Time { // {{{
+	r, _ := t.transformFieldType(v)
+	return r.(time.Time)
 } // }}}
 
 func (t *fieldtypeTime) lowestFieldData() any { // {{{
 	// https://stackoverflow.com/questions/25065055/what-is-the-maximum-time-time-in-go
-	return t.transformDBResultType(time.Unix(0, 0))
+	lowest, _ := t.transformDBResultType(time.Unix(0, 0))
+	return lowest
 } // }}}
 
 func (t *fieldtypeTime) greaterThan(v1 any, v2 any) bool { // {{{
-	return t.transformFieldType(v1).(time.Time).After(t.transformFieldType(v2).(time.Time))
+	return t.value(v1).After(t.value(v2))
 } // }}}
 
 func (t *fieldtypeTime) equals(v1 any, v2 any) bool { // {{{
-	return t.transformFieldType(v1).(time.Time).Equal(t.transformFieldType(v2).(time.Time))
+	return t.value(v1).Equal(t.value(v2))
 } // }}}
 
 func (t *fieldtypeTime) withQuote() bool { // {{{
@@ -171,11 +201,19 @@ type fieldtypeDate struct{}
 
 // implement interface {{{
 
-func (t *fieldtypeDate) transformDBResultType(v any) any { // {{{
-	return t.transformFieldType(v).(time.Time).Format("2006-01-02")
+func (t *fieldtypeDate) transformDBResultType(v any) (any, error) { // {{{
+	r, e := t.transformFieldType(v)
+	if e != nil {
+		return "", e
+	}
+	return r.(time.Time).Format("2006-01-02"), nil
 } // }}}
 
-func (t *fieldtypeDate) transformFieldType(v any) any { // {{{
+func (t *fieldtypeDate) transformFieldType(v any) (any, error) { // {{{
+	if r, istime := v.(time.Time); istime { // parsed by the driver
+		return r, nil
+	}
+
 	r, e := time.Parse("2006-01-02", fmt.Sprint(v))
 	if e != nil {
 		r, e = time.Parse("2006-01-02 15:04:05", fmt.Sprint(v))
@@ -187,26 +225,34 @@ func (t *fieldtypeDate) transformFieldType(v any) any { // {{{
 					r, e = time.Parse("2006-01-02 15:04:05 -0700 MST", fmt.Sprint(v))
 					if e != nil {
 						r, e = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", fmt.Sprint(v))
-						errorCheck(e)
+						if e != nil {
+							return time.Time{}, e
+						}
 					}
 				}
 			}
 		}
 	}
-	return r
+	return r, nil
+} // }}}
+
+func (t *fieldtypeDate) value(v any) time.Time { // {{{
+	r, _ := t.transformFieldType(v)
+	return r.(time.Time)
 } // }}}
 
 func (t *fieldtypeDate) lowestFieldData() any { // {{{
 	// https://stackoverflow.com/questions/25065055/what-is-the-maximum-time-time-in-go
-	return t.transformDBResultType(time.Unix(0, 0))
+	lowest, _ := t.transformDBResultType(time.Unix(0, 0))
+	return lowest
 } // }}}
 
 func (t *fieldtypeDate) greaterThan(v1 any, v2 any) bool { // {{{
-	return t.transformFieldType(v1).(time.Time).After(t.transformFieldType(v2).(time.Time))
+	return t.value(v1).After(t.value(v2))
 } // }}}
 
 func (t *fieldtypeDate) equals(v1 any, v2 any) bool { // {{{
-	return t.transformFieldType(v1).(time.Time).Equal(t.transformFieldType(v2).(time.Time))
+	return t.value(v1).Equal(t.value(v2))
 } // }}}
 
 func (t *fieldtypeDate) withQuote() bool { // {{{
@@ -217,4 +263,306 @@ func (t *fieldtypeDate) withQuote() bool { // {{{
 
 //  └──────────────────────────────────────────────────────────────────────────────┘
 
+// ┌──────────────────────────────────────────────────────────────────────────────┐
+//	decimal data type, values are kept as decimal text so no digit is lost to float
+
+type fieldtypeDecimal struct{}
+
+// implement interface {{{
+
+func (t *fieldtypeDecimal) transformDBResultType(v any) (any, error) { // {{{
+	return t.transformFieldType(v)
+} // }}}
+
+func (t *fieldtypeDecimal) transformFieldType(v any) (any, error) { // {{{
+	s := fmt.Sprint(v)
+	if b, isbytes := v.([]uint8); isbytes {
+		s = string(b)
+	}
+	if _, ok := new(big.Rat).SetString(s); !ok {
+		return json.Number(""), fmt.Errorf("invalid decimal value: %v", v)
+	}
+	return json.Number(s), nil
+} // }}}
+
+func (t *fieldtypeDecimal) lowestFieldData() any { // {{{
+	return json.Number("-1" + strings.Repeat("0", 65)) // more digits than DECIMAL(65) holds
+} // }}}
+
+func (t *fieldtypeDecimal) rat(v any) *big.Rat { // {{{
+	n, _ := t.transformFieldType(v)
+	r, ok := new(big.Rat).SetString(string(n.(json.Number)))
+	if !ok {
+		return new(big.Rat)
+	}
+	return r
+} // }}}
+
+func (t *fieldtypeDecimal) greaterThan(v1 any, v2 any) bool { // {{{
+	return t.rat(v1).Cmp(t.rat(v2)) > 0
+} // }}}
+
+func (t *fieldtypeDecimal) equals(v1 any, v2 any) bool { // {{{
+	return t.rat(v1).Cmp(t.rat(v2)) == 0
+} // }}}
+
+func (t *fieldtypeDecimal) withQuote() bool { // {{{
+	return false
+} // }}}
+
+// }}}
+
+//  └──────────────────────────────────────────────────────────────────────────────┘
+
+// ┌──────────────────────────────────────────────────────────────────────────────┐
+//	float and double data type
+
+type fieldtypeFloat struct{}
+
+// implement interface {{{
+
+func (t *fieldtypeFloat) transformDBResultType(v any) (any, error) { // {{{
+	return t.transformFieldType(v)
+} // }}}
+
+func (t *fieldtypeFloat) transformFieldType(v any) (any, error) { // {{{
+	switch f := v.(type) {
+	case float64:
+		return f, nil
+	case float32:
+		return float64(f), nil
+	case []uint8:
+		v = string(f)
+	}
+	f, e := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if e != nil {
+		return float64(0), e
+	}
+	return f, nil
+} // }}}
+
+func (t *fieldtypeFloat) value(v any) float64 { // {{{
+	f, _ := t.transformFieldType(v)
+	return f.(float64)
+} // }}}
+
+func (t *fieldtypeFloat) lowestFieldData() any { // {{{
+	return -math.MaxFloat64
+} // }}}
+
+func (t *fieldtypeFloat) greaterThan(v1 any, v2 any) bool { // {{{
+	return t.value(v1) > t.value(v2)
+} // }}}
+
+func (t *fieldtypeFloat) equals(v1 any, v2 any) bool { // {{{
+	return t.value(v1) == t.value(v2)
+} // }}}
+
+func (t *fieldtypeFloat) withQuote() bool { // {{{
+	return false
+} // }}}
+
+// }}}
+
+//  └──────────────────────────────────────────────────────────────────────────────┘
+
+// ┌──────────────────────────────────────────────────────────────────────────────┐
+//	binary and varbinary data type
+
+// binaryValue : binary field value, written as 0x hex literal in json and sql, bound to queries as
+// raw bytes
+type binaryValue []byte
+
+func (b binaryValue) String() string { // {{{
+	return "0x" + strings.ToUpper(hex.EncodeToString(b))
+} // }}}
+
+func (b binaryValue) MarshalJSON() ([]byte, error) { // {{{
+	return json.Marshal(b.String())
+} // }}}
+
+func (b binaryValue) Value() (driver.Value, error) { // {{{
+	return []byte(b), nil
+} // }}}
+
+type fieldtypeBinary struct{}
+
+// implement interface {{{
+
+func (t *fieldtypeBinary) transformDBResultType(v any) (any, error) { // {{{
+	return binaryValue(append([]byte(nil), v.([]uint8)...)), nil
+} // }}}
+
+func (t *fieldtypeBinary) transformFieldType(v any) (any, error) { // {{{
+	if b, isbinary := v.(binaryValue); isbinary {
+		return b, nil
+	}
+	s := fmt.Sprint(v)
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return binaryValue(s), nil // plain text value
+	}
+	b, e := hex.DecodeString(s[2:])
+	if e != nil {
+		return binaryValue(nil), e
+	}
+	return binaryValue(b), nil
+} // }}}
+
+func (t *fieldtypeBinary) value(v any) binaryValue { // {{{
+	b, _ := t.transformFieldType(v)
+	return b.(binaryValue)
+} // }}}
+
+func (t *fieldtypeBinary) lowestFieldData() any { // {{{
+	return binaryValue{}
+} // }}}
+
+func (t *fieldtypeBinary) greaterThan(v1 any, v2 any) bool { // {{{
+	return bytes.Compare(t.value(v1), t.value(v2)) > 0
+} // }}}
+
+func (t *fieldtypeBinary) equals(v1 any, v2 any) bool { // {{{
+	return bytes.Equal(t.value(v1), t.value(v2))
+} // }}}
+
+func (t *fieldtypeBinary) withQuote() bool { // {{{
+	return false // 0x hex literal
+} // }}}
+
+// }}}
+
+//  └──────────────────────────────────────────────────────────────────────────────┘
+
+// ┌──────────────────────────────────────────────────────────────────────────────┐
+//	enum data type, sorted by index of the value in the enum definition
+
+// enumValue : enum field value, written as its label in json, bound to queries as its index so
+// that comparisons follow the ORDER BY of the column
+type enumValue struct {
+	label string
+	index int64
+}
+
+func (ev enumValue) String() string { // {{{
+	return ev.label
+} // }}}
+
+func (ev enumValue) MarshalJSON() ([]byte, error) { // {{{
+	return json.Marshal(ev.label)
+} // }}}
+
+func (ev enumValue) Value() (driver.Value, error) { // {{{
+	return ev.index, nil
+} // }}}
+
+type fieldtypeEnum struct {
+	labels []string // enum values in definition order, index 1 is labels[0]
+}
+
+// newFieldtypeEnum : enum field type of COLUMN_TYPE like enum('a','b')
+func newFieldtypeEnum(columntype string) *fieldtypeEnum { // {{{
+	t := new(fieldtypeEnum)
+	definition := strings.TrimSuffix(strings.TrimPrefix(columntype, "enum("), ")")
+	for _, label := range strings.Split(definition, "','") {
+		label = strings.TrimSuffix(strings.TrimPrefix(label, "'"), "'")
+		t.labels = append(t.labels, strings.ReplaceAll(label, "''", "'"))
+	}
+	return t
+} // }}}
+
+// implement interface {{{
+
+func (t *fieldtypeEnum) transformDBResultType(v any) (any, error) { // {{{
+	return t.transformFieldType(string(v.([]uint8)))
+} // }}}
+
+func (t *fieldtypeEnum) transformFieldType(v any) (any, error) { // {{{
+	if ev, isenum := v.(enumValue); isenum {
+		return ev, nil
+	}
+	label := fmt.Sprint(v)
+	for i, l := range t.labels {
+		if l == label {
+			return enumValue{label: label, index: int64(i + 1)}, nil
+		}
+	}
+	return enumValue{label: label, index: 0}, nil // invalid value stored as ''
+} // }}}
+
+func (t *fieldtypeEnum) value(v any) enumValue { // {{{
+	ev, _ := t.transformFieldType(v)
+	return ev.(enumValue)
+} // }}}
+
+func (t *fieldtypeEnum) lowestFieldData() any { // {{{
+	return enumValue{label: "", index: 0}
+} // }}}
+
+func (t *fieldtypeEnum) greaterThan(v1 any, v2 any) bool { // {{{
+	return t.value(v1).index > t.value(v2).index
+} // }}}
+
+func (t *fieldtypeEnum) equals(v1 any, v2 any) bool { // {{{
+	return t.value(v1).index == t.value(v2).index
+} // }}}
+
+func (t *fieldtypeEnum) withQuote() bool { // {{{
+	return true
+} // }}}
+
+// }}}
+
+//  └──────────────────────────────────────────────────────────────────────────────┘
+
+// ┌──────────────────────────────────────────────────────────────────────────────┐
+//	bit data type, values are unsigned integers
+
+type fieldtypeBit struct{}
+
+// implement interface {{{
+
+func (t *fieldtypeBit) transformDBResultType(v any) (any, error) { // {{{
+	var u uint64
+	for _, b := range v.([]uint8) { // big endian
+		u = u<<8 | uint64(b)
+	}
+	return u, nil
+} // }}}
+
+func (t *fieldtypeBit) transformFieldType(v any) (any, error) { // {{{
+	if u, isuint := v.(uint64); isuint {
+		return u, nil
+	}
+	u, e := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+	if e != nil {
+		return uint64(0), e
+	}
+	return u, nil
+} // }}}
+
+func (t *fieldtypeBit) value(v any) uint64 { // {{{
+	u, _ := t.transformFieldType(v)
+	return u.(uint64)
+} // }}}
+
+func (t *fieldtypeBit) lowestFieldData() any { // {{{
+	return uint64(0)
+} // }}}
+
+func (t *fieldtypeBit) greaterThan(v1 any, v2 any) bool { // {{{
+	return t.value(v1) > t.value(v2)
+} // }}}
+
+func (t *fieldtypeBit) equals(v1 any, v2 any) bool { // {{{
+	return t.value(v1) == t.value(v2)
+} // }}}
+
+func (t *fieldtypeBit) withQuote() bool { // {{{
+	return false
+} // }}}
+
+// }}}
+
+//  └──────────────────────────────────────────────────────────────────────────────┘
+
 // vim: fdm=marker fdc=2
@@ -0,0 +1,147 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFieldTypeOf(t *testing.T) { // {{{
+	tests := []struct {
+		datatype   string
+		columntype string
+		want       iFieldType
+	}{
+		{"int", "int(11)", new(fieldtypeInt)},
+		{"bigint", "bigint(20) unsigned", new(fieldtypeInt)},
+		{"tinyint", "tinyint(1)", new(fieldtypeInt)},
+		{"year", "year(4)", new(fieldtypeInt)},
+		{"varchar", "varchar(50)", new(fieldtypeChar)},
+		{"char", "char(2)", new(fieldtypeChar)},
+		{"binary", "binary(16)", new(fieldtypeBinary)},
+		{"varbinary", "varbinary(255)", new(fieldtypeBinary)},
+		{"decimal", "decimal(10,2)", new(fieldtypeDecimal)},
+		{"float", "float", new(fieldtypeFloat)},
+		{"double", "double", new(fieldtypeFloat)},
+		{"enum", "enum('a''b','c')", &fieldtypeEnum{labels: []string{"a'b", "c"}}},
+		{"bit", "bit(8)", new(fieldtypeBit)},
+		{"datetime", "datetime(3)", new(fieldtypeTime)},
+		{"timestamp", "timestamp", new(fieldtypeTime)},
+		{"date", "date", new(fieldtypeDate)},
+		{"text", "text", nil},
+		{"json", "json", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.columntype, func(t *testing.T) {
+			if got := fieldTypeOf(tt.datatype, tt.columntype); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fieldTypeOf(%s, %s) = %#v, want %#v", tt.datatype, tt.columntype, got, tt.want)
+			}
+		})
+	}
+} // }}}
+
+func TestFieldTypeCompare(t *testing.T) { // {{{
+	enum := newFieldtypeEnum("enum('z','a')")
+
+	tests := []struct {
+		name    string
+		ft      iFieldType
+		v1, v2  any
+		greater bool
+		equal   bool
+	}{
+		{"int of json", new(fieldtypeInt), json.Number("10"), json.Number("9"), true, false},
+		{"int of driver and text", new(fieldtypeInt), int64(-5), "-5", false, true},
+		{"char", new(fieldtypeChar), "b", "ab", true, false},
+		{"decimal scale", new(fieldtypeDecimal), json.Number("10.50"), "10.5", false, true},
+		{"decimal digits above float", new(fieldtypeDecimal), "12345678901234567890.01", "12345678901234567890.001", true, false},
+		{"decimal of driver bytes", new(fieldtypeDecimal), []uint8("-1.5"), json.Number("-1.25"), false, false},
+		{"float", new(fieldtypeFloat), 1.5, "1.25", true, false},
+		{"float of driver bytes", new(fieldtypeFloat), []uint8("2.5e1"), float32(25), false, true},
+		{"time formats", new(fieldtypeTime), "2023-01-02 03:04:05", "2023-01-02T03:04:05Z", false, true},
+		{"time of driver", new(fieldtypeTime), time.Date(2023, 1, 2, 3, 4, 6, 0, time.UTC), "2023-01-02T03:04:05+00:00", true, false},
+		{"time of offset", new(fieldtypeTime), "2023-01-02T04:04:05+01:00", "2023-01-02 03:04:05", false, true},
+		{"date", new(fieldtypeDate), "2023-01-03", "2023-01-02 00:00:00", true, false},
+		{"binary hex and raw", new(fieldtypeBinary), "0x6162", binaryValue("ab"), false, true},
+		{"binary bytes order", new(fieldtypeBinary), "0xFF", "0x0100", true, false},
+		{"enum definition order", enum, "a", "z", true, false},
+		{"enum invalid lowest", enum, "", "z", false, false},
+		{"bit", new(fieldtypeBit), uint64(256), "255", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ft.greaterThan(tt.v1, tt.v2); got != tt.greater {
+				t.Errorf("greaterThan(%v, %v) = %v, want %v", tt.v1, tt.v2, got, tt.greater)
+			}
+			if got := tt.ft.equals(tt.v1, tt.v2); got != tt.equal {
+				t.Errorf("equals(%v, %v) = %v, want %v", tt.v1, tt.v2, got, tt.equal)
+			}
+			// the lowest value sorts before every value
+			if tt.ft.greaterThan(tt.ft.lowestFieldData(), tt.v1) {
+				t.Errorf("lowestFieldData() %v is greater than %v", tt.ft.lowestFieldData(), tt.v1)
+			}
+		})
+	}
+} // }}}
+
+func TestFieldTypeDBResult(t *testing.T) { // {{{
+	tests := []struct {
+		name string
+		ft   iFieldType
+		v    any // value scanned by the driver
+		want string
+	}{
+		{"int", new(fieldtypeInt), int64(7), "7"},
+		{"char bytes", new(fieldtypeChar), []uint8("abc"), "abc"},
+		{"char string of lib/pq", new(fieldtypeChar), "abc", "abc"},
+		{"time", new(fieldtypeTime), time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), "2023-01-02T03:04:05+00:00"},
+		{"date", new(fieldtypeDate), time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), "2023-01-02"},
+		{"decimal", new(fieldtypeDecimal), []uint8("10.50"), "10.50"},
+		{"binary", new(fieldtypeBinary), []uint8{0x01, 0xab}, "0x01AB"},
+		{"enum", newFieldtypeEnum("enum('z','a')"), []uint8("a"), "a"},
+		{"bit big endian", new(fieldtypeBit), []uint8{1, 0}, "256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, e := tt.ft.transformDBResultType(tt.v)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if got := fmt.Sprint(v); got != tt.want {
+				t.Errorf("transformDBResultType(%v) = %s, want %s", tt.v, got, tt.want)
+			}
+			// the value written to the chunk log reads back as the same key value
+			readback, e := tt.ft.transformFieldType(fmt.Sprint(v))
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !tt.ft.equals(v, readback) {
+				t.Errorf("%s does not read back as %v", fmt.Sprint(v), v)
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,455 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultOutputFormat is the NDJSON chunk log read back by --resume and the query command
+const defaultOutputFormat = "json"
+
+// outputWriter : writer of the chunk output and row level output of a table in one --format
+type outputWriter interface {
+	write(cr chunkResult) error   // chunks come in chunk index order
+	close(ts *TableSummary) error // totals of the table, not called if the table failed
+}
+
+// outputFormat : file extension and writer of an --format
+type outputFormat struct { // {{{
+	ext       string
+	newWriter func(t *pkTable) (outputWriter, error)
+} // }}}
+
+// outputFormats : writers of each --format on the outputs of a table
+func outputFormats() map[string]outputFormat { // {{{
+	return map[string]outputFormat{
+		"json":     {ext: "json", newWriter: newJSONWriter},
+		"csv":      {ext: "csv", newWriter: newCSVWriter},
+		"markdown": {ext: "md", newWriter: newMarkdownWriter},
+		"junit":    {ext: "xml", newWriter: newJUnitWriter},
+	}
+} // }}}
+
+// OutputFormatNames : names accepted by --format
+func OutputFormatNames() (names []string) { // {{{
+	for name := range outputFormats() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+} // }}}
+
+// OutputFile : output file named after output with name inserted before its final extension,
+// e.g. log.json and emp give log.emp.json. Empty output names log.<extension of format>
+func OutputFile(output string, format string, name string) string { // {{{
+	if output == "" {
+		ext := outputFormats()[defaultOutputFormat].ext
+		if f, exists := outputFormats()[format]; exists {
+			ext = f.ext
+		}
+		output = "log." + ext
+	}
+	if name == "" {
+		return output
+	}
+
+	ext := filepath.Ext(output)
+	return strings.TrimSuffix(output, ext) + "." + name + ext
+} // }}}
+
+// summaryFile : json summary file of the run named after output, e.g. log.md gives
+// log.summary.json
+func summaryFile(output string, format string) string { // {{{
+	output = OutputFile(output, format, "")
+	return strings.TrimSuffix(output, filepath.Ext(output)) + ".summary.json"
+} // }}}
+
+// chunkBoundaries : lower and upper boundary of the chunk, pk field values
+func chunkBoundaries(tci *tableChunkInfo) (lower []any, upper []any) { // {{{
+	lower = tci.LowerBoundary
+	upper = append(append([]any{}, tci.LowerBoundary[:len(tci.LowerBoundary)-1]...), tci.LastPKFieldUpperBoundary)
+	return
+} // }}}
+
+// jsonString : compact json of v for csv and markdown cells, v holds values scanned from the DBs
+// which always encode
+func jsonString(v any) string { // {{{
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+} // }}}
+
+// diffRow : differing row of the row level output
+type diffRow struct { // {{{
+	op string // insert, update or delete
+	TableRow
+} // }}}
+
+// diffRows : differing rows of a chunk, inserts first
+func diffRows(tcri *TableChunkRowsInfo) (rows []diffRow) { // {{{
+	for _, crud := range []struct {
+		op   string
+		rows []TableRow
+	}{
+		{"insert", tcri.Diff.Insert},
+		{"update", tcri.Diff.Update},
+		{"delete", tcri.Diff.Delete},
+	} {
+		for _, tr := range crud.rows {
+			rows = append(rows, diffRow{op: crud.op, TableRow: tr})
+		}
+	}
+	return
+} // }}}
+
+// jsonWriter : NDJSON, one line per chunk and per mismatched chunk
+type jsonWriter struct { // {{{
+	t *pkTable
+} // }}}
+
+func newJSONWriter(t *pkTable) (outputWriter, error) { // {{{
+	return &jsonWriter{t: t}, nil
+} // }}}
+
+func (w *jsonWriter) write(cr chunkResult) error { // {{{
+	// row level line first, --resume trusts the row level lines of chunks in the chunk output
+	if cr.tcri != nil {
+		if e := w.t.TableLog(w.t.arg.ArgOutputRowLevelfile, cr.tcri); e != nil {
+			return e
+		}
+	}
+	return w.t.TableLog(w.t.arg.ArgOutputfile, cr.tci)
+} // }}}
+
+func (w *jsonWriter) close(ts *TableSummary) error { return nil } // }}}
+
+// csvWriter : one record per chunk in the chunk output, one record per differing row in the row
+// level output. Boundaries, pk values and column values are json
+type csvWriter struct { // {{{
+	t      *pkTable
+	chunks *csv.Writer
+	rows   *csv.Writer
+} // }}}
+
+func newCSVWriter(t *pkTable) (outputWriter, error) { // {{{
+	w := &csvWriter{
+		t:      t,
+		chunks: csv.NewWriter(t.arg.ArgOutputfile),
+		rows:   csv.NewWriter(t.arg.ArgOutputRowLevelfile),
+	}
+
+	if e := w.chunks.Write([]string{
+		"tablesrc", "tabletgt", "chunkidx", "match", "lowerboundary", "upperboundary",
+		"rowcntsrc", "rowcnttgt", "hashsrc", "hashtgt", "elapsedmssrc", "elapsedmstgt",
+	}); e != nil {
+		return nil, e
+	}
+	if e := w.rows.Write([]string{
+		"tablesrc", "tabletgt", "chunkidx", "op", "pkcolumnnames", "pkcolumnvalues",
+		"rowhash", "columns", "before", "after",
+	}); e != nil {
+		return nil, e
+	}
+
+	return w, nil
+} // }}}
+
+func (w *csvWriter) write(cr chunkResult) error { // {{{
+	tci := cr.tci
+
+	if cr.tcri != nil {
+		for _, row := range diffRows(cr.tcri) {
+			var columns, before, after string
+			if len(row.Columns) > 0 {
+				columns = strings.Join(row.Columns, ",")
+			}
+			if row.Before != nil {
+				before, after = jsonString(row.Before), jsonString(row.After)
+			}
+			if e := w.rows.Write([]string{
+				tci.TableSrc, tci.TableTgt, fmt.Sprint(tci.ChunkIdx), row.op,
+				strings.Join(w.t.GetAllPKColumnNames(), ","), jsonString(row.AllPKColumnValues),
+				string(row.Hash), columns, before, after,
+			}); e != nil {
+				return e
+			}
+		}
+		w.rows.Flush()
+		if e := w.rows.Error(); e != nil {
+			return e
+		}
+	}
+
+	lower, upper := chunkBoundaries(tci)
+	if e := w.chunks.Write([]string{
+		tci.TableSrc, tci.TableTgt, fmt.Sprint(tci.ChunkIdx), fmt.Sprint(tci.Match),
+		jsonString(lower), jsonString(upper),
+		fmt.Sprint(tci.RowcntSrc), fmt.Sprint(tci.RowcntTgt),
+		string(tci.HashSrc), string(tci.HashTgt),
+		fmt.Sprint(tci.ElapsedMsSrc), fmt.Sprint(tci.ElapsedMsTgt),
+	}); e != nil {
+		return e
+	}
+	w.chunks.Flush()
+	return w.chunks.Error()
+} // }}}
+
+func (w *csvWriter) close(ts *TableSummary) error { return nil } // }}}
+
+// markdownWriter : mismatched chunks and totals of the table in the chunk output, differing rows
+// in the row level output, for tickets
+type markdownWriter struct { // {{{
+	t          *pkTable
+	mismatches int
+	rows       int
+} // }}}
+
+// markdownCell : s escaped for a markdown table cell
+func markdownCell(s string) string { // {{{
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+} // }}}
+
+func newMarkdownWriter(t *pkTable) (outputWriter, error) { // {{{
+	title := fmt.Sprintf("# diff %s → %s\n\n", t.arg.ArgSrcTable, t.arg.ArgTgtTable)
+	if _, e := fmt.Fprint(t.arg.ArgOutputfile, title); e != nil {
+		return nil, e
+	}
+	if _, e := fmt.Fprint(t.arg.ArgOutputRowLevelfile, title); e != nil {
+		return nil, e
+	}
+
+	return &markdownWriter{t: t}, nil
+} // }}}
+
+func (w *markdownWriter) write(cr chunkResult) error { // {{{
+	tci := cr.tci
+
+	if cr.tcri != nil {
+		for _, row := range diffRows(cr.tcri) {
+			if w.rows == 0 {
+				if _, e := fmt.Fprintf(
+					w.t.arg.ArgOutputRowLevelfile,
+					"| chunk | op | %s | columns | before | after |\n|---:|---|---|---|---|---|\n",
+					markdownCell(strings.Join(w.t.GetAllPKColumnNames(), ", ")),
+				); e != nil {
+					return e
+				}
+			}
+			w.rows++
+
+			var before, after string
+			if row.Before != nil {
+				before, after = jsonString(row.Before), jsonString(row.After)
+			}
+			if _, e := fmt.Fprintf(
+				w.t.arg.ArgOutputRowLevelfile,
+				"| %d | %s | %s | %s | %s | %s |\n",
+				tci.ChunkIdx, row.op,
+				markdownCell(strings.Trim(jsonString(row.AllPKColumnValues), "[]")),
+				markdownCell(strings.Join(row.Columns, ", ")),
+				markdownCell(before), markdownCell(after),
+			); e != nil {
+				return e
+			}
+		}
+	}
+
+	if tci.Match {
+		return nil
+	}
+
+	if w.mismatches == 0 {
+		if _, e := fmt.Fprint(
+			w.t.arg.ArgOutputfile,
+			"## mismatched chunks\n\n"+
+				"| chunk | lower boundary | upper boundary | rowcnt source | rowcnt target |\n"+
+				"|---:|---|---|---:|---:|\n",
+		); e != nil {
+			return e
+		}
+	}
+	w.mismatches++
+
+	lower, upper := chunkBoundaries(tci)
+	_, e := fmt.Fprintf(
+		w.t.arg.ArgOutputfile,
+		"| %d | %s | %s | %d | %d |\n",
+		tci.ChunkIdx,
+		markdownCell(strings.Trim(jsonString(lower), "[]")),
+		markdownCell(strings.Trim(jsonString(upper), "[]")),
+		tci.RowcntSrc, tci.RowcntTgt,
+	)
+	return e
+} // }}}
+
+func (w *markdownWriter) close(ts *TableSummary) error { // {{{
+	if w.rows == 0 {
+		if _, e := fmt.Fprint(w.t.arg.ArgOutputRowLevelfile, "no differing rows\n"); e != nil {
+			return e
+		}
+	}
+
+	var b strings.Builder
+	if w.mismatches == 0 {
+		b.WriteString("no mismatched chunks\n")
+	}
+	fmt.Fprintf(&b, "\n## summary\n\n")
+	fmt.Fprintf(&b, "| status | chunks | mismatched | rowcnt source | rowcnt target | insert | update | delete | elapsed ms |\n")
+	fmt.Fprintf(&b, "|---|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	fmt.Fprintf(
+		&b, "| %s | %d | %d | %d | %d | %d | %d | %d | %d |\n",
+		ts.Status, ts.Chunks, ts.MismatchChunks, ts.RowcntSrc, ts.RowcntTgt,
+		ts.Insert, ts.Update, ts.Delete, ts.ElapsedMs,
+	)
+	if ts.Reason != "" {
+		fmt.Fprintf(&b, "\n%s\n", ts.Reason)
+	}
+
+	_, e := fmt.Fprint(w.t.arg.ArgOutputfile, b.String())
+	return e
+} // }}}
+
+// junitTestsuites : JUnit XML report, written once the table is done
+type junitTestsuites struct { // {{{
+	XMLName    xml.Name         `xml:"testsuites"`
+	Testsuites []junitTestsuite `xml:"testsuite"`
+} // }}}
+
+type junitTestsuite struct { // {{{
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Testcases []junitTestcase `xml:"testcase"`
+} // }}}
+
+type junitTestcase struct { // {{{
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+} // }}}
+
+type junitFailure struct { // {{{
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+} // }}}
+
+// junitWriter : one testcase per chunk in the chunk output, failed for mismatched chunks. One
+// failed testcase per differing row in the row level output
+type junitWriter struct { // {{{
+	t      *pkTable
+	chunks junitTestsuite
+	rows   junitTestsuite
+} // }}}
+
+// seconds : milliseconds as JUnit seconds
+func seconds(ms int64) string { // {{{
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+} // }}}
+
+func newJUnitWriter(t *pkTable) (outputWriter, error) { // {{{
+	name := t.arg.ArgSrcTable + " -> " + t.arg.ArgTgtTable
+	return &junitWriter{
+		t:      t,
+		chunks: junitTestsuite{Name: name, Time: seconds(0)},
+		rows:   junitTestsuite{Name: name + " rows", Time: seconds(0)},
+	}, nil
+} // }}}
+
+func (w *junitWriter) write(cr chunkResult) error { // {{{
+	tci := cr.tci
+	classname := "diffchecker." + tci.TableSrc
+	lower, upper := chunkBoundaries(tci)
+	chunkname := fmt.Sprintf(
+		"chunk %d -l %s -u %s", tci.ChunkIdx,
+		strings.Trim(jsonString(lower), "[]"), strings.Trim(jsonString(upper), "[]"),
+	)
+
+	elapsedms := tci.ElapsedMsSrc
+	if tci.ElapsedMsTgt > elapsedms {
+		elapsedms = tci.ElapsedMsTgt
+	}
+	tc := junitTestcase{Classname: classname, Name: chunkname, Time: seconds(elapsedms)}
+	if !tci.Match {
+		tc.Failure = &junitFailure{
+			Message: fmt.Sprintf("rowcnt %d/%d, hash %s/%s", tci.RowcntSrc, tci.RowcntTgt, tci.HashSrc, tci.HashTgt),
+			Type:    "mismatch",
+		}
+		w.chunks.Failures++
+	}
+	w.chunks.Testcases = append(w.chunks.Testcases, tc)
+	w.chunks.Tests++
+
+	if cr.tcri == nil {
+		return nil
+	}
+	for _, row := range diffRows(cr.tcri) {
+		tc := junitTestcase{
+			Classname: classname,
+			Name:      fmt.Sprintf("%s %s", chunkname, strings.Trim(jsonString(row.AllPKColumnValues), "[]")),
+			Time:      seconds(0),
+			Failure: &junitFailure{
+				Message: row.op + " " + strings.Join(w.t.GetAllPKColumnNames(), ",") + " " + jsonString(row.AllPKColumnValues),
+				Type:    row.op,
+			},
+		}
+		if len(row.Columns) > 0 {
+			tc.Failure.Text = "columns: " + strings.Join(row.Columns, ", ")
+			if row.Before != nil {
+				tc.Failure.Text += "\nbefore: " + jsonString(row.Before) + "\nafter: " + jsonString(row.After)
+			}
+		}
+		w.rows.Testcases = append(w.rows.Testcases, tc)
+		w.rows.Tests++
+		w.rows.Failures++
+	}
+	return nil
+} // }}}
+
+// writeReport : JUnit XML of the testsuite to file
+func (w *junitWriter) writeReport(file *os.File, suite junitTestsuite) error { // {{{
+	b, e := xml.MarshalIndent(junitTestsuites{Testsuites: []junitTestsuite{suite}}, "", "  ")
+	if e != nil {
+		return e
+	}
+	_, e = file.Write(append([]byte(xml.Header), append(b, '\n')...))
+	return e
+} // }}}
+
+func (w *junitWriter) close(ts *TableSummary) error { // {{{
+	w.chunks.Time = seconds(ts.ElapsedMs)
+	if e := w.writeReport(w.t.arg.ArgOutputfile, w.chunks); e != nil {
+		return e
+	}
+	return w.writeReport(w.t.arg.ArgOutputRowLevelfile, w.rows)
+} // }}}
+
+// vim: fdm=marker fdc=2
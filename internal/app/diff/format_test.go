@@ -0,0 +1,103 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputFile(t *testing.T) { // {{{
+	tests := []struct {
+		output string
+		format string
+		name   string
+		want   string
+	}{
+		{"", "json", "", "log.json"},
+		{"", "markdown", "", "log.md"},
+		{"", "unknown", "", "log.json"},
+		{"", "csv", "rowlevel", "log.rowlevel.csv"},
+		{"log.json", "json", "emp", "log.emp.json"},
+		{"out/diff.json", "json", "rowlevel", "out/diff.rowlevel.json"},
+		{"out.json/diff.json", "json", "rowlevel", "out.json/diff.rowlevel.json"},
+		{"diff.json.json", "json", "rowlevel", "diff.json.rowlevel.json"},
+		{"log.emp.md", "markdown", "rowlevel", "log.emp.rowlevel.md"},
+		{"out.d/diff", "json", "rowlevel", "out.d/diff.rowlevel"},
+		{"diff.txt", "json", "rowlevel", "diff.rowlevel.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := OutputFile(tt.output, tt.format, tt.name); got != tt.want {
+			t.Errorf("OutputFile(%q, %s, %q) = %s, want %s", tt.output, tt.format, tt.name, got, tt.want)
+		}
+		if tt.name != "" && OutputFile(tt.output, tt.format, tt.name) == OutputFile(tt.output, tt.format, "") {
+			t.Errorf("OutputFile(%q, %s, %q) is the output itself", tt.output, tt.format, tt.name)
+		}
+	}
+} // }}}
+
+func TestSummaryFile(t *testing.T) { // {{{
+	tests := []struct {
+		output string
+		format string
+		want   string
+	}{
+		{"", "json", "log.summary.json"},
+		{"", "junit", "log.summary.json"},
+		{"log.json", "json", "log.summary.json"},
+		{"report.md", "markdown", "report.summary.json"},
+		{"out.xml/diff.xml", "junit", "out.xml/diff.summary.json"},
+		{"diff.md.md", "markdown", "diff.md.summary.json"},
+		{"out.d/diff", "csv", "out.d/diff.summary.json"},
+	}
+
+	for _, tt := range tests {
+		if got := summaryFile(tt.output, tt.format); got != tt.want {
+			t.Errorf("summaryFile(%q, %s) = %s, want %s", tt.output, tt.format, got, tt.want)
+		}
+	}
+} // }}}
+
+func TestNewArgsOutputExtension(t *testing.T) { // {{{
+	tests := []struct {
+		output  string
+		format  string
+		wantErr string
+	}{
+		{"diff.json", "json", ""},
+		{"out.json/diff.json", "json", ""},
+		{"report.md", "markdown", ""},
+		{"diff.json.bak", "json", "-o diff.json.bak should have the .json extension of --format json"},
+		{"diff", "csv", "-o diff should have the .csv extension of --format csv"},
+		{"out.md/diff", "markdown", "should have the .md extension"},
+	}
+
+	for _, tt := range tests {
+		o := &Options{Format: tt.format}
+		o.Table, o.Output = "emp", tt.output
+		o.TableOptions.setDefaults(tt.format)
+
+		_, e := newArgs(&o.TableOptions, o)
+		if tt.wantErr == "" && e != nil || tt.wantErr != "" && (e == nil || !strings.Contains(e.Error(), tt.wantErr)) {
+			t.Errorf("-o %s --format %s: error = %v, want %q", tt.output, tt.format, e, tt.wantErr)
+		}
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,150 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// defaultHashAlgorithm is the hash of chunk logs written before --hash existed
+const defaultHashAlgorithm = "crc32"
+
+// foldHex : fold the first 64 bits of a hex digest to an unsigned integer
+func foldHex(hexexpr string) string { // {{{
+	return "CAST(CONV(LEFT(" + hexexpr + ", 16), 16, 10) AS UNSIGNED)"
+} // }}}
+
+// hashAlgorithms : MySQL expression of each --hash algorithm on the expression expr, other engines
+// support some of them, see dialect
+func hashAlgorithms() map[string]func(expr string) string { // {{{
+	return map[string]func(expr string) string{
+		"crc32": func(expr string) string {
+			return "CAST(CRC32(" + expr + ") AS UNSIGNED)"
+		},
+		"md5": func(expr string) string {
+			return foldHex("MD5(" + expr + ")")
+		},
+		"md5-full": func(expr string) string {
+			return "MD5(" + expr + ")"
+		},
+		"sha1": func(expr string) string {
+			return foldHex("SHA1(" + expr + ")")
+		},
+		"sha1-full": func(expr string) string {
+			return "SHA1(" + expr + ")"
+		},
+		"sha256": func(expr string) string {
+			return foldHex("SHA2(" + expr + ", 256)")
+		},
+		"sha256-full": func(expr string) string {
+			return "SHA2(" + expr + ", 256)"
+		},
+		"sha512-full": func(expr string) string {
+			return "SHA2(" + expr + ", 512)"
+		},
+		// two independent hashes, a collision has to hit both
+		"dual": func(expr string) string {
+			return "CONCAT(CRC32(" + expr + "), ':', MD5(" + expr + "))"
+		},
+	}
+} // }}}
+
+// HashAlgorithmNames : names accepted by --hash
+func HashAlgorithmNames() (names []string) { // {{{
+	for name := range hashAlgorithms() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+} // }}}
+
+// hashExpr : sql expression hashing expr with the algorithm of the run, in the dialect of db
+func (t *pkTable) hashExpr(db *DB, expr string) string { // {{{
+	return db.dialect.hashAlgorithms[t.arg.ArgHash](expr)
+} // }}}
+
+// defaultRowEncoding is the row encoding of chunk logs written before --row-encoding existed
+const defaultRowEncoding = "concat-ws"
+
+// rowEncodings : MySQL expression of each --row-encoding, encoding the columns of a row as the text
+// being hashed
+func rowEncodings() map[string]func(columns []string) string { // {{{
+	return map[string]func(columns []string) string{
+		// NULLs are skipped and '#' is not escaped, ('a#b', NULL) encodes like ('a', 'b')
+		"concat-ws": func(columns []string) string {
+			return "CONCAT_WS('#'," + strings.Join(columns, ",") + ")"
+		},
+		// each column is N for NULL, or V with its length in UTF-8 bytes and its value, no two rows share
+		// one. Lengths are of the utf8mb4 text (CONVERT USING utf8mb4) whatever the column charset, as
+		// other engines count them
+		"null-safe": func(columns []string) string {
+			fields := make([]string, len(columns))
+			for i, column := range columns {
+				fields[i] = "IF(" + column + " IS NULL, 'N', CONCAT('V', LENGTH(CAST(" + column + " AS CHAR CHARACTER SET utf8mb4)), ':', " + column + "))"
+			}
+			return "CONCAT(" + strings.Join(fields, ",") + ")"
+		},
+	}
+} // }}}
+
+// RowEncodingNames : names accepted by --row-encoding
+func RowEncodingNames() (names []string) { // {{{
+	for name := range rowEncodings() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+} // }}}
+
+// rowExpr : sql expression encoding columns with the row encoding of the run, in the dialect of db
+func (t *pkTable) rowExpr(db *DB, columns []string) string { // {{{
+	return db.dialect.rowEncodings[t.arg.ArgRowEncoding](columns)
+} // }}}
+
+// hashValue : chunk or row hash. Integer hashes are written as json numbers like the crc32 chunk
+// logs have always been, hex digests as json strings
+type hashValue string
+
+// MarshalJSON : json number for integer hashes, json string otherwise. A hex digest of digits only
+// with a leading zero is no json number and stays a string
+func (h hashValue) MarshalJSON() ([]byte, error) { // {{{
+	if h != "" && strings.Trim(string(h), "0123456789") == "" && (h == "0" || h[0] != '0') {
+		return []byte(h), nil
+	}
+	return json.Marshal(string(h))
+} // }}}
+
+// UnmarshalJSON : accept both json numbers and json strings
+func (h *hashValue) UnmarshalJSON(b []byte) error { // {{{
+	var s string
+	if e := json.Unmarshal(b, &s); e == nil {
+		*h = hashValue(s)
+		return nil
+	}
+
+	var n json.Number
+	if e := json.Unmarshal(b, &n); e != nil {
+		return e
+	}
+	*h = hashValue(n)
+	return nil
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,177 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// openSQLite : in-memory SQLite database with the dfc_ functions of the sqlite dialect
+func openSQLite(t *testing.T) *sql.DB { // {{{
+	t.Helper()
+	if e := sqliteRegister(); e != nil {
+		t.Fatal(e)
+	}
+	db, e := sql.Open("sqlite", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	db.SetMaxOpenConns(1) // one in-memory database
+	t.Cleanup(func() { db.Close() })
+	return db
+} // }}}
+
+// queryText : text of the single value of query
+func queryText(t *testing.T, db *sql.DB, query string) string { // {{{
+	t.Helper()
+	var v any
+	if e := db.QueryRow(query).Scan(&v); e != nil {
+		t.Fatalf("%s: %v", query, e)
+	}
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+} // }}}
+
+func TestHashValueJSON(t *testing.T) { // {{{
+	tests := []struct {
+		name string
+		hash hashValue
+		json string
+	}{
+		{"crc32 as number", "891568578", `891568578`},
+		{"folded above int64 as number", "18446744073709551615", `18446744073709551615`},
+		{"hex digest as string", "900150983cd24fb0d6963f7d28e17f72", `"900150983cd24fb0d6963f7d28e17f72"`},
+		{"hex digest of digits as string", "0123", `"0123"`},
+		{"zero as number", "0", `0`},
+		{"dual as string", "891568578:900150983cd24fb0d6963f7d28e17f72", `"891568578:900150983cd24fb0d6963f7d28e17f72"`},
+		{"empty as string", "", `""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, e := json.Marshal(tt.hash)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if string(b) != tt.json {
+				t.Errorf("Marshal(%q) = %s, want %s", tt.hash, b, tt.json)
+			}
+
+			var h hashValue
+			if e := json.Unmarshal([]byte(tt.json), &h); e != nil {
+				t.Fatal(e)
+			}
+			if h != tt.hash {
+				t.Errorf("Unmarshal(%s) = %q, want %q", tt.json, h, tt.hash)
+			}
+		})
+	}
+
+	var h hashValue
+	if e := json.Unmarshal([]byte(`true`), &h); e == nil {
+		t.Errorf("Unmarshal(true) = %q, want an error", h)
+	}
+} // }}}
+
+func TestHashAlgorithms(t *testing.T) { // {{{
+	// MySQL expressions of 'abc', and the values MySQL returns for them
+	tests := []struct {
+		hash  string
+		mysql string
+		value string
+	}{
+		{"crc32", "CAST(CRC32('abc') AS UNSIGNED)", "891568578"},
+		{"md5", "CAST(CONV(LEFT(MD5('abc'), 16), 16, 10) AS UNSIGNED)", "10376663631224000432"},
+		{"md5-full", "MD5('abc')", "900150983cd24fb0d6963f7d28e17f72"},
+		{"sha1", "CAST(CONV(LEFT(SHA1('abc'), 16), 16, 10) AS UNSIGNED)", "12220867466687316330"},
+		{"sha1-full", "SHA1('abc')", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"sha256", "CAST(CONV(LEFT(SHA2('abc', 256), 16), 16, 10) AS UNSIGNED)", "13436514500253700074"},
+		{"sha256-full", "SHA2('abc', 256)", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha512-full", "SHA2('abc', 512)", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{"dual", "CONCAT(CRC32('abc'), ':', MD5('abc'))", "891568578:900150983cd24fb0d6963f7d28e17f72"},
+	}
+
+	if len(tests) != len(hashAlgorithms()) {
+		t.Errorf("%d algorithms tested, want all of %v", len(tests), HashAlgorithmNames())
+	}
+
+	db := openSQLite(t)
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			if got := hashAlgorithms()[tt.hash]("'abc'"); got != tt.mysql {
+				t.Errorf("mysql = %s, want %s", got, tt.mysql)
+			}
+			// SQLite sides hash to the same values as MySQL sides
+			if got := queryText(t, db, "SELECT "+sqliteHashAlgorithms()[tt.hash]("'abc'")); got != tt.value {
+				t.Errorf("sqlite = %s, want %s", got, tt.value)
+			}
+		})
+	}
+} // }}}
+
+func TestRowEncodings(t *testing.T) { // {{{
+	if got, want := rowEncodings()["null-safe"]([]string{"a", "b"}), "CONCAT("+
+		"IF(a IS NULL, 'N', CONCAT('V', LENGTH(CAST(a AS CHAR CHARACTER SET utf8mb4)), ':', a)),"+
+		"IF(b IS NULL, 'N', CONCAT('V', LENGTH(CAST(b AS CHAR CHARACTER SET utf8mb4)), ':', b)))"; got != want {
+		t.Errorf("mysql null-safe = %s, want %s", got, want)
+	}
+	if got, want := rowEncodings()["concat-ws"]([]string{"a", "b"}), "CONCAT_WS('#',a,b)"; got != want {
+		t.Errorf("mysql concat-ws = %s, want %s", got, want)
+	}
+
+	many := make([]string, 150) // more than one SQLite call takes
+	for i := range many {
+		many[i] = "'x'"
+	}
+
+	// text MySQL encodes the row of values into
+	tests := []struct {
+		name     string
+		values   []string
+		concatWS string
+		nullSafe string
+	}{
+		{"separator in value", []string{"'a#b'", "NULL"}, "a#b", "V3:a#bN"},
+		{"two values", []string{"'a'", "'b'"}, "a#b", "V1:aV1:b"},
+		{"all NULL", []string{"NULL", "NULL"}, "<nil>", "NN"},
+		{"empty before NULL", []string{"''", "NULL"}, "", "V0:N"},
+		{"empty after NULL", []string{"NULL", "''"}, "", "NV0:"},
+		{"utf8 bytes and numbers", []string{"'é'", "12"}, "é#12", "V2:éV2:12"},
+		{"many columns", many, strings.TrimSuffix(strings.Repeat("x#", 150), "#"), strings.Repeat("V1:x", 150)},
+	}
+
+	db := openSQLite(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryText(t, db, "SELECT "+sqliteRowEncodings()["concat-ws"](tt.values)); got != tt.concatWS {
+				t.Errorf("sqlite concat-ws = %s, want %s", got, tt.concatWS)
+			}
+			if got := queryText(t, db, "SELECT "+sqliteRowEncodings()["null-safe"](tt.values)); got != tt.nullSafe {
+				t.Errorf("sqlite null-safe = %s, want %s", got, tt.nullSafe)
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
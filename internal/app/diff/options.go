@@ -0,0 +1,327 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TableOptions : options of one table diff, flags of the diff command with the same names
+type TableOptions struct { // {{{
+	Table            string        // same table name on source and target, or SourceTable and TargetTable
+	SourceTable      string        // -s
+	TargetTable      string        // -t
+	LowerBoundary    []string      // -l, pk field values
+	UpperBoundary    []string      // -u, pk field values
+	ChunkSize        int           // -c, defaults to 1000
+	PKColumnSequence []int         // -S, 1-based positions of the pk fields
+	KeyColumns       []string      // --key-columns
+	ChunkIndex       string        // --chunk-index
+	IgnoreFields     []string      // -I
+	AdditionalFilter string        // -F
+	Hash             string        // -H, defaults to crc32
+	RowEncoding      string        // --row-encoding, defaults to concat-ws
+	ChunkAggregate   string        // --chunk-aggregate, defaults to group-concat
+	Bisect           int           // --bisect
+	Recheck          int           // --recheck
+	RecheckDelay     time.Duration // --recheck-delay, defaults to 5s
+	DiffColumns      bool          // --diff-columns
+	DiffValues       bool          // --diff-values, implies DiffColumns
+	Parallel         int           // -p, defaults to 1
+	Resume           bool          // --resume
+	Output           string        // -o, defaults to log.<extension of Format>
+} // }}}
+
+// Options : options of a diff run. The embedded TableOptions is the table to diff, or the options
+// of every table with AllTables. With Tables, each table has its own complete TableOptions and the
+// embedded Output only names the summary file
+type Options struct { // {{{
+	TableOptions
+	Source         Connection
+	Target         Connection
+	Debug          bool
+	Trace          bool
+	Format         string            // --format of the outputs, defaults to json
+	SrcConcurrency int               // --src-concurrency, defaults to Parallel
+	TgtConcurrency int               // --tgt-concurrency, defaults to Parallel
+	AllTables      bool              // -A
+	Include        []string          // --include, table name glob patterns
+	Exclude        []string          // --exclude, table name glob patterns
+	TableMap       map[string]string // --table-map, source to target table names
+	TableParallel  int               // --table-parallel, defaults to 1
+	Tables         []TableOptions
+
+	Sleep             time.Duration // --sleep between chunks of each worker
+	MaxThreadsRunning int           // --max-threads-running of source DB
+	Replica           Connection    // --replica of source DB, for MaxReplicaLag
+	MaxReplicaLag     time.Duration // --max-replica-lag
+	MaxRowsPerSecond  int           // --max-rows-per-second read from source DB by the run
+
+	ConsistentSnapshot bool // --consistent-snapshot, chunk queries of each side run in one snapshot transaction
+	SnapshotPosition   bool // --snapshot-position of source DB binary log at its snapshot
+
+	Progress bool // --progress line with ETA, only if stderr is a terminal
+
+	Logger *logrus.Logger // log of the run, defaults to a text logger on stderr at the level of Debug and Trace
+} // }}}
+
+// setDefaults : zero values of options default like the diff command flags, Output follows the
+// --format of the run
+func (to *TableOptions) setDefaults(format string) { // {{{
+	if to.ChunkSize == 0 {
+		to.ChunkSize = 1000
+	}
+	if to.Hash == "" {
+		to.Hash = defaultHashAlgorithm
+	}
+	if to.RowEncoding == "" {
+		to.RowEncoding = defaultRowEncoding
+	}
+	if to.ChunkAggregate == "" {
+		to.ChunkAggregate = defaultChunkAggregate
+	}
+	if to.RecheckDelay == 0 {
+		to.RecheckDelay = 5 * time.Second
+	}
+	if to.Parallel == 0 {
+		to.Parallel = 1
+	}
+	if to.Output == "" {
+		to.Output = OutputFile("", format, "")
+	}
+} // }}}
+
+// orEmpty : values, or one empty value standing for an unset list arg
+func orEmpty(values []string) []string { // {{{
+	if len(values) == 0 {
+		return []string{""}
+	}
+	return values
+} // }}}
+
+// newArgs : validate table options and run level options o, returns the args of the table run
+func newArgs(to *TableOptions, o *Options) (arg envarg, err error) { // {{{
+	arg.ArgDebug = o.Debug
+	arg.ArgTrace = o.Trace
+	arg.ArgLowerBoundary = orEmpty(to.LowerBoundary)
+	arg.ArgUpperBoundary = orEmpty(to.UpperBoundary)
+	if to.ChunkSize <= 1 {
+		arg.ArgChunksize = 2
+	} else {
+		arg.ArgChunksize = to.ChunkSize
+	}
+	for _, seq := range to.PKColumnSequence {
+		arg.ArgPKColumnSequence = append(arg.ArgPKColumnSequence, strconv.Itoa(seq))
+	}
+	arg.ArgPKColumnSequence = orEmpty(arg.ArgPKColumnSequence)
+	arg.ArgKeyColumns = to.KeyColumns
+	arg.ArgChunkIndex = to.ChunkIndex
+	arg.ArgIgnoreFields = orEmpty(to.IgnoreFields)
+	arg.ArgAdditionalFilter = to.AdditionalFilter
+	if _, exists := hashAlgorithms()[to.Hash]; !exists {
+		return arg, fmt.Errorf("--hash should be one of %s", strings.Join(HashAlgorithmNames(), ", "))
+	}
+	arg.ArgHash = to.Hash
+	if _, exists := rowEncodings()[to.RowEncoding]; !exists {
+		return arg, fmt.Errorf("--row-encoding should be one of %s", strings.Join(RowEncodingNames(), ", "))
+	}
+	arg.ArgRowEncoding = to.RowEncoding
+	aggregate, exists := chunkAggregates()[to.ChunkAggregate]
+	if !exists {
+		return arg, fmt.Errorf("--chunk-aggregate should be one of %s", strings.Join(ChunkAggregateNames(), ", "))
+	}
+	if aggregate.integer && !integerHashes()[to.Hash] {
+		return arg, fmt.Errorf("--chunk-aggregate %s adds up integer row hashes, --hash %s is not one of them", to.ChunkAggregate, to.Hash)
+	}
+	arg.ArgChunkAggregate = to.ChunkAggregate
+	// chunk hashes of both sides are compared, so both engines need the same expressions
+	for _, side := range []struct {
+		name string
+		c    Connection
+	}{{"source", o.Source}, {"target", o.Target}} {
+		d, e := side.c.dialect()
+		if e != nil {
+			return arg, fmt.Errorf("%s: %w", side.name, e)
+		}
+		if e := d.supports(side.name, &arg); e != nil {
+			return arg, e
+		}
+	}
+	if to.Bisect < 0 {
+		arg.ArgBisect = 0
+	} else {
+		arg.ArgBisect = to.Bisect
+	}
+	if to.Recheck < 0 || to.RecheckDelay < 0 {
+		return arg, errors.New("--recheck and --recheck-delay should not be negative")
+	}
+	if to.Recheck > 0 && o.ConsistentSnapshot {
+		return arg, errors.New("--recheck hashes the same snapshot again with --consistent-snapshot, they are mutual exclusive")
+	}
+	arg.ArgRecheck = to.Recheck
+	arg.ArgRecheckDelay = to.RecheckDelay
+	arg.ArgDiffColumns = to.DiffColumns || to.DiffValues // values come with their columns
+	arg.ArgDiffValues = to.DiffValues
+	if to.Parallel < 1 {
+		arg.ArgParallel = 1
+	} else {
+		arg.ArgParallel = to.Parallel
+	}
+
+	// per side concurrency follows --parallel by default, one connection is kept for boundary queries
+	defaultConcurrency := arg.ArgParallel
+	if defaultConcurrency > maxOpenConns-1 {
+		defaultConcurrency = maxOpenConns - 1
+	}
+	arg.ArgSrcConcurrency = o.SrcConcurrency
+	if o.SrcConcurrency <= 0 {
+		arg.ArgSrcConcurrency = defaultConcurrency
+	}
+	arg.ArgTgtConcurrency = o.TgtConcurrency
+	if o.TgtConcurrency <= 0 {
+		arg.ArgTgtConcurrency = defaultConcurrency
+	}
+	if arg.ArgSrcConcurrency > maxOpenConns-1 || arg.ArgTgtConcurrency > maxOpenConns-1 {
+		return arg, fmt.Errorf("--src-concurrency and --tgt-concurrency should be less than %d", maxOpenConns)
+	}
+
+	arg.ArgResume = to.Resume
+
+	if to.Resume && len(to.LowerBoundary) > 0 {
+		return arg, errors.New("--resume and -l are mutual exclusive")
+	}
+
+	format, exists := outputFormats()[o.Format]
+	if !exists {
+		return arg, fmt.Errorf("--format should be one of %s", strings.Join(OutputFormatNames(), ", "))
+	}
+	if to.Resume && o.Format != defaultOutputFormat {
+		return arg, fmt.Errorf("--resume reads the checkpoint from the %s output, --format should be %s", defaultOutputFormat, defaultOutputFormat)
+	}
+	// the row level and summary outputs are named after the extension of the output
+	if filepath.Ext(to.Output) != "."+format.ext {
+		return arg, fmt.Errorf("-o %s should have the .%s extension of --format %s", to.Output, format.ext, o.Format)
+	}
+	arg.ArgFormat = o.Format
+
+	if len(to.LowerBoundary) > 0 && len(to.UpperBoundary) > 0 &&
+		len(to.LowerBoundary) != len(to.UpperBoundary) {
+		return arg, errors.New("-l and -u should have same number of elements")
+	}
+
+	if len(to.PKColumnSequence) > 0 {
+		if len(to.LowerBoundary) > 0 && len(to.LowerBoundary) != len(to.PKColumnSequence) {
+			return arg, errors.New("-l and -S should have same number of elements")
+		}
+		if len(to.UpperBoundary) > 0 && len(to.UpperBoundary) != len(to.PKColumnSequence) {
+			return arg, errors.New("-u and -S should have same number of elements")
+		}
+	}
+
+	if o.Sleep < 0 || o.MaxThreadsRunning < 0 || o.MaxReplicaLag < 0 || o.MaxRowsPerSecond < 0 {
+		return arg, errors.New("--sleep/--max-threads-running/--max-replica-lag/--max-rows-per-second should not be negative")
+	}
+	if (o.Replica.Host != "") != (o.MaxReplicaLag > 0) {
+		return arg, errors.New("--replica and --max-replica-lag should be set together")
+	}
+
+	if o.SnapshotPosition && !o.ConsistentSnapshot {
+		return arg, errors.New("--snapshot-position requires --consistent-snapshot")
+	}
+	if d, _ := o.Source.dialect(); o.SnapshotPosition && d != nil && !d.snapshotPosition {
+		return arg, fmt.Errorf("--snapshot-position captures the binary log position, not supported by source DB (%s)", d.name)
+	}
+	if d, _ := o.Source.dialect(); o.MaxThreadsRunning > 0 && d != nil && d.threadsRunning == nil {
+		return arg, fmt.Errorf("--max-threads-running is not supported by source DB (%s)", d.name)
+	}
+	if d, _ := o.Replica.dialect(); o.MaxReplicaLag > 0 && d != nil && d.replicaLag == nil {
+		return arg, fmt.Errorf("--replica and --max-replica-lag are not supported by replica DB (%s)", d.name)
+	}
+	if o.ConsistentSnapshot && (o.SrcConcurrency > 1 || o.TgtConcurrency > 1) {
+		return arg, errors.New("--consistent-snapshot runs the chunk queries of each side on one connection, --src-concurrency and --tgt-concurrency should not be above 1")
+	}
+	if o.ConsistentSnapshot { // queries of a side take turns on its snapshot connection
+		arg.ArgSrcConcurrency, arg.ArgTgtConcurrency = 1, 1
+	}
+
+	arg.ArgAllTables = o.AllTables
+	if o.TableParallel < 1 {
+		arg.ArgTableParallel = 1
+	} else {
+		arg.ArgTableParallel = o.TableParallel
+	}
+
+	if o.AllTables {
+		if to.Table != "" || to.SourceTable != "" || to.TargetTable != "" {
+			return arg, errors.New("--all-tables and --table/-s/-t are mutual exclusive")
+		}
+		if len(to.LowerBoundary) > 0 || len(to.UpperBoundary) > 0 || len(to.PKColumnSequence) > 0 ||
+			len(to.KeyColumns) > 0 || to.ChunkIndex != "" {
+			return arg, errors.New("-l/-u/-S/--key-columns/--chunk-index are table specific, not supported with --all-tables")
+		}
+
+		for _, pattern := range append(append([]string(nil), o.Include...), o.Exclude...) {
+			if _, e := path.Match(pattern, ""); e != nil {
+				return arg, fmt.Errorf("invalid table name pattern %s: %v", pattern, e)
+			}
+		}
+		arg.ArgIncludeTables = o.Include
+		arg.ArgExcludeTables = o.Exclude
+		arg.ArgTableMap = map[string]string{}
+		for tablesrc, tabletgt := range o.TableMap {
+			if tablesrc == "" || tabletgt == "" {
+				return arg, fmt.Errorf("--table-map should be pairs of source:target, got %s:%s", tablesrc, tabletgt)
+			}
+			arg.ArgTableMap[tablesrc] = tabletgt
+		}
+		return arg, nil
+	}
+
+	if len(o.Include) > 0 || len(o.Exclude) > 0 || len(o.TableMap) > 0 {
+		return arg, errors.New("--include/--exclude/--table-map require --all-tables")
+	}
+
+	if to.Table == "" && to.SourceTable == "" && to.TargetTable == "" {
+		return arg, errors.New("--table or -s/-t is required")
+	}
+
+	if !((to.Table != "" && to.SourceTable == "" && to.TargetTable == "") ||
+		(to.Table == "" && to.SourceTable != "" && to.TargetTable != "")) {
+		return arg, errors.New("--table and -s/-t are mutual exclusive")
+	}
+
+	if to.Table != "" {
+		arg.ArgSrcTable = to.Table
+		arg.ArgTgtTable = to.Table
+	} else {
+		arg.ArgSrcTable = to.SourceTable
+		arg.ArgTgtTable = to.TargetTable
+	}
+
+	return arg, nil
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -19,20 +19,18 @@ package diff
 
 // Importing fmt package for the sake of printing
 import (
-	"database/sql"
 	"strconv"
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
-	log "github.com/sirupsen/logrus"
 )
 
 type pkTableSingle struct { // {{{
 	pkTable
 } // }}}
 
-func (t *pkTableSingle) Init(pkColumns []pkColumn) *pkTableSingle { // {{{
-	t.init(pkColumns)
+func (t *pkTableSingle) Init(arg *envarg, pkColumns []pkColumn) *pkTableSingle { // {{{
+	t.init(arg, pkColumns)
 	return t
 } // }}}
 
@@ -54,17 +52,14 @@ func (t *pkTableSingle) UpperBoundaryQuery(
 	columnOperators []string,
 	chunksize int,
 ) (query string) { // {{{
-	table := envArg.ArgSrcTable
+	table := t.arg.ArgSrcTable
 
 	var lastpkfield string
 	var pkcolumnsWhere []string
 
 	lastpkfield = columnNames[0]
 	pkcolumnsWhere = append(pkcolumnsWhere, columnNames[0]+columnOperators[0]+"?")
-	var additionalfilterstmt string
-	if envArg.ArgAdditionalFilter != "" {
-		additionalfilterstmt = " AND " + envArg.ArgAdditionalFilter
-	}
+	additionalfilterstmt := t.additionalFilterStmt()
 
 	query = `
     SELECT SQL_NO_CACHE
@@ -77,7 +72,7 @@ func (t *pkTableSingle) UpperBoundaryQuery(
       LIMIT ` + strconv.Itoa(chunksize) + `) AS A
     `
 
-	log.Traceln(query)
+	t.arg.run.log.Traceln(query)
 
 	return
 } // }}}
@@ -92,10 +87,11 @@ returns 3 fields
  4. UpperBoundaryQuery
 */
 func (t *pkTableSingle) TransformUpperBoundaryResult(
-	dbSrc *sql.DB,
+	dbSrc *DB,
 	tub *tableUpperBoundary,
-) (resultset [][]any) { // {{{
-	chunksize := envArg.ArgChunksize
+) (resultset [][]any, err error) { // {{{
+	log := t.arg.run.log
+	chunksize := t.arg.ArgChunksize
 	pkColumnNames := t.GetPKColumnNames()
 
 	lastPKfieldtype := t.GetPKColumns()[len(t.GetPKColumns())-1].FieldType
@@ -106,7 +102,7 @@ func (t *pkTableSingle) TransformUpperBoundaryResult(
 	// 2. PK field lowerboundary
 	// 3. PK field upperboundary
 	// 4. UpperBoundaryQuery
-	populateResultset := func(rub [][]any) int { // {{{
+	populateResultset := func(rub [][]any) (int, error) { // {{{
 		rowcntSrc := 0
 		originalrow := rub[0]
 		var rowinresultset []any
@@ -121,41 +117,51 @@ func (t *pkTableSingle) TransformUpperBoundaryResult(
 
 		// 3. PK field upperboundary
 		v := *originalrow[len(originalrow)-1].(*any)
+		ub, e := lastPKfieldtype.transformDBResultType(v)
+		if e != nil {
+			return 0, e
+		}
 		log.Debugf(
 			"====return lowerboundary: %v, column type: %T, value: %v====\n",
 			tub.LowerBoundary[0],
 			v,
-			lastPKfieldtype.transformDBResultType(v),
+			ub,
 		)
-		rowinresultset = append(rowinresultset, lastPKfieldtype.transformDBResultType(v))
+		rowinresultset = append(rowinresultset, ub)
 
 		// 4. UpperBoundaryQuery
 		rowinresultset = append(rowinresultset, tub.UpperBoundaryQuery)
 
 		resultset = append(resultset, rowinresultset)
 
-		return rowcntSrc
+		return rowcntSrc, nil
 	} // }}}
 
-	runUpperBoundary := func(runidx int) int { // {{{
+	runUpperBoundary := func(runidx int) (int, error) { // {{{
 		tub.UpperBoundaryQuery = t.UpperBoundaryQuery(pkColumnNames, pkColumnOperators, chunksize)
 		log.Debugf("----[%d] lowerboundary: %v----\n", runidx, tub.LowerBoundary)
 		log.Debugf("----[%d] UpperBoundaryQuery: %v----\n", runidx, tub.UpperBoundaryQuery)
 
-		rub := t.UpperBoundaryResult(dbSrc, pkColumnNames, tub)
+		rub, e := t.UpperBoundaryResult(dbSrc, pkColumnNames, tub)
+		if e != nil {
+			return 0, e
+		}
 		log.Debugf("----[%d] UpperBoundaryQuery formated: %v----\n", runidx, tub.UpperBoundaryQuery)
 		log.Debugf("----[%d] chunksize: %d----\n", runidx, chunksize)
 
-		rowcntSrc := populateResultset(rub)
+		rowcntSrc, e := populateResultset(rub)
+		if e != nil {
+			return 0, e
+		}
 
 		log.Debugf("====[%d] rowcntSrc: %d, resultset: %v====\n", runidx, rowcntSrc, resultset)
 		log.Tracef("====[%d] query: %v====\n", runidx, tub.UpperBoundaryQuery)
 
-		return rowcntSrc
+		return rowcntSrc, nil
 	} // }}}
 
 	pkColumnOperators = []string{">="}
-	runUpperBoundary(1)
+	_, err = runUpperBoundary(1)
 	return
 } // }}}
 
@@ -165,7 +171,9 @@ func (t *pkTableSingle) ResetLowerboundaryUpperboundary(
 ) (
 	stopAfterRun bool,
 	lastpkfieldUpperboundary any,
+	err error,
 ) { // {{{
+	log := t.arg.run.log
 	log.Debugf("----before lowerboundary: %v----\n", lowerboundary)
 
 	stopAfterRun = false
@@ -179,14 +187,17 @@ func (t *pkTableSingle) ResetLowerboundaryUpperboundary(
 		}
 	}
 
-	if envArg.ArgUpperBoundary[len(envArg.ArgUpperBoundary)-1] == "" {
+	if t.arg.ArgUpperBoundary[len(t.arg.ArgUpperBoundary)-1] == "" {
 		return
 	}
 
 	lastPKfieldtype := t.GetPKColumns()[len(t.GetPKColumns())-1].FieldType
-	userUpperboundary := lastPKfieldtype.transformFieldType(
-		envArg.ArgUpperBoundary[len(envArg.ArgUpperBoundary)-1],
+	userUpperboundary, err := lastPKfieldtype.transformFieldType(
+		t.arg.ArgUpperBoundary[len(t.arg.ArgUpperBoundary)-1],
 	)
+	if err != nil {
+		return false, nil, err
+	}
 
 	if lastPKfieldtype.equals(lastpkfieldUpperboundary, userUpperboundary) {
 		stopAfterRun = true
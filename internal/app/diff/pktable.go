@@ -29,17 +29,17 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	log "github.com/sirupsen/logrus"
 )
 
 type ipkTable interface { // {{{
-	RunTableRoutine(*sql.DB, *sql.DB, ipkTable)
+	RunTableRoutine(*DB, *DB, ipkTable, *tableChunkInfo) (*TableSummary, error)
 	GetPKColumns() []pkColumn
 	GetPKColumnNames() []string
-	PKColumnMaxGroupCount(*sql.DB) int
+	PKColumnMaxGroupCount(*DB) (int, error)
 	UpperBoundaryQuery([]string, []string, int) string
-	ResetLowerboundaryUpperboundary([]any, []any) (bool, any)
-	TransformUpperBoundaryResult(*sql.DB, *tableUpperBoundary) (resultset [][]any)
+	ResetLowerboundaryUpperboundary([]any, []any) (bool, any, error)
+	TransformUpperBoundaryResult(*DB, *tableUpperBoundary) (resultset [][]any, err error)
+	EstimateRows(*DB) (int64, error)
 } // }}}
 
 // pkColumn return table's primary key column info
@@ -48,13 +48,14 @@ type pkColumn struct { // {{{
 	DataType    string
 	FieldType   iFieldType
 	IsLastField bool
+	KeyName     string // primary key or unique index, empty for declared --key-columns
 } // }}}
 
 // tableHashResult : stores CRC query run result
 type tableHashResult struct { // {{{
 	issrc     bool
 	rowcnt    int
-	hash      int
+	hash      hashValue
 	ts        time.Time
 	elapsedms int64
 } // }}}
@@ -66,16 +67,21 @@ type tableUpperBoundary struct { // {{{
 } // }}}
 
 type pkTable struct {
+	arg               *envarg // args of the table run
 	_allpkColumns     []pkColumn
 	_allpkColumnNames []string
 	_pkColumns        []pkColumn
 	_pkColumnNames    []string
+	writer            outputWriter  // --format writer of the chunk results
+	window            chan struct{} // chunks dispatched and not written yet, see chunkWindowPerWorker
 }
 
-func (t *pkTable) init(allpkcolumns []pkColumn) { // {{{
+func (t *pkTable) init(arg *envarg, allpkcolumns []pkColumn) { // {{{
 	var columnsequence []int
 
-	if len(envArg.ArgPKColumnSequence) == 1 && envArg.ArgPKColumnSequence[0] == "" {
+	t.arg = arg
+
+	if len(t.arg.ArgPKColumnSequence) == 1 && t.arg.ArgPKColumnSequence[0] == "" {
 		columnsequence = make([]int, len(allpkcolumns))
 		t._pkColumns = make([]pkColumn, len(allpkcolumns))
 		t._pkColumnNames = make([]string, len(allpkcolumns))
@@ -83,7 +89,7 @@ func (t *pkTable) init(allpkcolumns []pkColumn) { // {{{
 			columnsequence[i] = i
 		}
 	} else {
-		newcolumns := envArg.ArgPKColumnSequence
+		newcolumns := t.arg.ArgPKColumnSequence
 		columnsequence = make([]int, len(newcolumns))
 		t._pkColumns = make([]pkColumn, len(newcolumns))
 		t._pkColumnNames = make([]string, len(newcolumns))
@@ -123,9 +129,11 @@ func (t *pkTable) GetPKColumnNames() []string { // {{{
 } // }}}
 
 // TableLog : table info JSON marshal and output to file, don't encode '>' char in hex
-func (t *pkTable) TableLog(outputfile *os.File, ti any) { // {{{
+func (t *pkTable) TableLog(outputfile *os.File, ti any) error { // {{{
 	// b, e := json.Marshal(ti) // encode '>' char in hex,
-	// errorCheck(e)
+	// if e != nil {
+	// 	return e
+	// }
 	// fmt.Fprintln(outputfile,string(b))
 
 	// create a buffer to hold JSON data
@@ -134,19 +142,23 @@ func (t *pkTable) TableLog(outputfile *os.File, ti any) { // {{{
 	bufEncoder := json.NewEncoder(buf)
 
 	bufEncoder.SetEscapeHTML(false) // don't encode '>' char in hex
-	e := bufEncoder.Encode(ti)
-	errorCheck(e)
-	fmt.Fprint(outputfile, buf) // calls `buf.String()` method
+	if e := bufEncoder.Encode(ti); e != nil {
+		return e
+	}
+	_, e := fmt.Fprint(outputfile, buf) // calls `buf.String()` method
+	return e
 } // }}}
 
 func (t *pkTable) TableQueryColumnNames(
-	db *sql.DB,
+	db *DB,
 	table string,
-) (columnNames []string, pkColumnsWhere []string) { // {{{
+) (columnNames []string, pkColumnsWhere []string, err error) { // {{{
 	//  ┌                                                                              ┐
 	//  │ figure out columnNames                                                       │
 	//  └                                                                              ┘
-	columnNames = GetTableColumns(db, table)
+	if columnNames, err = GetTableColumns(db, table); err != nil {
+		return nil, nil, err
+	}
 
 	Exclude := func(xs *[]string, excluded map[string]bool) {
 		w := 0
@@ -167,7 +179,7 @@ func (t *pkTable) TableQueryColumnNames(
 		return r
 	}
 
-	Exclude(&columnNames, mapFromSlice(envArg.ArgIgnoreFields))
+	Exclude(&columnNames, mapFromSlice(t.arg.ArgIgnoreFields))
 
 	//  ┌                                                                              ┐
 	//  │   figure out pkColumnsWhere                                                  │
@@ -185,24 +197,27 @@ func (t *pkTable) TableQueryColumnNames(
 	return
 } // }}}
 
+// TableHashStmt : prepare the chunk hash query of the side on conn, returns the statement and its
+// boundary inputs
 func (t *pkTable) TableHashStmt(
-	db *sql.DB,
+	conn *sql.Conn,
 	issrc bool,
 	ptrHashQuerySrc *string,
 	ptrHashQueryTgt *string,
 	LowerBoundary []any,
 	LastPKFieldUpperBoundary any,
-) (stmt *sql.Stmt, inputs []any) { // {{{
-	var e error
+) (stmt *sql.Stmt, inputs []any, err error) { // {{{
+	log := t.arg.run.log
 
 	if issrc {
 		log.Debugf("----*ptrHashQuerySrc----\n%v\n", *ptrHashQuerySrc)
-		stmt, e = db.Prepare(*ptrHashQuerySrc)
-		errorCheck(e)
+		stmt, err = conn.PrepareContext(t.arg.run.ctx, *ptrHashQuerySrc)
 	} else {
 		log.Debugf("----*ptrHashQueryTgt----\n%v\n", *ptrHashQueryTgt)
-		stmt, e = db.Prepare(*ptrHashQueryTgt)
-		errorCheck(e)
+		stmt, err = conn.PrepareContext(t.arg.run.ctx, *ptrHashQueryTgt)
+	}
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// lowerboundary for pkcolumns and lastpkfieldUpperboundary
@@ -248,10 +263,10 @@ func (t *pkTable) TableHashStmt(
 } // }}}
 
 func (t *pkTable) PKColumnMaxGroupCount(
-	dbSrc *sql.DB,
-) int { // {{{
+	dbSrc *DB,
+) (count int, err error) { // {{{
 	pkColumnNames := t.GetPKColumnNames()
-	table := envArg.ArgSrcTable
+	table := t.arg.ArgSrcTable
 
 	query := fmt.Sprintf(`
     SELECT COUNT(1) AS count
@@ -265,18 +280,14 @@ func (t *pkTable) PKColumnMaxGroupCount(
 		strings.Join(pkColumnNames, ", "),
 	)
 
-	stmt, e := dbSrc.Prepare(query)
-	errorCheck(e)
-	defer func() {
-		e := stmt.Close()
-		errorCheck(e)
-	}()
-
-	var count int
-	e = stmt.QueryRow().Scan(&count)
-	errorCheck(e)
+	stmt, err := dbSrc.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer closeErr(stmt, &err)
 
-	return count
+	err = stmt.QueryRow().Scan(&count)
+	return
 } // }}}
 
 /*
@@ -295,19 +306,21 @@ UpperBoundaryResult :	Return resultset of DB from queries, for example:
 	LIMIT 211
 */
 func (t *pkTable) UpperBoundaryResult(
-	dbSrc *sql.DB,
+	dbSrc *DB,
 	columnNames []string,
 	tub *tableUpperBoundary,
-) (resultset [][]any) { // {{{
-	stmt, e := dbSrc.Prepare(tub.UpperBoundaryQuery)
-	errorCheck(e)
-	defer func() {
-		e := stmt.Close()
-		errorCheck(e)
-	}()
+) (resultset [][]any, err error) { // {{{
+	stmt, err := dbSrc.Prepare(tub.UpperBoundaryQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(stmt, &err)
 
-	result, e := stmt.Query(tub.LowerBoundary...)
-	errorCheck(e)
+	result, err := stmt.Query(tub.LowerBoundary...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(result, &err)
 
 	// plugin input value to the normalized query for logging purpose
 	//  ┌──────────────────────────────────────────────────────────────────────────────┐
@@ -345,22 +358,23 @@ func (t *pkTable) UpperBoundaryResult(
 		// lastpkfield
 		vals[len(vals)-1] = new(any)
 
-		e = result.Scan(vals...)
-		errorCheck(e)
+		if err = result.Scan(vals...); err != nil {
+			return nil, err
+		}
 
 		resultset = append(resultset, vals)
 	}
 
-	return
+	return resultset, result.Err()
 } // }}}
 
 // InitialPKFieldLowerboundaryFromTable : find 1st record in the table based on PK columns
 func (t *pkTable) InitialPKFieldLowerboundaryFromTable(
-	dbSrc *sql.DB,
-) (resultset [][]any) { // {{{
+	dbSrc *DB,
+) (resultset [][]any, err error) { // {{{
 
 	pkColumnNames := t.GetPKColumnNames()
-	table := envArg.ArgSrcTable
+	table := t.arg.ArgSrcTable
 
 	query := `
     SELECT SQL_NO_CACHE ` + strings.Join(pkColumnNames, ",") + `
@@ -368,17 +382,19 @@ func (t *pkTable) InitialPKFieldLowerboundaryFromTable(
     ORDER BY ` + strings.Join(pkColumnNames, ",") + `
     LIMIT 1`
 
-	log.Traceln(query)
+	t.arg.run.log.Traceln(query)
 
-	stmt, e := dbSrc.Prepare(query)
-	errorCheck(e)
-	defer func() {
-		e := stmt.Close()
-		errorCheck(e)
-	}()
+	stmt, err := dbSrc.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(stmt, &err)
 
-	result, e := stmt.Query()
-	errorCheck(e)
+	result, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer closeErr(result, &err)
 
 	for result.Next() {
 		vals := make([]any, len(pkColumnNames))
@@ -387,41 +403,48 @@ func (t *pkTable) InitialPKFieldLowerboundaryFromTable(
 			vals[i] = new(any)
 		}
 
-		e = result.Scan(vals...)
-		errorCheck(e)
+		if err = result.Scan(vals...); err != nil {
+			return nil, err
+		}
 
 		resultset = append(resultset, vals)
 	}
 
-	return
+	return resultset, result.Err()
 } // }}}
 
 // FindInitialPKFieldLowerboundary : find lowerboundary []any for the run
 func (t *pkTable) FindInitialPKFieldLowerboundary(
-	dbSrc *sql.DB,
-) (lowerboundary []any) { // {{{
+	dbSrc *DB,
+) (lowerboundary []any, err error) { // {{{
+	log := t.arg.run.log
 
 	pkColumnNames := t.GetPKColumnNames()
 	lowerboundary = make([]any, len(pkColumnNames))
 
-	if envArg.ArgLowerBoundary[0] != "" {
+	if t.arg.ArgLowerBoundary[0] != "" {
 		for i := 0; i < len(pkColumnNames); i++ {
-			if envArg.ArgLowerBoundary[i] != "" {
+			if t.arg.ArgLowerBoundary[i] != "" {
 				ft := t.GetPKColumns()[i].FieldType
-				lowerboundary[i] = ft.transformFieldType(envArg.ArgLowerBoundary[i])
+				if lowerboundary[i], err = ft.transformFieldType(t.arg.ArgLowerBoundary[i]); err != nil {
+					return nil, err
+				}
 			}
 		}
 
 		log.Debugf(
-			"envArg.ArgLowerBoundary: %v, pkcolumns: %v, lowerboundary: %v\n",
-			envArg.ArgLowerBoundary,
+			"t.arg.ArgLowerBoundary: %v, pkcolumns: %v, lowerboundary: %v\n",
+			t.arg.ArgLowerBoundary,
 			pkColumnNames,
 			lowerboundary,
 		)
 		return
 	}
 
-	rub := t.InitialPKFieldLowerboundaryFromTable(dbSrc)
+	rub, err := t.InitialPKFieldLowerboundaryFromTable(dbSrc)
+	if err != nil {
+		return nil, err
+	}
 	if len(rub) == 0 {
 		log.Debugf("table is empty")
 		return
@@ -431,32 +454,44 @@ func (t *pkTable) FindInitialPKFieldLowerboundary(
 	for i := 0; i < len(originalrow); i++ {
 		v := *originalrow[i].(*any)
 		ft := t.GetPKColumns()[i].FieldType
-		lowerboundary[i] = ft.transformDBResultType(v)
+		if lowerboundary[i], err = ft.transformDBResultType(v); err != nil {
+			return nil, err
+		}
 	}
 
 	log.Debugf(
-		"envArg.ArgLowerBoundary: %v, pkcolumns: %v, lowerboundary: %v\n",
-		envArg.ArgLowerBoundary,
+		"t.arg.ArgLowerBoundary: %v, pkcolumns: %v, lowerboundary: %v\n",
+		t.arg.ArgLowerBoundary,
 		pkColumnNames,
 		lowerboundary,
 	)
 	return
 } // }}}
 
+// RunTableChunk : reset boundaries from the upper boundary resultset and queue the chunks for
+// the chunk workers
 func (t *pkTable) RunTableChunk(
-	dbSrc *sql.DB,
-	dbTgt *sql.DB,
+	dbSrc *DB,
+	dbTgt *DB,
 	pkTab ipkTable,
 	ptrChunkidx *int,
 	lowerboundary []any,
 	tci *tableChunkInfo,
 	resultset [][]any,
-) (stoprun bool) { // {{{
+	jobs chan<- *tableChunkInfo,
+) (stoprun bool, err error) { // {{{
+	log := t.arg.run.log
 	log.Debugf("====resultset: %v====\n", resultset)
 
 	lastPKfieldtype := pkTab.GetPKColumns()[len(pkTab.GetPKColumns())-1].FieldType
-	hashQuerySrc := t.TableHashQueryChunkLevel(dbSrc, envArg.ArgSrcTable)
-	hashQueryTgt := t.TableHashQueryChunkLevel(dbTgt, envArg.ArgTgtTable)
+	hashQuerySrc, err := t.TableHashQueryChunkLevel(dbSrc, t.arg.ArgSrcTable)
+	if err != nil {
+		return false, err
+	}
+	hashQueryTgt, err := t.TableHashQueryChunkLevel(dbTgt, t.arg.ArgTgtTable)
+	if err != nil {
+		return false, err
+	}
 	rowcntSrc := 0
 
 	// singlePKTable: resultset has only 1 row
@@ -472,10 +507,13 @@ func (t *pkTable) RunTableChunk(
 		var stopAfterRun bool
 		var lastpkfieldUpperboundary any
 
-		stopAfterRun, lastpkfieldUpperboundary = pkTab.ResetLowerboundaryUpperboundary(
+		stopAfterRun, lastpkfieldUpperboundary, err = pkTab.ResetLowerboundaryUpperboundary(
 			row[:len(row)-1],
 			lowerboundary,
 		)
+		if err != nil {
+			return false, err
+		}
 
 		// if this is the table last record, stop run
 		// r == (len(resultset)-1):
@@ -494,45 +532,27 @@ func (t *pkTable) RunTableChunk(
 		// more smaller chunks if more than 1 row
 		*ptrChunkidx++
 
-		tci.ChunkIdx = *ptrChunkidx
-		tci.LastPKFieldUpperBoundary = lastpkfieldUpperboundary
-		tci.LowerBoundary = lowerboundary
-		tci.UpperBoundaryQuery = row[len(row)-1].(string)
-		tci.HashQuerySrc = hashQuerySrc // normalized
-		tci.HashQueryTgt = hashQueryTgt // normalized
-
-		// tci.HashQuerySrc and tci.HashQueryTgt are normalized, will be changed/filled for logging purpose
-		t.RunTableRoutineChunkLevel(dbSrc, dbTgt, tci)
-
-		lb, _ := json.Marshal(tci.LowerBoundary)
-		ub, _ := json.Marshal(
-			append(
-				append(
-					[]any{},
-					tci.LowerBoundary[:len(tci.LowerBoundary)-1]...,
-				),
-				tci.LastPKFieldUpperBoundary),
-		)
-
-		logmsg := fmt.Sprintf(
-			"[%-5v] [%5d] -l %v -u %v [RowcntSrc: %d, RowcntTgt: %d]",
-			tci.Match,
-			tci.ChunkIdx,
-			strings.Trim(string(lb), "[]"),
-			strings.Trim(string(ub), "[]"),
-			tci.RowcntSrc,
-			tci.RowcntTgt,
-		)
-		log.SetReportCaller(false) // hide line number
-		log.Infoln(logmsg)
-		log.SetReportCaller(true) // show line number
+		// every chunk gets its own copy, lowerboundary keeps moving while workers run
+		job := *tci
+		job.ChunkIdx = *ptrChunkidx
+		job.LastPKFieldUpperBoundary = lastpkfieldUpperboundary
+		job.LowerBoundary = append([]any(nil), lowerboundary...)
+		job.UpperBoundaryQuery = row[len(row)-1].(string)
+		job.HashQuerySrc = hashQuerySrc // normalized
+		job.HashQueryTgt = hashQueryTgt // normalized
+
+		// job.HashQuerySrc and job.HashQueryTgt are normalized, will be changed/filled for logging purpose
+		if !t.dispatch(jobs, &job) {
+			stoprun = true
+			return
+		}
 
 		if stopAfterRun {
 			stoprun = true
 			break
 		}
 
-		lowerboundary[len(lowerboundary)-1] = tci.LastPKFieldUpperBoundary
+		lowerboundary[len(lowerboundary)-1] = lastpkfieldUpperboundary
 
 		log.Debugf(
 			"----after loop rowcntSrc: %d, lowerboundary: %v----\n\n%s",
@@ -545,45 +565,112 @@ func (t *pkTable) RunTableChunk(
 	return
 } // }}}
 
-// RunTableRoutine : loop through ranges between lowerboundary and upperboundary
+// RunTableRoutine : loop through ranges between lowerboundary and upperboundary, chunks are diffed
+// by --parallel workers and written in chunk index order. With a checkpoint the run continues
+// after the checkpoint chunk. Chunking stops once the run is cancelled
 func (t *pkTable) RunTableRoutine(
-	dbSrc *sql.DB,
-	dbTgt *sql.DB,
+	dbSrc *DB,
+	dbTgt *DB,
 	pkTab ipkTable,
-) { // {{{
-	stoprun := false
-	lowerboundary := t.FindInitialPKFieldLowerboundary(dbSrc)
-
-	for chunkidx := 0; !stoprun; {
-		var tci tableChunkInfo
-		tci.TableSrc = envArg.ArgSrcTable
-		tci.TableTgt = envArg.ArgTgtTable
-		tci.PKColumnNames = t.GetPKColumnNames()
-		tci.PKColumnSequence = envArg.ArgPKColumnSequence
-		tci.IgnoreFields = envArg.ArgIgnoreFields
-		tci.AdditionalFilter = envArg.ArgAdditionalFilter
-
-		var tub tableUpperBoundary
-		// make a copy of lowerboundary
-		tub.LowerBoundary = append([]any(nil), lowerboundary...)
-		resultset := pkTab.TransformUpperBoundaryResult(dbSrc, &tub)
-		//  ┌                                                                              ┐
-		//  │ single PK tables resultset has rows with following fields                    │
-		//  └                                                                              ┘
-		// 1. COUNT(1)
-		// 2. PK field lowerboundary
-		// 3. PK field upperboundary
-		// 4. UpperBoundaryQuery
-		//  ┌                                                                              ┐
-		//  │ composite PK tables resultset has rows with following fields                 │
-		//  └                                                                              ┘
-		// 1. COUNT(1)
-		// 2. PK fields (not include last field)
-		// 3. last PK field lowerboundary
-		// 4. last PK field upperboundary
-		// 5. UpperBoundaryQuery
-		stoprun = t.RunTableChunk(dbSrc, dbTgt, pkTab, &chunkidx, lowerboundary, &tci, resultset)
+	checkpoint *tableChunkInfo,
+) (ts *TableSummary, err error) { // {{{
+	start := time.Now()
+
+	var lowerboundary []any
+	firstchunkidx := 0
+	if checkpoint != nil {
+		lowerboundary, err = t.ResumeLowerboundary(checkpoint)
+		firstchunkidx = checkpoint.ChunkIdx
+	} else {
+		lowerboundary, err = t.FindInitialPKFieldLowerboundary(dbSrc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if t.writer, err = outputFormats()[t.arg.ArgFormat].newWriter(t); err != nil {
+		return nil, err
+	}
+
+	t.newChunkWindow()
+	jobs := make(chan *tableChunkInfo, t.arg.ArgParallel)
+	results := t.RunChunkWorkers(func(tci *tableChunkInfo) (*TableChunkRowsInfo, error) {
+		return t.RunTableRoutineChunkLevel(dbSrc, dbTgt, tci)
+	}, jobs)
+
+	go func() {
+		defer close(jobs)
+
+		stoprun := false
+		for chunkidx := firstchunkidx; !stoprun && t.arg.run.ctx.Err() == nil; {
+			var tci tableChunkInfo
+			tci.TableSrc = t.arg.ArgSrcTable
+			tci.TableTgt = t.arg.ArgTgtTable
+			tci.PKColumnNames = t.GetPKColumnNames()
+			tci.PKColumnSequence = t.arg.ArgPKColumnSequence
+			tci.KeyColumns = t.arg.ArgKeyColumns
+			tci.IgnoreFields = t.arg.ArgIgnoreFields
+			tci.AdditionalFilter = t.arg.ArgAdditionalFilter
+			tci.HashAlgorithm = t.arg.ArgHash
+			if t.arg.ArgRowEncoding != defaultRowEncoding { // chunk logs of concat-ws stay as they were
+				tci.RowEncoding = t.arg.ArgRowEncoding
+			}
+			if t.arg.ArgChunkAggregate != defaultChunkAggregate {
+				tci.ChunkAggregate = t.arg.ArgChunkAggregate
+			}
+
+			var tub tableUpperBoundary
+			// make a copy of lowerboundary
+			tub.LowerBoundary = append([]any(nil), lowerboundary...)
+			resultset, e := pkTab.TransformUpperBoundaryResult(dbSrc, &tub)
+			if e != nil {
+				t.arg.run.fail(e)
+				return
+			}
+			//  ┌                                                                              ┐
+			//  │ single PK tables resultset has rows with following fields                    │
+			//  └                                                                              ┘
+			// 1. COUNT(1)
+			// 2. PK field lowerboundary
+			// 3. PK field upperboundary
+			// 4. UpperBoundaryQuery
+			//  ┌                                                                              ┐
+			//  │ composite PK tables resultset has rows with following fields                 │
+			//  └                                                                              ┘
+			// 1. COUNT(1)
+			// 2. PK fields (not include last field)
+			// 3. last PK field lowerboundary
+			// 4. last PK field upperboundary
+			// 5. UpperBoundaryQuery
+			if stoprun, e = t.RunTableChunk(dbSrc, dbTgt, pkTab, &chunkidx, lowerboundary, &tci, resultset, jobs); e != nil {
+				t.arg.run.fail(e)
+				return
+			}
+		}
+	}()
+
+	// workers and chunking stop with the run, results are drained before failing the table
+	if ts, err = t.WriteChunkResults(results, firstchunkidx+1); err != nil {
+		t.arg.run.fail(err)
+		for range results {
+		}
+		return nil, err
+	}
+	ts.ElapsedMs = time.Since(start).Milliseconds()
+	if err = t.writer.close(ts); err != nil {
+		return nil, err
+	}
+
+	return
+} // }}}
+
+// additionalFilterStmt : AND of the -F filter, or empty. The filter is between filterMarks, its ?
+// are SQL of the user, e.g. jsonb operators, not placeholders numbered by numberedPlaceholders
+func (t *pkTable) additionalFilterStmt() string { // {{{
+	if t.arg.ArgAdditionalFilter == "" {
+		return ""
 	}
+	return " AND " + filterMark + t.arg.ArgAdditionalFilter + filterMark
 } // }}}
 
 // vim: fdm=marker fdc=2
@@ -0,0 +1,278 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// bisectNode : json marshalable sub-chunk hashed while bisecting a mismatched chunk
+type bisectNode struct { // {{{
+	Depth                    int   `json:"depth"`
+	LowerBoundary            []any `json:"lowerboundary"`
+	LastPKFieldUpperBoundary any   `json:"lastpkfieldupperboundary"`
+	RowcntSrc                int   `json:"rowcntsrc"`
+	RowcntTgt                int   `json:"rowcnttgt"`
+	Match                    bool  `json:"match"`
+	RowLevel                 bool  `json:"rowlevel"` // diffed row by row
+} // }}}
+
+// bisectWhere : where clause of the chunk with lastpkcolumnwhere on the last pk field
+func (t *pkTable) bisectWhere(lastpkcolumnwhere string) string { // {{{
+	pkColumnNames := t.GetPKColumnNames()
+
+	var pkColumnsWhere []string
+	for i := 0; i < len(pkColumnNames)-1; i++ {
+		pkColumnsWhere = append(pkColumnsWhere, pkColumnNames[i]+" = ?")
+	}
+	pkColumnsWhere = append(pkColumnsWhere, lastpkcolumnwhere)
+
+	additionalfilterstmt := t.additionalFilterStmt()
+
+	return strings.Join(pkColumnsWhere, " AND ") + additionalfilterstmt
+} // }}}
+
+/*
+BisectMidpoint : last pk field value of the row at offset in the chunk
+
+	SELECT pkfieldn
+	FROM table
+	WHERE pkfield1 = ? AND pkfield2 = ? AND ... AND pkfieldn BETWEEN ? AND ?
+	ORDER BY pkfieldn
+	LIMIT 1 OFFSET offset
+*/
+func (t *pkTable) BisectMidpoint(
+	db *DB,
+	issrc bool,
+	table string,
+	tci *tableChunkInfo,
+	offset int,
+) (midpoint any, err error) { // {{{
+	lastPKColumn := t.GetPKColumns()[len(t.GetPKColumns())-1]
+
+	query := `
+    SELECT SQL_NO_CACHE ` + lastPKColumn.ColumnName + `
+    FROM ` + table + `
+    WHERE ` + t.bisectWhere(lastPKColumn.ColumnName+" BETWEEN ? AND ?") + `
+    ORDER BY ` + lastPKColumn.ColumnName + `
+    LIMIT 1 OFFSET ?`
+
+	t.arg.run.log.Traceln(query)
+
+	inputs := append(append([]any(nil), tci.LowerBoundary...), tci.LastPKFieldUpperBoundary, offset)
+
+	conn, release, err := t.arg.run.acquire(db, issrc)
+	if err != nil {
+		return nil, err
+	}
+	defer release(&err)
+
+	var v any
+	err = conn.QueryRowContext(t.arg.run.ctx, query, inputs...).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return lastPKColumn.FieldType.transformDBResultType(v)
+} // }}}
+
+/*
+BisectNextValue : smallest last pk field value greater than midpoint in the chunk, nil if none
+
+	SELECT MIN(pkfieldn)
+	FROM table
+	WHERE pkfield1 = ? AND pkfield2 = ? AND ... AND pkfieldn > ? AND pkfieldn <= ?
+*/
+func (t *pkTable) BisectNextValue(
+	db *DB,
+	issrc bool,
+	table string,
+	tci *tableChunkInfo,
+	midpoint any,
+) (next any, err error) { // {{{
+	lastPKColumn := t.GetPKColumns()[len(t.GetPKColumns())-1]
+
+	query := `
+    SELECT SQL_NO_CACHE MIN(` + lastPKColumn.ColumnName + `)
+    FROM ` + table + `
+    WHERE ` + t.bisectWhere(lastPKColumn.ColumnName+" > ? AND "+lastPKColumn.ColumnName+" <= ?")
+
+	t.arg.run.log.Traceln(query)
+
+	inputs := append([]any(nil), tci.LowerBoundary[:len(tci.LowerBoundary)-1]...)
+	inputs = append(inputs, midpoint, tci.LastPKFieldUpperBoundary)
+
+	conn, release, err := t.arg.run.acquire(db, issrc)
+	if err != nil {
+		return nil, err
+	}
+	defer release(&err)
+
+	var v any
+	err = conn.QueryRowContext(t.arg.run.ctx, query, inputs...).Scan(&v)
+	if err == sql.ErrNoRows || (err == nil && v == nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return lastPKColumn.FieldType.transformDBResultType(v)
+} // }}}
+
+// BisectChunk : split the chunk at the middle row of the bigger side. The lower half ends at the
+// midpoint, the upper half starts at the next value found on either side, so both halves keep the
+// BETWEEN boundaries of a regular chunk
+func (t *pkTable) BisectChunk(
+	dbSrc *DB,
+	dbTgt *DB,
+	tci *tableChunkInfo,
+) (lower *tableChunkInfo, upper *tableChunkInfo, split bool, err error) { // {{{
+	ft := t.GetPKColumns()[len(t.GetPKColumns())-1].FieldType
+
+	var midpoint any
+	if tci.RowcntSrc >= tci.RowcntTgt {
+		midpoint, err = t.BisectMidpoint(dbSrc, true, t.arg.ArgSrcTable, tci, (tci.RowcntSrc-1)/2)
+	} else {
+		midpoint, err = t.BisectMidpoint(dbTgt, false, t.arg.ArgTgtTable, tci, (tci.RowcntTgt-1)/2)
+	}
+	if err != nil || midpoint == nil || ft.equals(midpoint, tci.LastPKFieldUpperBoundary) {
+		return
+	}
+
+	next, err := t.BisectNextValue(dbSrc, true, t.arg.ArgSrcTable, tci, midpoint)
+	if err != nil {
+		return
+	}
+	nextTgt, err := t.BisectNextValue(dbTgt, false, t.arg.ArgTgtTable, tci, midpoint)
+	if err != nil {
+		return
+	}
+	if next == nil || (nextTgt != nil && ft.greaterThan(next, nextTgt)) {
+		next = nextTgt
+	}
+	if next == nil { // rows sharing the last pk field value, cannot split
+		return
+	}
+
+	lower = &tableChunkInfo{}
+	*lower = *tci
+	lower.LastPKFieldUpperBoundary = midpoint
+
+	upper = &tableChunkInfo{}
+	*upper = *tci
+	upper.LowerBoundary = append([]any(nil), tci.LowerBoundary...)
+	upper.LowerBoundary[len(upper.LowerBoundary)-1] = next
+
+	split = true
+
+	return
+} // }}}
+
+// RunTableRoutineBisect : split a mismatched chunk and hash the halves again until mismatched
+// sub-chunks have --bisect rows or less, only those are diffed row by row
+func (t *pkTable) RunTableRoutineBisect(
+	dbSrc *DB,
+	dbTgt *DB,
+	tci *tableChunkInfo,
+) (tcri *TableChunkRowsInfo, err error) { // {{{
+	hashQuerySrc, err := t.TableHashQueryChunkLevel(dbSrc, t.arg.ArgSrcTable)
+	if err != nil {
+		return nil, err
+	}
+	hashQueryTgt, err := t.TableHashQueryChunkLevel(dbTgt, t.arg.ArgTgtTable)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcri, err = t.newTableChunkRowsInfo(dbSrc, dbTgt, tci); err != nil {
+		return nil, err
+	}
+
+	var bisect func(sub *tableChunkInfo, depth int) error
+	bisect = func(sub *tableChunkInfo, depth int) error {
+		node := len(tcri.Bisect)
+		tcri.Bisect = append(tcri.Bisect, bisectNode{
+			Depth:                    depth,
+			LowerBoundary:            sub.LowerBoundary,
+			LastPKFieldUpperBoundary: sub.LastPKFieldUpperBoundary,
+			RowcntSrc:                sub.RowcntSrc,
+			RowcntTgt:                sub.RowcntTgt,
+			Match:                    sub.Match,
+		})
+
+		t.arg.run.log.Debugf(
+			"bisect chunk %d depth %d: -l %v -u %v [RowcntSrc: %d, RowcntTgt: %d] match: %v\n",
+			tci.ChunkIdx,
+			depth,
+			sub.LowerBoundary,
+			sub.LastPKFieldUpperBoundary,
+			sub.RowcntSrc,
+			sub.RowcntTgt,
+			sub.Match,
+		)
+
+		if sub.Match {
+			return nil
+		}
+
+		var lower, upper *tableChunkInfo
+		split := false
+		if sub.RowcntSrc > t.arg.ArgBisect || sub.RowcntTgt > t.arg.ArgBisect {
+			if lower, upper, split, err = t.BisectChunk(dbSrc, dbTgt, sub); err != nil {
+				return err
+			}
+		}
+
+		if !split {
+			tcri.Bisect[node].RowLevel = true
+			rows, err := t.RunTableRoutineRowLevel(dbSrc, dbTgt, sub)
+			if err != nil {
+				return err
+			}
+			tcri.Diff.Insert = append(tcri.Diff.Insert, rows.Diff.Insert...)
+			tcri.Diff.Update = append(tcri.Diff.Update, rows.Diff.Update...)
+			tcri.Diff.Delete = append(tcri.Diff.Delete, rows.Diff.Delete...)
+			return nil
+		}
+
+		for _, half := range []*tableChunkInfo{lower, upper} {
+			half.HashQuerySrc = hashQuerySrc
+			half.HashQueryTgt = hashQueryTgt
+			if err := t.TableHashChunkLevel(dbSrc, dbTgt, half); err != nil {
+				return err
+			}
+			if err := bisect(half, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err = bisect(tci, 0); err != nil {
+		return nil, err
+	}
+
+	return
+} // }}}
+
+// vim: fdm=marker fdc=2
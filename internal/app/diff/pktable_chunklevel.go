@@ -19,13 +19,10 @@ package diff
 
 // Importing fmt package for the sake of printing
 import (
-	"database/sql"
 	"strings"
-	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	log "github.com/sirupsen/logrus"
 )
 
 // tableChunkInfo : json marshalable struct for table chunks
@@ -40,150 +37,214 @@ type tableChunkInfo struct { // {{{
 	TableTgt                 string    `json:"tabletgt"`
 	PKColumnNames            []string  `json:"pkcolumnnames"`
 	PKColumnSequence         []string  `json:"pkcolumnsequence"`
+	KeyColumns               []string  `json:"keycolumns,omitempty"` // declared --key-columns
 	RowcntSrc                int       `json:"rowcntsrc"`
 	RowcntTgt                int       `json:"rowcnttgt"`
-	HashSrc                  int       `json:"hashsrc"`
-	HashTgt                  int       `json:"hashtgt"`
+	HashAlgorithm            string    `json:"hash"`
+	RowEncoding              string    `json:"rowencoding,omitempty"`    // --row-encoding, empty for concat-ws
+	ChunkAggregate           string    `json:"chunkaggregate,omitempty"` // --chunk-aggregate, empty for group-concat
+	HashSrc                  hashValue `json:"hashsrc"`
+	HashTgt                  hashValue `json:"hashtgt"`
 	IgnoreFields             []string  `json:"ignorefields"`
 	AdditionalFilter         string    `json:"additionalfilter"`
 	LastPKFieldUpperBoundary any       `json:"lastpkfieldupperboundary"`
+	ThrottledMs              int64     `json:"throttledms,omitempty"` // waited before the chunk, --sleep and load throttling
+	Throttle                 string    `json:"throttle,omitempty"`    // load threshold crossed before the chunk
+	SnapshotSrc              *Snapshot `json:"snapshotsrc,omitempty"` // --consistent-snapshot the chunk is hashed in
+	SnapshotTgt              *Snapshot `json:"snapshottgt,omitempty"`
+	Recheck                  *recheck  `json:"recheck,omitempty"` // --recheck of a mismatched chunk
 	tableUpperBoundary
 	HashQuerySrc string `json:"hashquerysrc"`
 	HashQueryTgt string `json:"hashquerytgt"`
 } // }}}
 
+// recheck : json marshalable rechecks of a mismatched chunk
+type recheck struct { // {{{
+	Attempts  int  `json:"attempts"`  // hashes after the first one
+	Converged bool `json:"converged"` // chunk matched at the last attempt
+} // }}}
+
 /*
 TableHashQueryChunkLevel : construct hash query statement like
 
-	SELECT COUNT(1) AS rowcnt, CRC32(GROUP_CONCAT(CONCAT_WS('#', field1, field2, ..., fieldn)))
+	SELECT COUNT(1) AS rowcnt, HASH(GROUP_CONCAT(HASH(ROW(field1, field2, ..., fieldn))))
 	FROM table
 	WHERE pkfield1 = ? AND pkfield2 = ? AND ... AND pkfieldn BETWEEN ? AND ?
+
+HASH is the --hash algorithm, ROW the --row-encoding of the fields. HASH(GROUP_CONCAT()) is the
+default --chunk-aggregate of the row hashes. The expressions are in the dialect of db
 */
 func (t *pkTable) TableHashQueryChunkLevel(
-	db *sql.DB,
+	db *DB,
 	table string,
-) (query string) { // {{{
+) (query string, err error) { // {{{
 
-	columnNames, pkColumnsWhere := t.TableQueryColumnNames(db, table)
-	var additionalfilterstmt string
-	if envArg.ArgAdditionalFilter != "" {
-		additionalfilterstmt = " AND " + envArg.ArgAdditionalFilter
+	columnNames, pkColumnsWhere, err := t.TableQueryColumnNames(db, table)
+	if err != nil {
+		return "", err
 	}
+	additionalfilterstmt := t.additionalFilterStmt()
 
+	hash := func(expr string) string {
+		return t.hashExpr(db, expr)
+	}
+
+	// '0' of empty chunks, text and integer chunk hashes alike
 	query = `
     SELECT SQL_NO_CACHE
       COUNT(1) AS rowcnt,
       COALESCE(
-        CAST(CRC32(
-          GROUP_CONCAT(
-            CAST(CRC32(
-              CONCAT_WS('#',` + strings.Join(columnNames, ",") + `)
-              ) AS UNSIGNED)
-            )
-          ) AS UNSIGNED),
-        0) AS crc32
+        ` + db.dialect.chunkAggregates[t.arg.ArgChunkAggregate](
+		hash,
+		hash(`
+              `+t.rowExpr(db, columnNames)+`
+              `),
+		t.GetAllPKColumnNames(),
+	) + `,
+        '0') AS hash
     FROM ` + table + `
     WHERE ` + strings.Join(pkColumnsWhere, " AND ") + additionalfilterstmt
 
-	log.Traceln(query)
+	t.arg.run.log.Traceln(query)
 
 	return
 } // }}}
 
 // TableResultChunkLevel : execute hash query statement and stores result in struct tablehashresult
 func (t *pkTable) TableResultChunkLevel(
-	db *sql.DB,
+	db *DB,
 	issrc bool,
 	tci *tableChunkInfo,
-) (result tableHashResult) { // {{{
+) (result tableHashResult, err error) { // {{{
+	conn, release, err := t.arg.run.acquire(db, issrc)
+	if err != nil {
+		return result, err
+	}
+	defer release(&err)
 
-	stmt, inputs := t.TableHashStmt(
-		db,
+	stmt, inputs, err := t.TableHashStmt(
+		conn,
 		issrc,
 		&tci.HashQuerySrc,
 		&tci.HashQueryTgt,
 		tci.LowerBoundary,
 		tci.LastPKFieldUpperBoundary,
 	)
-	if stmt != nil {
-		defer func() {
-			e := stmt.Close()
-			errorCheck(e)
-		}()
+	if err != nil {
+		return result, err
 	}
+	defer closeErr(stmt, &err)
 
 	var rowcnt int
-	var hash int
+	var hash string
 
 	ts := time.Now()
-	e := stmt.QueryRow(inputs...).Scan(&rowcnt, &hash)
-	errorCheck(e)
+	if err = stmt.QueryRowContext(t.arg.run.ctx, inputs...).Scan(&rowcnt, &hash); err != nil {
+		return result, err
+	}
 	elapsedms := time.Since(ts).Milliseconds()
 
+	if err = t.groupConcatGuard(issrc, rowcnt); err != nil {
+		return result, err
+	}
+
 	result.issrc = issrc
 	result.ts = ts
 	result.elapsedms = elapsedms
 
 	result.rowcnt = rowcnt
-	result.hash = hash
+	result.hash = hashValue(hash)
 
 	return
 } // }}}
 
-// TableRoutineChunkLevel : co-routine executing hash query against both source and target DB
-func (t *pkTable) TableRoutineChunkLevel(
-	dbSrc *sql.DB,
-	dbTgt *sql.DB,
+// TableHashChunkLevel : co-routine executing hash query against both source and target DB
+func (t *pkTable) TableHashChunkLevel(
+	dbSrc *DB,
+	dbTgt *DB,
 	tci *tableChunkInfo,
-) { // {{{
-	var waitgroup sync.WaitGroup
-	hashchan := make(chan tableHashResult)
-
-	waitgroup.Add(2)
-
-	go func() {
-		waitgroup.Wait()
-		close(hashchan)
-	}()
-
-	go func() {
-		defer waitgroup.Done()
-		hashchan <- t.TableResultChunkLevel(dbSrc, true, tci)
-	}()
-
-	go func() {
-		defer waitgroup.Done()
-		hashchan <- t.TableResultChunkLevel(dbTgt, false, tci)
-	}()
-
-	for result := range hashchan {
-		if result.issrc {
-			tci.RowcntSrc, tci.HashSrc, tci.ElapsedMsSrc, tci.TimestampSrc = result.rowcnt, result.hash, result.elapsedms, result.ts
-		} else {
-			tci.RowcntTgt, tci.HashTgt, tci.ElapsedMsTgt, tci.TimestampTgt = result.rowcnt, result.hash, result.elapsedms, result.ts
-		}
+) error { // {{{
+	var group errGroup
+	var resultSrc, resultTgt tableHashResult
+
+	group.Go(func() (e error) {
+		resultSrc, e = t.TableResultChunkLevel(dbSrc, true, tci)
+		return
+	})
+
+	group.Go(func() (e error) {
+		resultTgt, e = t.TableResultChunkLevel(dbTgt, false, tci)
+		return
+	})
+
+	if e := group.Wait(); e != nil {
+		return e
 	}
 
+	tci.RowcntSrc, tci.HashSrc, tci.ElapsedMsSrc, tci.TimestampSrc = resultSrc.rowcnt, resultSrc.hash, resultSrc.elapsedms, resultSrc.ts
+	tci.RowcntTgt, tci.HashTgt, tci.ElapsedMsTgt, tci.TimestampTgt = resultTgt.rowcnt, resultTgt.hash, resultTgt.elapsedms, resultTgt.ts
+
 	tci.Match = (tci.RowcntSrc == tci.RowcntTgt) && (tci.HashSrc == tci.HashTgt)
+	return nil
+} // }}}
+
+// TableRoutineChunkLevel : hash the chunk on both source and target DB, returns row level diff of
+// the chunk if hashes mismatch
+func (t *pkTable) TableRoutineChunkLevel(
+	dbSrc *DB,
+	dbTgt *DB,
+	tci *tableChunkInfo,
+) (tcri *TableChunkRowsInfo, err error) { // {{{
+	hashQuerySrc, hashQueryTgt := tci.HashQuerySrc, tci.HashQueryTgt // inputs are plugged in by each hash
+	if err = t.TableHashChunkLevel(dbSrc, dbTgt, tci); err != nil {
+		return nil, err
+	}
+
+	// mismatches of a lagging replica go away once it catches up
+	if !tci.Match && t.arg.ArgRecheck > 0 {
+		tci.Recheck = new(recheck)
+		for tci.Recheck.Attempts < t.arg.ArgRecheck && !tci.Match {
+			if !sleepContext(t.arg.run.ctx, t.arg.ArgRecheckDelay) {
+				return nil, t.arg.run.ctx.Err()
+			}
+			tci.Recheck.Attempts++
+			tci.HashQuerySrc, tci.HashQueryTgt = hashQuerySrc, hashQueryTgt
+			if err = t.TableHashChunkLevel(dbSrc, dbTgt, tci); err != nil {
+				return nil, err
+			}
+		}
+		tci.Recheck.Converged = tci.Match
+	}
 
 	if !tci.Match {
-		t.RunTableRoutineRowLevel(dbSrc, dbTgt, tci)
+		if t.arg.ArgBisect > 0 {
+			tcri, err = t.RunTableRoutineBisect(dbSrc, dbTgt, tci)
+		} else {
+			tcri, err = t.RunTableRoutineRowLevel(dbSrc, dbTgt, tci)
+		}
 	}
+
+	return
 } // }}}
 
+// RunTableRoutineChunkLevel : diff one chunk, the result is written by the chunk writer in chunk
+// index order
 func (t *pkTable) RunTableRoutineChunkLevel(
-	dbSrc *sql.DB,
-	dbTgt *sql.DB,
+	dbSrc *DB,
+	dbTgt *DB,
 	tci *tableChunkInfo,
-) { // {{{
-	t.TableRoutineChunkLevel(dbSrc, dbTgt, tci)
+) (tcri *TableChunkRowsInfo, err error) { // {{{
+	if tcri, err = t.TableRoutineChunkLevel(dbSrc, dbTgt, tci); err != nil {
+		return nil, err
+	}
 
-	if !envArg.ArgDebug {
+	if !t.arg.ArgDebug {
 		tci.UpperBoundaryQuery = ""
 		tci.HashQuerySrc = ""
 		tci.HashQueryTgt = ""
 	}
-	t.TableLog(envArg.ArgOutputfile, tci)
+
+	return
 } // }}}
 
 // vim: fdm=marker fdc=2
@@ -0,0 +1,223 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// columnLevelBatchSize is the max number of update rows fetched by one column level query
+const columnLevelBatchSize = 500
+
+/*
+TableQueryColumnLevel : construct column level query statement for a batch of rows, column values
+with --diff-values, otherwise hash of each column
+
+	SELECT pkfield1, ..., pkfieldn, HASH(CONCAT(field1)), ..., HASH(CONCAT(fieldn))
+	FROM table
+	WHERE (pkfield1, ..., pkfieldn) IN ((?, ..., ?), (?, ..., ?), ...)
+*/
+func (t *pkTable) TableQueryColumnLevel(
+	db *DB,
+	table string,
+	columnNames []string,
+	rowcnt int,
+) (query string) { // {{{
+	allPKColumnNames := t.GetAllPKColumnNames()
+
+	fields := make([]string, len(columnNames))
+	for i, column := range columnNames {
+		if t.arg.ArgDiffValues {
+			fields[i] = column
+		} else {
+			fields[i] = t.hashExpr(db, db.dialect.textExpr(column)) // as text like CONCAT_WS of the row hash, NULL stays NULL
+		}
+	}
+
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(allPKColumnNames)), ",") + ")"
+	rows := make([]string, rowcnt)
+	for i := range rows {
+		rows[i] = placeholders
+	}
+
+	query = `
+    SELECT SQL_NO_CACHE ` + strings.Join(allPKColumnNames, ",") + `,
+      ` + strings.Join(fields, ",\n      ") + `
+    FROM ` + table + `
+    WHERE (` + strings.Join(allPKColumnNames, ",") + `) IN ` + db.dialect.valuesList(rows)
+
+	t.arg.run.log.Traceln(query)
+
+	return
+} // }}}
+
+// TableResultColumnLevel : execute column level query for the update rows, returns column values
+// (or hashes) by pk column values
+func (t *pkTable) TableResultColumnLevel(
+	db *DB,
+	issrc bool,
+	table string,
+	columnNames []string,
+	tablerows []TableRow,
+) (mapRows map[string][]any, err error) { // {{{
+	mapRows = make(map[string][]any, len(tablerows))
+	allPKColumns := t.GetAllPKColumns()
+
+	for start := 0; start < len(tablerows); start += columnLevelBatchSize {
+		end := start + columnLevelBatchSize
+		if end > len(tablerows) {
+			end = len(tablerows)
+		}
+
+		var inputs []any
+		for _, tr := range tablerows[start:end] {
+			inputs = append(inputs, tr.AllPKColumnValues...)
+		}
+
+		query := t.TableQueryColumnLevel(db, table, columnNames, end-start)
+
+		err = func() (err error) {
+			conn, release, err := t.arg.run.acquire(db, issrc)
+			if err != nil {
+				return err
+			}
+			defer release(&err)
+
+			rowresult, err := conn.QueryContext(t.arg.run.ctx, query, inputs...)
+			if err != nil {
+				return err
+			}
+			defer closeErr(rowresult, &err)
+
+			for rowresult.Next() {
+				vals := make([]any, len(allPKColumns)+len(columnNames))
+				for i := 0; i < len(vals); i++ {
+					vals[i] = new(any)
+				}
+
+				if err = rowresult.Scan(vals...); err != nil {
+					return err
+				}
+
+				allPKColumnValues := make([]any, len(allPKColumns))
+				for i := 0; i < len(allPKColumns); i++ {
+					if allPKColumnValues[i], err = allPKColumns[i].FieldType.transformDBResultType(*vals[i].(*any)); err != nil {
+						return err
+					}
+				}
+
+				columnValues := make([]any, len(columnNames))
+				for i := 0; i < len(columnNames); i++ {
+					v := *vals[len(allPKColumns)+i].(*any)
+					if b, isbytes := v.([]uint8); isbytes {
+						v = string(b)
+					}
+					columnValues[i] = v
+				}
+
+				allPKColumnValuesBytes, _ := json.Marshal(allPKColumnValues)
+				mapRows[string(allPKColumnValuesBytes)] = columnValues
+			}
+
+			return rowresult.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return
+} // }}}
+
+// TableRoutineColumnLevel : co-routine fetching column hashes (or values) of the update rows from
+// both source and target DB, records the differing columns on each update row
+func (t *pkTable) TableRoutineColumnLevel(
+	dbSrc *DB,
+	dbTgt *DB,
+	tcri *TableChunkRowsInfo,
+) error { // {{{
+	columnNames, _, err := t.TableQueryColumnNames(dbSrc, t.arg.ArgSrcTable)
+	if err != nil {
+		return err
+	}
+
+	var group errGroup
+	var mapRowsSrc, mapRowsTgt map[string][]any
+
+	group.Go(func() (e error) {
+		mapRowsSrc, e = t.TableResultColumnLevel(dbSrc, true, t.arg.ArgSrcTable, columnNames, tcri.Diff.Update)
+		return
+	})
+
+	group.Go(func() (e error) {
+		mapRowsTgt, e = t.TableResultColumnLevel(dbTgt, false, t.arg.ArgTgtTable, columnNames, tcri.Diff.Update)
+		return
+	})
+
+	if err = group.Wait(); err != nil {
+		return err
+	}
+
+	for i := range tcri.Diff.Update {
+		tr := &tcri.Diff.Update[i]
+
+		allPKColumnValuesBytes, _ := json.Marshal(tr.AllPKColumnValues)
+		valuesSrc, existsSrc := mapRowsSrc[string(allPKColumnValuesBytes)]
+		valuesTgt, existsTgt := mapRowsTgt[string(allPKColumnValuesBytes)]
+		if !existsSrc || !existsTgt { // row changed since the row level query
+			t.arg.run.log.Warnf("update row %v not found in chunk %d column level query\n", tr.AllPKColumnValues, tcri.ChunkIdx)
+			continue
+		}
+
+		for c, column := range columnNames {
+			if columnValueEquals(valuesSrc[c], valuesTgt[c]) {
+				continue
+			}
+
+			tr.Columns = append(tr.Columns, column)
+			if t.arg.ArgDiffValues {
+				if tr.Before == nil {
+					tr.Before = map[string]any{}
+					tr.After = map[string]any{}
+				}
+				tr.Before[column] = valuesTgt[c]
+				tr.After[column] = valuesSrc[c]
+			}
+		}
+	}
+
+	return nil
+} // }}}
+
+// columnValueEquals : NULL only equals NULL, values of different driver types are compared as text
+func columnValueEquals(v1 any, v2 any) bool { // {{{
+	if v1 == nil || v2 == nil {
+		return v1 == nil && v2 == nil
+	}
+	if reflect.TypeOf(v1) == reflect.TypeOf(v2) {
+		return reflect.DeepEqual(v1, v2)
+	}
+	return fmt.Sprint(v1) == fmt.Sprint(v2)
+} // }}}
+
+// vim: fdm=marker fdc=2
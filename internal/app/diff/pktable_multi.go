@@ -19,20 +19,19 @@ package diff
 
 // Importing fmt package for the sake of printing
 import (
-	"database/sql"
+	"errors"
 	"strconv"
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
-	log "github.com/sirupsen/logrus"
 )
 
 type pkTableMulti struct { // {{{
 	pkTable
 } // }}}
 
-func (t *pkTableMulti) Init(pkColumns []pkColumn) *pkTableMulti { // {{{
-	t.init(pkColumns)
+func (t *pkTableMulti) Init(arg *envarg, pkColumns []pkColumn) *pkTableMulti { // {{{
+	t.init(arg, pkColumns)
 	return t
 } // }}}
 
@@ -69,7 +68,7 @@ func (t *pkTableMulti) UpperBoundaryQuery(
 	columnOperators []string,
 	chunksize int,
 ) (query string) { // {{{
-	table := envArg.ArgSrcTable
+	table := t.arg.ArgSrcTable
 
 	var lastpkfield string
 	var pkcolumnsWhere []string
@@ -91,10 +90,7 @@ func (t *pkTableMulti) UpperBoundaryQuery(
 		}
 	}
 
-	var additionalfilterstmt string
-	if envArg.ArgAdditionalFilter != "" {
-		additionalfilterstmt = " AND " + envArg.ArgAdditionalFilter
-	}
+	additionalfilterstmt := t.additionalFilterStmt()
 
 	// distinguish customized single PK column sequence in multi PK table case
 	if len(pkcolumnsNolastpkfields) > 0 {
@@ -123,7 +119,7 @@ func (t *pkTableMulti) UpperBoundaryQuery(
     `
 	}
 
-	log.Traceln(query)
+	t.arg.run.log.Traceln(query)
 
 	return
 } // }}}
@@ -139,10 +135,11 @@ returns 4 or more fields
  5. UpperBoundaryQuery
 */
 func (t *pkTableMulti) TransformUpperBoundaryResult(
-	dbSrc *sql.DB,
+	dbSrc *DB,
 	tub *tableUpperBoundary,
-) (resultset [][]any) { // {{{
-	chunksize := envArg.ArgChunksize
+) (resultset [][]any, err error) { // {{{
+	log := t.arg.run.log
+	chunksize := t.arg.ArgChunksize
 	pkColumnNames := t.GetPKColumnNames()
 
 	lastPKfieldtype := t.GetPKColumns()[len(t.GetPKColumns())-1].FieldType
@@ -154,7 +151,7 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 	// 3. last PK field lowerboundary
 	// 4. last PK field upperboundary
 	// 5. UpperBoundaryQuery
-	populateResultset := func(rub [][]any) int { // {{{
+	populateResultset := func(rub [][]any) (int, error) { // {{{
 		rowcntSrc := 0
 		for r := 0; r < len(rub); r++ { // row level
 			originalrow := rub[r]
@@ -169,7 +166,11 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 			for c := 1; c < len(originalrow)-1; c++ {
 				v := *originalrow[c].(*any)
 				ft := t.GetPKColumns()[c-1].FieldType
-				rowinresultset = append(rowinresultset, ft.transformDBResultType(v))
+				tv, e := ft.transformDBResultType(v)
+				if e != nil {
+					return 0, e
+				}
+				rowinresultset = append(rowinresultset, tv)
 			}
 
 			// 3. last PK field lowerboundary
@@ -185,13 +186,17 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 
 			// 4. last PK field upperboundary
 			v := *originalrow[len(originalrow)-1].(*any)
+			ub, e := lastPKfieldtype.transformDBResultType(v)
+			if e != nil {
+				return 0, e
+			}
 			log.Debugf(
 				"====return lowerboundary: %v, column type: %T, value: %v====\n",
 				lb,
 				v,
-				lastPKfieldtype.transformDBResultType(v),
+				ub,
 			)
-			rowinresultset = append(rowinresultset, lastPKfieldtype.transformDBResultType(v))
+			rowinresultset = append(rowinresultset, ub)
 
 			// 5. UpperBoundaryQuery
 			rowinresultset = append(rowinresultset, tub.UpperBoundaryQuery)
@@ -199,10 +204,10 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 			resultset = append(resultset, rowinresultset)
 		}
 
-		return rowcntSrc
+		return rowcntSrc, nil
 	} // }}}
 
-	runUpperBoundary := func(runidx int) int { // {{{
+	runUpperBoundary := func(runidx int) (int, error) { // {{{
 		// if runidx > 1 {
 		// 	log.SetLevel(log.DebugLevel)
 		// }
@@ -211,12 +216,18 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 		log.Debugf("----[%d] lowerboundary: %v----\n", runidx, tub.LowerBoundary)
 		log.Debugf("----[%d] UpperBoundaryQuery: %v----\n", runidx, tub.UpperBoundaryQuery)
 
-		rub := t.UpperBoundaryResult(dbSrc, pkColumnNames, tub)
+		rub, e := t.UpperBoundaryResult(dbSrc, pkColumnNames, tub)
+		if e != nil {
+			return 0, e
+		}
 		log.Debugf("----[%d] UpperBoundaryQuery formated: %v----\n", runidx, tub.UpperBoundaryQuery)
 		log.Debugf("----[%d] chunksize: %d----\n", runidx, chunksize)
 
 		// possible result loop size of more than 1
-		rowcntSrc := populateResultset(rub)
+		rowcntSrc, e := populateResultset(rub)
+		if e != nil {
+			return 0, e
+		}
 
 		log.Debugf("====[%d] rowcntSrc: %d, resultset: %v====\n", runidx, rowcntSrc, resultset)
 		log.Tracef("====[%d] query: %v====\n", runidx, tub.UpperBoundaryQuery)
@@ -225,18 +236,18 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 		// 	log.SetLevel(log.InfoLevel)
 		// }
 
-		return rowcntSrc
+		return rowcntSrc, nil
 	} // }}}
 
-	runUpperBoundaryFor1PKFields := func() { // {{{
-		runUpperBoundary(1)
+	runUpperBoundaryFor1PKFields := func() error { // {{{
+		_, e := runUpperBoundary(1)
+		return e
 	} // }}}
 
-	runUpperBoundaryFor2PKFields := func() { // {{{
-		rowcntSrc := runUpperBoundary(2)
-
-		if rowcntSrc == chunksize {
-			return
+	runUpperBoundaryFor2PKFields := func() error { // {{{
+		rowcntSrc, e := runUpperBoundary(2)
+		if e != nil || rowcntSrc == chunksize {
+			return e
 		}
 
 		chunksize -= rowcntSrc
@@ -245,14 +256,13 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 		tub.LowerBoundary = tub.LowerBoundary[:len(tub.LowerBoundary)-1]
 
 		pkColumnOperators = []string{">"}
-		runUpperBoundaryFor1PKFields()
+		return runUpperBoundaryFor1PKFields()
 	} // }}}
 
-	runUpperBoundaryFor3PKFields := func() { // {{{
-		rowcntSrc := runUpperBoundary(3)
-
-		if rowcntSrc == chunksize {
-			return
+	runUpperBoundaryFor3PKFields := func() error { // {{{
+		rowcntSrc, e := runUpperBoundary(3)
+		if e != nil || rowcntSrc == chunksize {
+			return e
 		}
 
 		chunksize -= rowcntSrc
@@ -261,14 +271,13 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 		tub.LowerBoundary = tub.LowerBoundary[:len(tub.LowerBoundary)-1]
 
 		pkColumnOperators = []string{"=", ">"}
-		runUpperBoundaryFor2PKFields()
+		return runUpperBoundaryFor2PKFields()
 	} // }}}
 
-	runUpperBoundaryFor4PKFields := func() { // {{{
-		rowcntSrc := runUpperBoundary(4)
-
-		if rowcntSrc == chunksize {
-			return
+	runUpperBoundaryFor4PKFields := func() error { // {{{
+		rowcntSrc, e := runUpperBoundary(4)
+		if e != nil || rowcntSrc == chunksize {
+			return e
 		}
 
 		chunksize -= rowcntSrc
@@ -277,25 +286,25 @@ func (t *pkTableMulti) TransformUpperBoundaryResult(
 		tub.LowerBoundary = tub.LowerBoundary[:len(tub.LowerBoundary)-1]
 
 		pkColumnOperators = []string{"=", "=", ">"}
-		runUpperBoundaryFor3PKFields()
+		return runUpperBoundaryFor3PKFields()
 	} // }}}
 
 	switch len(pkColumnNames) {
 	case 1:
 		pkColumnOperators = []string{">="}
-		runUpperBoundaryFor1PKFields()
+		err = runUpperBoundaryFor1PKFields()
 	case 2:
 		pkColumnOperators = []string{"=", ">="}
-		runUpperBoundaryFor2PKFields()
+		err = runUpperBoundaryFor2PKFields()
 	case 3:
 		pkColumnOperators = []string{"=", "=", ">="}
-		runUpperBoundaryFor3PKFields()
+		err = runUpperBoundaryFor3PKFields()
 	case 4:
 		pkColumnOperators = []string{"=", "=", "=", ">="}
-		runUpperBoundaryFor4PKFields()
+		err = runUpperBoundaryFor4PKFields()
 	default:
 		// WARN:
-		log.Fatalln("5 or more composite pk table is not supported")
+		err = errors.New("5 or more composite pk table is not supported")
 	}
 
 	return
@@ -307,7 +316,9 @@ func (t *pkTableMulti) ResetLowerboundaryUpperboundary(
 ) (
 	stopAfterRun bool,
 	lastpkfieldUpperboundary any,
+	err error,
 ) { // {{{
+	log := t.arg.run.log
 	log.Debugf("----before lowerboundary: %v----\n", lowerboundary)
 
 	stopAfterRun = false
@@ -322,18 +333,21 @@ func (t *pkTableMulti) ResetLowerboundaryUpperboundary(
 	}
 
 	// -u is empty, return
-	if len(envArg.ArgUpperBoundary) == 1 && envArg.ArgUpperBoundary[0] == "" {
+	if len(t.arg.ArgUpperBoundary) == 1 && t.arg.ArgUpperBoundary[0] == "" {
 		return
 	}
 
-	// compare envArg.ArgUpperBoundary excluding last PK field with resultset rows
+	// compare t.arg.ArgUpperBoundary excluding last PK field with resultset rows
 	// exclude 1st field[COUNT(1)]
 	// exclude (2nd to the last) and last fields, respective lowerboundary and upperboundary of last PK field
 	// single PK skip the loop
 	matchedfieldcnt := 0
 	for c := 1; c < len(row)-2; c++ { // column level
 		ft := t.GetPKColumns()[c-1].FieldType
-		userUB := envArg.ArgUpperBoundary[c-1]
+		userUB, e := ft.transformFieldType(t.arg.ArgUpperBoundary[c-1])
+		if e != nil {
+			return false, nil, e
+		}
 		if ft.equals(row[c], userUB) {
 			matchedfieldcnt++
 			log.Debugf("----match matchedfieldcnt: %d----\n", matchedfieldcnt)
@@ -353,9 +367,12 @@ func (t *pkTableMulti) ResetLowerboundaryUpperboundary(
 	}
 
 	lastPKfieldtype := t.GetPKColumns()[len(t.GetPKColumns())-1].FieldType
-	userUpperboundary := lastPKfieldtype.transformFieldType(
-		envArg.ArgUpperBoundary[len(envArg.ArgUpperBoundary)-1],
+	userUpperboundary, err := lastPKfieldtype.transformFieldType(
+		t.arg.ArgUpperBoundary[len(t.arg.ArgUpperBoundary)-1],
 	)
+	if err != nil {
+		return false, nil, err
+	}
 
 	if lastPKfieldtype.equals(lastpkfieldUpperboundary, userUpperboundary) {
 		stopAfterRun = true
@@ -19,20 +19,20 @@ package diff
 
 // Importing fmt package for the sake of printing
 import (
-	"database/sql"
 	"encoding/json"
 	"strings"
-	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	log "github.com/sirupsen/logrus"
 )
 
 // TableRow : json marshalable struct on table row level
 type TableRow struct { // {{{
-	Hash              int   `json:"rowhash"`
-	AllPKColumnValues []any `json:"allpkcolumnvalues"`
+	Hash              hashValue      `json:"rowhash"`
+	AllPKColumnValues []any          `json:"allpkcolumnvalues"`
+	Columns           []string       `json:"columns,omitempty"` // differing columns of update rows
+	Before            map[string]any `json:"before,omitempty"`  // target values of differing columns
+	After             map[string]any `json:"after,omitempty"`   // source values of differing columns
 } // }}}
 
 // tableRowCrud : json marshalable struct on table row level for crud types
@@ -45,45 +45,48 @@ type tableRowCrud struct { // {{{
 // TableChunkRowsInfo : json marshalaable struct for table chunk rows
 type TableChunkRowsInfo struct { // {{{
 	tableChunkInfo
-	Diff            tableRowCrud   `json:"diff"`
-	TableRowsSrc    []TableRow     `json:"-"` // raw source table rows
-	TableRowsTgt    []TableRow     `json:"-"` // raw target table rows
-	MapTableRowsSrc map[string]int `json:"-"` // map of source table pk column values to row hash
-	MapTableRowsTgt map[string]int `json:"-"` // map of target table pk column values to row hash
+	Diff            tableRowCrud         `json:"diff"`
+	TableRowsSrc    []TableRow           `json:"-"`                // raw source table rows
+	TableRowsTgt    []TableRow           `json:"-"`                // raw target table rows
+	MapTableRowsSrc map[string]hashValue `json:"-"`                // map of source table pk column values to row hash
+	MapTableRowsTgt map[string]hashValue `json:"-"`                // map of target table pk column values to row hash
+	Bisect          []bisectNode         `json:"bisect,omitempty"` // sub-chunks hashed by --bisect
 } // }}}
 
 /*
 TableHashQueryRowLevel : construct hash query statement for each row in the range
 
-	SELECT COUNT(1) AS rowcnt, CRC32(CONCAT_WS('#', field1, field2, ..., fieldn))
+	SELECT HASH(ROW(field1, field2, ..., fieldn)), pkfield1, pkfield2, ..., pkfieldn
 	FROM table
 	WHERE pkfield1 = ? AND pkfield2 = ? AND ... AND pkfieldn BETWEEN ? AND ?
 	ORDER BY pkfield1, pkfield2, ..., pkfieldn
+
+HASH is the --hash algorithm, ROW the --row-encoding of the fields
 */
 func (t *pkTable) TableHashQueryRowLevel(
-	db *sql.DB,
+	db *DB,
 	table string,
-) (query string) { // {{{
+) (query string, err error) { // {{{
 
-	columnNames, pkColumnsWhere := t.TableQueryColumnNames(db, table)
+	columnNames, pkColumnsWhere, err := t.TableQueryColumnNames(db, table)
+	if err != nil {
+		return "", err
+	}
 
 	allPKColumnNames := t.GetAllPKColumnNames()
-	var additionalfilterstmt string
-	if envArg.ArgAdditionalFilter != "" {
-		additionalfilterstmt = " AND " + envArg.ArgAdditionalFilter
-	}
+	additionalfilterstmt := t.additionalFilterStmt()
 
 	query = `
     SELECT SQL_NO_CACHE
-      CAST(CRC32(
-        CONCAT_WS('#',` + strings.Join(columnNames, ",") + `)
-        ) AS UNSIGNED) AS crc32,` +
+      ` + t.hashExpr(db, `
+        `+t.rowExpr(db, columnNames)+`
+        `) + ` AS hash,` +
 		strings.Join(allPKColumnNames, ",") + `
     FROM ` + table + `
     WHERE ` + strings.Join(pkColumnsWhere, " AND ") + additionalfilterstmt + `
     ORDER BY ` + strings.Join(allPKColumnNames, ",")
 
-	log.Traceln(query)
+	t.arg.run.log.Traceln(query)
 
 	return
 } // }}}
@@ -91,29 +94,35 @@ func (t *pkTable) TableHashQueryRowLevel(
 // TableResultRowLevel : execute hash row level query statement and stores result in struct
 // tablehashresult
 func (t *pkTable) TableResultRowLevel(
-	db *sql.DB,
+	db *DB,
 	issrc bool,
 	tcri *TableChunkRowsInfo,
-) (result tableHashResult) { // {{{
+) (result tableHashResult, err error) { // {{{
+	conn, release, err := t.arg.run.acquire(db, issrc)
+	if err != nil {
+		return result, err
+	}
+	defer release(&err)
 
-	stmt, inputs := t.TableHashStmt(
-		db,
+	stmt, inputs, err := t.TableHashStmt(
+		conn,
 		issrc,
 		&tcri.HashQuerySrc,
 		&tcri.HashQueryTgt,
 		tcri.LowerBoundary,
 		tcri.LastPKFieldUpperBoundary,
 	)
-	if stmt != nil {
-		defer func() {
-			e := stmt.Close()
-			errorCheck(e)
-		}()
+	if err != nil {
+		return result, err
 	}
+	defer closeErr(stmt, &err)
 
 	ts := time.Now()
-	rowresult, e := stmt.Query(inputs...)
-	errorCheck(e)
+	rowresult, err := stmt.QueryContext(t.arg.run.ctx, inputs...)
+	if err != nil {
+		return result, err
+	}
+	defer closeErr(rowresult, &err)
 	elapsedms := time.Since(ts).Milliseconds()
 
 	result.issrc = issrc
@@ -125,26 +134,30 @@ func (t *pkTable) TableResultRowLevel(
 		vals := make([]any, len(t.GetAllPKColumns())+1)
 
 		// 1st field: hash
-		vals[0] = new(int)
+		vals[0] = new(string)
 
 		// 2nd - last fields: pkcolumn values
 		for i := 1; i < len(vals); i++ {
 			vals[i] = new(any)
 		}
 
-		e = rowresult.Scan(vals...)
-		errorCheck(e)
+		if err = rowresult.Scan(vals...); err != nil {
+			return result, err
+		}
 
 		allPKColumnValues := make([]any, len(t.GetAllPKColumns()))
 
 		for i := 1; i < len(vals); i++ {
 			v := *vals[i].(*any)
-			tv := t.GetAllPKColumns()[i-1].FieldType.transformDBResultType(v)
+			tv, e := t.GetAllPKColumns()[i-1].FieldType.transformDBResultType(v)
+			if e != nil {
+				return result, e
+			}
 			allPKColumnValues[i-1] = tv
 		}
 
 		tr := TableRow{
-			Hash:              *vals[0].(*int),
+			Hash:              hashValue(*vals[0].(*string)),
 			AllPKColumnValues: allPKColumnValues,
 		}
 
@@ -160,44 +173,39 @@ func (t *pkTable) TableResultRowLevel(
 		}
 	}
 
+	// a killed query ends the rows early, the chunk must not be diffed on part of them
+	err = rowresult.Err()
+
 	return
 } // }}}
 
 // TableRoutineRowLevel : co-routine executing hash query against both source and target DB on
 // row level
 func (t *pkTable) TableRoutineRowLevel(
-	dbSrc *sql.DB,
-	dbTgt *sql.DB,
+	dbSrc *DB,
+	dbTgt *DB,
 	tcri *TableChunkRowsInfo,
-) { // {{{
-	var waitgroup sync.WaitGroup
-	hashchan := make(chan tableHashResult)
-
-	waitgroup.Add(2)
-
-	go func() {
-		waitgroup.Wait()
-		close(hashchan)
-	}()
-
-	go func() {
-		defer waitgroup.Done()
-		hashchan <- t.TableResultRowLevel(dbSrc, true, tcri)
-	}()
-
-	go func() {
-		defer waitgroup.Done()
-		hashchan <- t.TableResultRowLevel(dbTgt, false, tcri)
-	}()
-
-	for result := range hashchan {
-		if result.issrc {
-			tcri.ElapsedMsSrc, tcri.TimestampSrc = result.elapsedms, result.ts
-		} else {
-			tcri.ElapsedMsTgt, tcri.TimestampTgt = result.elapsedms, result.ts
-		}
+) error { // {{{
+	var group errGroup
+	var resultSrc, resultTgt tableHashResult
+
+	group.Go(func() (e error) {
+		resultSrc, e = t.TableResultRowLevel(dbSrc, true, tcri)
+		return
+	})
+
+	group.Go(func() (e error) {
+		resultTgt, e = t.TableResultRowLevel(dbTgt, false, tcri)
+		return
+	})
+
+	if e := group.Wait(); e != nil {
+		return e
 	}
 
+	tcri.ElapsedMsSrc, tcri.TimestampSrc = resultSrc.elapsedms, resultSrc.ts
+	tcri.ElapsedMsTgt, tcri.TimestampTgt = resultTgt.elapsedms, resultTgt.ts
+
 	// figure out crud on row level
 	//  ┌──────────────────────────────────────────────────────────────────────────────┐
 	for _, tr := range tcri.TableRowsSrc {
@@ -218,18 +226,24 @@ func (t *pkTable) TableRoutineRowLevel(
 		}
 	}
 	//  └──────────────────────────────────────────────────────────────────────────────┘
+
+	if t.arg.ArgDiffColumns && len(tcri.Diff.Update) > 0 {
+		return t.TableRoutineColumnLevel(dbSrc, dbTgt, tcri)
+	}
+	return nil
 } // }}}
 
-func (t *pkTable) RunTableRoutineRowLevel(
-	dbSrc *sql.DB,
-	dbTgt *sql.DB,
+// newTableChunkRowsInfo : row level info of the chunk, without rows
+func (t *pkTable) newTableChunkRowsInfo(
+	dbSrc *DB,
+	dbTgt *DB,
 	tci *tableChunkInfo,
-) { // {{{
-	tcri := new(TableChunkRowsInfo)
+) (tcri *TableChunkRowsInfo, err error) { // {{{
+	tcri = new(TableChunkRowsInfo)
 	tcri.Match = tci.Match
 	tcri.ChunkIdx = tci.ChunkIdx
-	tcri.TableSrc = envArg.ArgSrcTable
-	tcri.TableTgt = envArg.ArgTgtTable
+	tcri.TableSrc = t.arg.ArgSrcTable
+	tcri.TableTgt = t.arg.ArgTgtTable
 	tcri.PKColumnNames = t.GetPKColumnNames()
 	tcri.RowcntSrc = tci.RowcntSrc
 	tcri.RowcntTgt = tci.RowcntTgt
@@ -239,22 +253,46 @@ func (t *pkTable) RunTableRoutineRowLevel(
 	tcri.LowerBoundary = tci.LowerBoundary
 	tcri.UpperBoundaryQuery = tci.UpperBoundaryQuery
 	tcri.PKColumnSequence = tci.PKColumnSequence
+	tcri.KeyColumns = tci.KeyColumns
 	tcri.IgnoreFields = tci.IgnoreFields
 	tcri.AdditionalFilter = tci.AdditionalFilter
-	tcri.HashQuerySrc = t.TableHashQueryRowLevel(dbSrc, envArg.ArgSrcTable)
-	tcri.HashQueryTgt = t.TableHashQueryRowLevel(dbTgt, envArg.ArgTgtTable)
+	tcri.HashAlgorithm = tci.HashAlgorithm
+	tcri.RowEncoding = tci.RowEncoding
+	tcri.ChunkAggregate = tci.ChunkAggregate
+	if tcri.HashQuerySrc, err = t.TableHashQueryRowLevel(dbSrc, t.arg.ArgSrcTable); err != nil {
+		return nil, err
+	}
+	if tcri.HashQueryTgt, err = t.TableHashQueryRowLevel(dbTgt, t.arg.ArgTgtTable); err != nil {
+		return nil, err
+	}
+
+	return
+} // }}}
+
+// RunTableRoutineRowLevel : diff a mismatched chunk row by row
+func (t *pkTable) RunTableRoutineRowLevel(
+	dbSrc *DB,
+	dbTgt *DB,
+	tci *tableChunkInfo,
+) (tcri *TableChunkRowsInfo, err error) { // {{{
+	if tcri, err = t.newTableChunkRowsInfo(dbSrc, dbTgt, tci); err != nil {
+		return nil, err
+	}
 
-	tcri.MapTableRowsSrc = make(map[string]int, tcri.RowcntSrc)
-	tcri.MapTableRowsTgt = make(map[string]int, tcri.RowcntTgt)
+	tcri.MapTableRowsSrc = make(map[string]hashValue, tcri.RowcntSrc)
+	tcri.MapTableRowsTgt = make(map[string]hashValue, tcri.RowcntTgt)
 
-	t.TableRoutineRowLevel(dbSrc, dbTgt, tcri)
+	if err = t.TableRoutineRowLevel(dbSrc, dbTgt, tcri); err != nil {
+		return nil, err
+	}
 
-	// if !envArg.ArgDebug {
+	// if !t.arg.ArgDebug {
 	// 	tcri.UpperBoundaryQuery = ""
 	// 	tcri.HashQuerySrc = ""
 	// 	tcri.HashQueryTgt = ""
 	// }
-	t.TableLog(envArg.ArgOutputRowLevelfile, tcri)
+
+	return
 } // }}}
 
 // vim: fdm=marker fdc=2
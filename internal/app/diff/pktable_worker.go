@@ -0,0 +1,315 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// chunkSlots : semaphores capping concurrent chunk hash queries per side, sized by
+// --src-concurrency and --tgt-concurrency
+type chunkSlots struct { // {{{
+	src chan struct{}
+	tgt chan struct{}
+} // }}}
+
+// acquire : take a query slot of the side and a connection of db for a chunk query, the snapshot
+// connection of the side with --consistent-snapshot. Once the run is cancelled the query running on
+// the connection is killed on the server, returns func to release both. The error of releasing the
+// connection goes to *err of release unless it already holds one
+func (r *runner) acquire(db *DB, issrc bool) (conn *sql.Conn, release func(err *error), err error) { // {{{
+	slots, snapshot := r.slots.tgt, r.snapshot.tgt
+	if issrc {
+		slots, snapshot = r.slots.src, r.snapshot.src
+	}
+
+	select {
+	case slots <- struct{}{}:
+	case <-r.ctx.Done():
+		return nil, nil, r.ctx.Err()
+	}
+
+	d := db.dialect
+
+	var connectionid int64
+	if snapshot != nil {
+		conn, connectionid = snapshot.conn, snapshot.connectionid
+	} else {
+		if conn, err = db.Conn(r.ctx); err != nil {
+			<-slots
+			return nil, nil, err
+		}
+
+		if connectionid, err = r.connectionID(d, conn); err != nil {
+			_ = conn.Close()
+			<-slots
+			return nil, nil, err
+		}
+	}
+
+	done := make(chan struct{})
+	killed := make(chan struct{})
+	go func() {
+		defer close(killed)
+		select {
+		case <-done:
+		case <-r.ctx.Done():
+			if d.killQuery == "" { // the driver cancels the query itself
+				return
+			}
+			// the driver only drops its connection, the query keeps running on the server
+			_, e := db.ExecContext(context.Background(), fmt.Sprintf(d.killQuery, connectionid))
+			if e != nil {
+				r.log.Warnf("failed to kill query of connection %d: %v\n", connectionid, e)
+			}
+		}
+	}()
+
+	return conn, func(err *error) {
+		close(done)
+		<-killed
+		var e error
+		if snapshot == nil { // the snapshot connection is kept for the next query
+			e = conn.Close()
+		}
+		<-slots
+		if *err == nil && r.ctx.Err() == nil {
+			*err = e
+		}
+	}, nil
+} // }}}
+
+// connectionID : id of the connection conn of the pool for killQuery, looked up once per driver
+// connection as the pool hands the same connections out again
+func (r *runner) connectionID(d *dialect, conn *sql.Conn) (int64, error) { // {{{
+	if d.killQuery == "" {
+		return 0, nil
+	}
+
+	var driverconn any
+	if e := conn.Raw(func(dc any) error {
+		driverconn = dc
+		return nil
+	}); e != nil {
+		return 0, e
+	}
+	if connectionid, exists := r.connids.Load(driverconn); exists {
+		return connectionid.(int64), nil
+	}
+
+	connectionid, e := d.queryConnectionID(r.ctx, conn)
+	if e != nil {
+		return 0, e
+	}
+	r.connids.Store(driverconn, connectionid)
+
+	return connectionid, nil
+} // }}}
+
+// chunkWindowPerWorker : chunks dispatched but not written yet per --parallel worker. A slow chunk
+// blocks chunking once the window is full instead of piling up results behind it
+const chunkWindowPerWorker = 4
+
+// chunkResult : diffed chunk waiting for the chunk writer
+type chunkResult struct { // {{{
+	tci  *tableChunkInfo
+	tcri *TableChunkRowsInfo // nil if chunk matches
+} // }}}
+
+// newChunkWindow : window of chunks dispatched to the workers and not written yet
+func (t *pkTable) newChunkWindow() { // {{{
+	t.window = make(chan struct{}, t.arg.ArgParallel*chunkWindowPerWorker)
+} // }}}
+
+// dispatch : queue a chunk for the workers once the chunk window has room for it, returns false if
+// the run is cancelled first. The chunk writer frees the room after writing the chunk
+func (t *pkTable) dispatch(jobs chan<- *tableChunkInfo, tci *tableChunkInfo) bool { // {{{
+	select {
+	case t.window <- struct{}{}:
+	case <-t.arg.run.ctx.Done():
+		return false
+	}
+
+	select {
+	case jobs <- tci:
+		return true
+	case <-t.arg.run.ctx.Done():
+		return false
+	}
+} // }}}
+
+// RunChunkWorkers : start --parallel workers diffing chunks from jobs with diff, results channel is
+// closed once jobs is closed and drained. A failed chunk fails the run, jobs queued after that are
+// drained without being diffed
+func (t *pkTable) RunChunkWorkers(
+	diff func(tci *tableChunkInfo) (*TableChunkRowsInfo, error),
+	jobs <-chan *tableChunkInfo,
+) <-chan chunkResult { // {{{
+	var waitgroup sync.WaitGroup
+	results := make(chan chunkResult, t.arg.ArgParallel)
+
+	waitgroup.Add(t.arg.ArgParallel)
+
+	go func() {
+		waitgroup.Wait()
+		close(results)
+	}()
+
+	for w := 0; w < t.arg.ArgParallel; w++ {
+		go func() {
+			defer waitgroup.Done()
+			for tci := range jobs {
+				if t.arg.run.ctx.Err() != nil {
+					continue
+				}
+
+				throttled, reason, e := t.arg.run.throttle.wait(t.arg.run.ctx)
+				if e != nil {
+					t.arg.run.fail(e)
+					continue
+				}
+				tci.ThrottledMs, tci.Throttle = throttled.Milliseconds(), reason
+
+				if snapshot := t.arg.run.snapshot; snapshot.src != nil {
+					tci.SnapshotSrc, tci.SnapshotTgt = &snapshot.src.Snapshot, &snapshot.tgt.Snapshot
+				}
+
+				tcri, e := diff(tci)
+				if e != nil {
+					t.arg.run.fail(e)
+					continue
+				}
+				t.arg.run.throttle.done(tci.RowcntSrc)
+				results <- chunkResult{tci: tci, tcri: tcri}
+			}
+		}()
+	}
+
+	return results
+} // }}}
+
+// WriteChunkResults : write chunk results to output files in chunk index order, starting from
+// chunk index nextidx, returns totals of the written chunks and frees their room in the chunk window.
+// Chunks after a gap left by a cancelled run are not written, the table is incomplete
+func (t *pkTable) WriteChunkResults(results <-chan chunkResult, nextidx int) (ts *TableSummary, err error) { // {{{
+	pending := map[int]chunkResult{}
+	ts = &TableSummary{
+		TableSrc: t.arg.ArgSrcTable,
+		TableTgt: t.arg.ArgTgtTable,
+		Status:   "match",
+	}
+
+	var last *tableChunkInfo
+	for cr := range results {
+		pending[cr.tci.ChunkIdx] = cr
+
+		for {
+			next, exists := pending[nextidx]
+			if !exists {
+				break
+			}
+			delete(pending, nextidx)
+			nextidx++
+
+			if err = t.TableLogChunk(next); err != nil {
+				return nil, err
+			}
+			ts.addChunk(next)
+			t.arg.run.progress.addChunk(next.tci)
+			last = next.tci
+			<-t.window
+		}
+	}
+
+	if t.arg.run.ctx.Err() != nil {
+		ts.Status = "incomplete"
+		if last != nil {
+			ts.ResumeBoundary = append(append([]any(nil), last.LowerBoundary[:len(last.LowerBoundary)-1]...), last.LastPKFieldUpperBoundary)
+			lb, _ := json.Marshal(ts.ResumeBoundary)
+			t.arg.run.log.Warnf(
+				"table %s stopped after chunk %d at upper boundary %s, continue with --resume\n",
+				t.arg.ArgSrcTable,
+				last.ChunkIdx,
+				strings.Trim(string(lb), "[]"),
+			)
+		} else {
+			t.arg.run.log.Warnf("table %s stopped before any new chunk was written, continue with --resume\n", t.arg.ArgSrcTable)
+		}
+	} else if len(pending) > 0 {
+		return nil, fmt.Errorf("%d chunks are not written, missing chunk index %d", len(pending), nextidx)
+	}
+
+	return
+} // }}}
+
+// TableLogChunk : write chunk result to output files in --format and print the chunk log line
+func (t *pkTable) TableLogChunk(cr chunkResult) error { // {{{
+	tci := cr.tci
+
+	if e := t.writer.write(cr); e != nil {
+		return e
+	}
+
+	lb, _ := json.Marshal(tci.LowerBoundary)
+	ub, _ := json.Marshal(
+		append(
+			append(
+				[]any{},
+				tci.LowerBoundary[:len(tci.LowerBoundary)-1]...,
+			),
+			tci.LastPKFieldUpperBoundary),
+	)
+
+	logmsg := fmt.Sprintf(
+		"[%-5v] [%5d] -l %v -u %v [RowcntSrc: %d, RowcntTgt: %d]",
+		tci.Match,
+		tci.ChunkIdx,
+		strings.Trim(string(lb), "[]"),
+		strings.Trim(string(ub), "[]"),
+		tci.RowcntSrc,
+		tci.RowcntTgt,
+	)
+	if tci.Throttle != "" {
+		logmsg += fmt.Sprintf(" [throttled %dms: %s]", tci.ThrottledMs, tci.Throttle)
+	} else if tci.ThrottledMs > 0 {
+		logmsg += fmt.Sprintf(" [throttled %dms]", tci.ThrottledMs)
+	}
+	if tci.Recheck != nil {
+		if tci.Recheck.Converged {
+			logmsg += fmt.Sprintf(" [converged after %d rechecks]", tci.Recheck.Attempts)
+		} else {
+			logmsg += fmt.Sprintf(" [%d rechecks]", tci.Recheck.Attempts)
+		}
+	}
+	logger := logrus.NewEntry(t.arg.run.chunkLog)
+	if t.arg.ArgAllTables {
+		logger = logger.WithField("s", tci.TableSrc)
+	}
+	logger.Infoln(logmsg)
+	return nil
+} // }}}
+
+// vim: fdm=marker fdc=2
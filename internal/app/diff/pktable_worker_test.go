@@ -0,0 +1,223 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunkRecorder : outputWriter keeping the chunk indexes in the order they are written
+type chunkRecorder struct { // {{{
+	chunks []int
+} // }}}
+
+func (w *chunkRecorder) write(cr chunkResult) error {
+	w.chunks = append(w.chunks, cr.tci.ChunkIdx)
+	return nil
+}
+func (w *chunkRecorder) close(ts *TableSummary) error { return nil }
+
+// newWorkerTable : table of a run without database, diffing chunks with --parallel parallel
+func newWorkerTable(parallel int) (*pkTable, *chunkRecorder) { // {{{
+	run := newRunner(context.Background(), discardLogger())
+	run.throttle = &throttler{}
+	recorder := &chunkRecorder{}
+	t := &pkTable{
+		arg: &envarg{
+			ArgSrcTable: "emp",
+			ArgTgtTable: "emp",
+			ArgParallel: parallel,
+			run:         run,
+		},
+		writer: recorder,
+	}
+	t.newChunkWindow()
+	return t, recorder
+} // }}}
+
+// workerChunk : chunk idx of a single PK table with boundaries of 100 rows
+func workerChunk(idx int) *tableChunkInfo { // {{{
+	tci := &tableChunkInfo{
+		TableSrc:                 "emp",
+		TableTgt:                 "emp",
+		ChunkIdx:                 idx,
+		LastPKFieldUpperBoundary: idx * 100,
+		Match:                    true,
+	}
+	tci.LowerBoundary = []any{(idx - 1) * 100}
+	return tci
+} // }}}
+
+func TestWriteChunkResults(t *testing.T) { // {{{
+	tests := []struct {
+		name       string
+		results    []int // chunk indexes in the order the workers finish them
+		cancelled  bool
+		want       []int
+		wantStatus string
+		wantErr    string
+	}{
+		{"in order", []int{1, 2, 3}, false, []int{1, 2, 3}, "match", ""},
+		{"out of order", []int{3, 1, 5, 2, 4}, false, []int{1, 2, 3, 4, 5}, "match", ""},
+		{"gap of a cancelled run", []int{1, 3, 4}, true, []int{1}, "incomplete", ""},
+		{"gap", []int{1, 3, 4}, false, []int{1}, "", "2 chunks are not written, missing chunk index 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tab, recorder := newWorkerTable(len(tt.results))
+			if tt.cancelled {
+				tab.arg.run.cancel()
+			}
+
+			results := make(chan chunkResult, len(tt.results))
+			for _, idx := range tt.results {
+				tab.window <- struct{}{} // dispatched
+				results <- chunkResult{tci: workerChunk(idx)}
+			}
+			close(results)
+
+			ts, err := tab.WriteChunkResults(results, 1)
+
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %s", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if ts.Status != tt.wantStatus || ts.Chunks != len(tt.want) {
+				t.Errorf("status = %s, chunks = %d, want %s, %d", ts.Status, ts.Chunks, tt.wantStatus, len(tt.want))
+			}
+			if !reflect.DeepEqual(recorder.chunks, tt.want) {
+				t.Errorf("written chunks = %v, want %v", recorder.chunks, tt.want)
+			}
+			if len(tab.window) != len(tt.results)-len(tt.want) {
+				t.Errorf("chunk window holds %d chunks, want %d", len(tab.window), len(tt.results)-len(tt.want))
+			}
+		})
+	}
+} // }}}
+
+func TestRunChunkWorkers(t *testing.T) { // {{{
+	const parallel, chunks = 2, 20
+	windowsize := parallel * chunkWindowPerWorker
+
+	tab, recorder := newWorkerTable(parallel)
+
+	// chunk 1 is slow, later chunks finish before it
+	release := make(chan struct{})
+	diff := func(tci *tableChunkInfo) (*TableChunkRowsInfo, error) {
+		if tci.ChunkIdx == 1 {
+			<-release
+		} else {
+			time.Sleep(time.Duration(chunks-tci.ChunkIdx) * time.Millisecond)
+		}
+		return nil, nil
+	}
+
+	jobs := make(chan *tableChunkInfo, parallel)
+	results := tab.RunChunkWorkers(diff, jobs)
+
+	var dispatched atomic.Int32
+	go func() {
+		defer close(jobs)
+		for idx := 1; idx <= chunks; idx++ {
+			if !tab.dispatch(jobs, workerChunk(idx)) {
+				return
+			}
+			dispatched.Add(1)
+		}
+	}()
+
+	var ts *TableSummary
+	var err error
+	var waitgroup sync.WaitGroup
+	waitgroup.Add(1)
+	go func() {
+		defer waitgroup.Done()
+		ts, err = tab.WriteChunkResults(results, 1)
+	}()
+
+	// dispatch stops at the window while chunk 1 holds back the writer
+	deadline := time.Now().Add(5 * time.Second)
+	for int(dispatched.Load()) < windowsize && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := int(dispatched.Load()); n != windowsize {
+		t.Errorf("%d chunks dispatched while chunk 1 runs, want %d", n, windowsize)
+	}
+
+	close(release)
+	waitgroup.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]int, chunks)
+	for i := range want {
+		want[i] = i + 1
+	}
+	if !reflect.DeepEqual(recorder.chunks, want) {
+		t.Errorf("written chunks = %v, want %v", recorder.chunks, want)
+	}
+	if ts.Status != "match" || ts.Chunks != chunks {
+		t.Errorf("status = %s, chunks = %d, want match, %d", ts.Status, ts.Chunks, chunks)
+	}
+	if len(tab.window) != 0 {
+		t.Errorf("chunk window holds %d chunks after the table, want 0", len(tab.window))
+	}
+} // }}}
+
+func TestConnectionID(t *testing.T) { // {{{
+	// a random connection id per lookup, a cached id is looked up once
+	d := sqliteDialect()
+	d.killQuery, d.connectionIDQuery = "KILL QUERY %d", "SELECT abs(random())"
+	r := newRunner(context.Background(), discardLogger())
+
+	lookup := func(db *sql.DB) int64 {
+		t.Helper()
+		conn, e := db.Conn(context.Background())
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer conn.Close()
+		connectionid, e := r.connectionID(d, conn)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return connectionid
+	}
+
+	db := openSQLite(t)
+	first := lookup(db)
+	if again := lookup(db); again != first {
+		t.Errorf("connection id = %d for the same driver connection, want %d", again, first)
+	}
+	if other := lookup(openSQLite(t)); other == first {
+		t.Errorf("connection id = %d for another driver connection, want a new one", other)
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,267 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// progress : live progress line of the run, redrawn every second below the log lines on a terminal
+type progress struct { // {{{
+	mu         sync.Mutex
+	out        *os.File
+	start      time.Time
+	estimates  map[string]int64 // estimated source rows of each table
+	rows       int64            // source rows of the written chunks
+	chunks     int
+	mismatches int
+	line       string           // progress line on the terminal
+	loggers    []*logrus.Logger // loggers of out, logging through the progress line until stop
+	done       chan struct{}
+} // }}}
+
+// isTerminal : f is a terminal, not a file or pipe
+func isTerminal(f *os.File) bool { // {{{
+	fi, e := f.Stat()
+	return e == nil && fi.Mode()&os.ModeCharDevice != 0
+} // }}}
+
+// newProgress : draw the progress line on out every second until stop, log lines of loggers
+// writing to out go through the progress line. Loggers writing elsewhere are left as they are
+func newProgress(out *os.File, loggers ...*logrus.Logger) (p *progress) { // {{{
+	p = &progress{
+		out:       out,
+		start:     time.Now(),
+		estimates: map[string]int64{},
+		done:      make(chan struct{}),
+	}
+	for _, logger := range loggers {
+		if logger.Out == io.Writer(out) {
+			logger.SetOutput(p)
+			p.loggers = append(p.loggers, logger)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				p.draw(p.format())
+				p.mu.Unlock()
+			}
+		}
+	}()
+
+	return
+} // }}}
+
+// stop : clear the progress line and give the loggers their output out back
+func (p *progress) stop() { // {{{
+	if p == nil {
+		return
+	}
+	close(p.done)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw("")
+	for _, logger := range p.loggers {
+		logger.SetOutput(p.out)
+	}
+} // }}}
+
+// draw : replace the progress line on the terminal with line
+func (p *progress) draw(line string) { // {{{
+	if line == p.line {
+		return
+	}
+	fmt.Fprint(p.out, "\r\033[K"+line)
+	p.line = line
+} // }}}
+
+// Write : write log line b above the progress line
+func (p *progress) Write(b []byte) (int, error) { // {{{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	line := p.line
+	p.draw("")
+	n, e := p.out.Write(b)
+	p.draw(line)
+
+	return n, e
+} // }}}
+
+// setEstimate : estimated source rows of table, replacing its earlier estimate
+func (p *progress) setEstimate(table string, rows int64) { // {{{
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.estimates[table] = rows
+} // }}}
+
+// addChunk : count a written chunk
+func (p *progress) addChunk(tci *tableChunkInfo) { // {{{
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rows += int64(tci.RowcntSrc)
+	p.chunks++
+	if !tci.Match {
+		p.mismatches++
+	}
+} // }}}
+
+// format : progress line of rows diffed, throughput, mismatched chunks and ETA. Percentage and ETA
+// are left out without row estimates, and are capped as estimates may be below the actual rows
+func (p *progress) format() string { // {{{
+	var total int64
+	for _, rows := range p.estimates {
+		total += rows
+	}
+
+	elapsed := time.Since(p.start)
+	rate := float64(p.rows) / elapsed.Seconds()
+
+	line := fmt.Sprintf("[progress] %d", p.rows)
+	if total > 0 {
+		percent := 100 * float64(p.rows) / float64(total)
+		if percent > 99.9 {
+			percent = 99.9
+		}
+		line = fmt.Sprintf("[progress] %4.1f%% %d/~%d", percent, p.rows, total)
+	}
+	line += fmt.Sprintf(
+		" rows, %.0f rows/s, %d/%d chunks mismatched, elapsed %s",
+		rate, p.mismatches, p.chunks, elapsed.Round(time.Second),
+	)
+	if total > 0 && rate > 0 {
+		eta := time.Duration(float64(total-p.rows) / rate * float64(time.Second))
+		if eta < 0 {
+			eta = 0
+		}
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+
+	return line
+} // }}}
+
+// tableRows : rows of table in the table statistics, 0 if unknown
+func tableRows(ctx context.Context, db *DB, table string) (rows int64, err error) { // {{{
+	query := db.dialect.tableRowsQuery
+	if query == "" {
+		return 0, nil
+	}
+
+	err = db.QueryRowContext(ctx, query, table).Scan(&rows)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return
+} // }}}
+
+/*
+EstimateRows : estimated source rows of the diff, from the table statistics. A single integer key
+field also gives the size of its range within -l and -u, as rows of dense keys
+
+	SELECT MIN(pkfield), MAX(pkfield) FROM table
+
+the smaller estimate wins, stale statistics of 0 rows are ignored
+*/
+func (t *pkTable) EstimateRows(dbSrc *DB) (rows int64, err error) { // {{{
+	if rows, err = tableRows(t.arg.run.ctx, dbSrc, t.arg.ArgSrcTable); err != nil {
+		return
+	}
+
+	pkColumns := t.GetPKColumns()
+	if len(pkColumns) != 1 {
+		return
+	}
+	ft, isint := pkColumns[0].FieldType.(*fieldtypeInt)
+	if !isint {
+		return
+	}
+
+	query := `
+    SELECT SQL_NO_CACHE MIN(` + pkColumns[0].ColumnName + `), MAX(` + pkColumns[0].ColumnName + `)
+    FROM ` + t.arg.ArgSrcTable
+
+	t.arg.run.log.Traceln(query)
+
+	var minpk, maxpk sql.NullInt64
+	if err = dbSrc.QueryRowContext(t.arg.run.ctx, query).Scan(&minpk, &maxpk); err != nil {
+		return
+	}
+	if !minpk.Valid {
+		return 0, nil // empty table
+	}
+
+	lower, upper := minpk.Int64, maxpk.Int64
+	if t.arg.ArgLowerBoundary[0] != "" {
+		l, e := ft.transformFieldType(t.arg.ArgLowerBoundary[0])
+		if e != nil {
+			return 0, e
+		}
+		if l.(int64) > lower {
+			lower = l.(int64)
+		}
+	}
+	if t.arg.ArgUpperBoundary[0] != "" {
+		u, e := ft.transformFieldType(t.arg.ArgUpperBoundary[0])
+		if e != nil {
+			return 0, e
+		}
+		if u.(int64) < upper {
+			upper = u.(int64)
+		}
+	}
+
+	var keyrange int64
+	if upper >= lower {
+		keyrange = upper - lower + 1
+		if keyrange <= 0 { // overflow of the whole int64 range
+			return
+		}
+	}
+	if rows == 0 || keyrange < rows {
+		rows = keyrange
+	}
+
+	return
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,71 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestProgressLoggers(t *testing.T) { // {{{
+	out, e := os.Create(filepath.Join(t.TempDir(), "terminal"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer out.Close()
+
+	terminal := logrus.New()
+	terminal.SetOutput(out)
+	other := new(bytes.Buffer)
+	elsewhere := logrus.New()
+	elsewhere.SetOutput(other)
+
+	p := newProgress(out, terminal, elsewhere)
+	if terminal.Out != io.Writer(p) {
+		t.Errorf("logger of the terminal writes to %v, want the progress line", terminal.Out)
+	}
+	if elsewhere.Out != io.Writer(other) {
+		t.Errorf("logger of another output writes to %v, want its own output", elsewhere.Out)
+	}
+	terminal.Infoln("through the progress line")
+	elsewhere.Infoln("not on the terminal")
+
+	p.stop()
+	if terminal.Out != io.Writer(out) || elsewhere.Out != io.Writer(other) {
+		t.Errorf("outputs after stop = %v, %v, want the outputs before", terminal.Out, elsewhere.Out)
+	}
+
+	b, e := os.ReadFile(out.Name())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !strings.Contains(string(b), "through the progress line") || strings.Contains(string(b), "not on the terminal") {
+		t.Errorf("terminal = %q", b)
+	}
+	if !strings.Contains(other.String(), "not on the terminal") {
+		t.Errorf("other output = %q", other.String())
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,171 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// Snapshot : json marshalable consistent snapshot of one side the chunks are hashed in
+type Snapshot struct { // {{{
+	Timestamp  time.Time `json:"timestamp"`
+	BinlogFile string    `json:"binlogfile,omitempty"` // --snapshot-position of source
+	BinlogPos  uint64    `json:"binlogpos,omitempty"`
+	GTIDSet    string    `json:"gtidset,omitempty"`
+} // }}}
+
+// snapshotConn : dedicated connection of one side holding the consistent snapshot of the run, the
+// chunk queries of the side take turns on it
+type snapshotConn struct { // {{{
+	conn         *sql.Conn
+	connectionid int64
+	Snapshot
+} // }}}
+
+// snapshotConns : snapshot connections of source and target DB
+type snapshotConns struct { // {{{
+	src *snapshotConn
+	tgt *snapshotConn
+} // }}}
+
+// binlogPosition : binary log coordinates and executed GTID set of the server, empty if the binary
+// log is disabled
+func binlogPosition(ctx context.Context, conn *sql.Conn) (file string, pos uint64, gtidset string, err error) { // {{{
+	rows, err := conn.QueryContext(ctx, "SHOW BINARY LOG STATUS")
+	if err != nil { // before MySQL 8.2
+		rows, err = conn.QueryContext(ctx, "SHOW MASTER STATUS")
+	}
+	if err != nil {
+		return
+	}
+	defer closeErr(rows, &err)
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return
+	}
+
+	if !rows.Next() {
+		err = rows.Err()
+		return
+	}
+
+	vals := make([]any, len(columns))
+	for i := range vals {
+		vals[i] = new(sql.NullString)
+	}
+	if err = rows.Scan(vals...); err != nil {
+		return
+	}
+
+	for i, column := range columns {
+		value := vals[i].(*sql.NullString).String
+		switch column {
+		case "File":
+			file = value
+		case "Position":
+			if pos, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return
+			}
+		case "Executed_Gtid_Set":
+			gtidset = value
+		}
+	}
+
+	return
+} // }}}
+
+/*
+openSnapshot : start a consistent snapshot transaction on a dedicated connection of db. With
+position the binary log position is captured at the snapshot, under a global read lock held only
+while the snapshot starts, like mysqldump --single-transaction --source-data
+
+	FLUSH TABLES WITH READ LOCK
+	SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ
+	START TRANSACTION WITH CONSISTENT SNAPSHOT
+	SHOW BINARY LOG STATUS
+	UNLOCK TABLES
+
+Other engines start their snapshot transaction, position is MySQL only
+*/
+func openSnapshot(ctx context.Context, db *DB, position bool) (s *snapshotConn, err error) { // {{{
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// closing the connection also ends the read lock and the transaction
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+			s = nil
+		}
+	}()
+
+	s = &snapshotConn{conn: conn}
+	d := db.dialect
+
+	if s.connectionid, err = d.queryConnectionID(ctx, conn); err != nil {
+		return
+	}
+
+	if position {
+		if _, err = conn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+			return
+		}
+	}
+
+	for _, stmt := range d.snapshotStmts {
+		if _, err = conn.ExecContext(ctx, stmt); err != nil {
+			return
+		}
+	}
+	s.Timestamp = time.Now()
+
+	if position {
+		if s.BinlogFile, s.BinlogPos, s.GTIDSet, err = binlogPosition(ctx, conn); err != nil {
+			return
+		}
+
+		_, err = conn.ExecContext(ctx, "UNLOCK TABLES")
+	}
+
+	return
+} // }}}
+
+// close : end the snapshot transaction and give the connection back. Errors of a cancelled run are
+// ignored, its killed queries may have broken the connection
+func (s *snapshotConn) close(ctx context.Context) error { // {{{
+	_, erollback := s.conn.ExecContext(context.Background(), "ROLLBACK")
+	eclose := s.conn.Close()
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	if erollback != nil {
+		return erollback
+	}
+	return eclose
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,236 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// slowestChunks is the number of slowest chunks kept in table and run totals
+const slowestChunks = 5
+
+// TableSummary : json marshalable totals of a table run
+type TableSummary struct { // {{{
+	TableSrc       string      `json:"tablesrc"`
+	TableTgt       string      `json:"tabletgt"`
+	Status         string      `json:"status"` // match, mismatch, skipped or incomplete
+	Reason         string      `json:"reason,omitempty"`
+	Chunks         int         `json:"chunks"`
+	MatchChunks    int         `json:"matchchunks"`
+	MismatchChunks int         `json:"mismatchchunks"`
+	RowcntSrc      int         `json:"rowcntsrc"`
+	RowcntTgt      int         `json:"rowcnttgt"`
+	Insert         int         `json:"insert"`
+	Update         int         `json:"update"`
+	Delete         int         `json:"delete"`
+	ElapsedMs      int64       `json:"elapsedms"`    // wall clock
+	ElapsedMsSrc   int64       `json:"elapsedmssrc"` // chunk hash queries on source DB
+	ElapsedMsTgt   int64       `json:"elapsedmstgt"` // chunk hash queries on target DB
+	SlowestChunks  []SlowChunk `json:"slowestchunks,omitempty"`
+	Outputfile     string      `json:"outputfile,omitempty"`
+	RowLevelfile   string      `json:"rowlevelfile,omitempty"`
+	ResumeBoundary []any       `json:"resumeboundary,omitempty"` // upper boundary of the last written chunk of an incomplete table
+	Args           *TableArgs  `json:"args,omitempty"`           // effective args of the table
+} // }}}
+
+// SlowChunk : json marshalable chunk among the slowest chunks of a table or run
+type SlowChunk struct { // {{{
+	TableSrc      string `json:"tablesrc"`
+	ChunkIdx      int    `json:"chunkidx"`
+	LowerBoundary []any  `json:"lowerboundary"`
+	UpperBoundary []any  `json:"upperboundary"`
+	ElapsedMsSrc  int64  `json:"elapsedmssrc"`
+	ElapsedMsTgt  int64  `json:"elapsedmstgt"`
+} // }}}
+
+// RunSummary : json marshalable summary of all table runs
+type RunSummary struct { // {{{
+	Timestamp   time.Time       `json:"timestamp"`
+	SnapshotSrc *Snapshot       `json:"snapshotsrc,omitempty"` // --consistent-snapshot of the run
+	SnapshotTgt *Snapshot       `json:"snapshottgt,omitempty"`
+	Args        *RunArgs        `json:"args,omitempty"` // effective run level args
+	Tables      []*TableSummary `json:"tables"`
+	Totals      TableSummary    `json:"totals"`
+} // }}}
+
+// elapsedMs : elapsed of the slower side, the sides are hashed concurrently
+func (sc SlowChunk) elapsedMs() int64 { // {{{
+	if sc.ElapsedMsTgt > sc.ElapsedMsSrc {
+		return sc.ElapsedMsTgt
+	}
+	return sc.ElapsedMsSrc
+} // }}}
+
+// addSlowChunks : keep the slowest chunks of the totals and chunks
+func (ts *TableSummary) addSlowChunks(chunks ...SlowChunk) { // {{{
+	ts.SlowestChunks = append(ts.SlowestChunks, chunks...)
+	sort.SliceStable(ts.SlowestChunks, func(i, j int) bool {
+		return ts.SlowestChunks[i].elapsedMs() > ts.SlowestChunks[j].elapsedMs()
+	})
+	if len(ts.SlowestChunks) > slowestChunks {
+		ts.SlowestChunks = ts.SlowestChunks[:slowestChunks]
+	}
+} // }}}
+
+// addChunk : add chunk result to the table totals
+func (ts *TableSummary) addChunk(cr chunkResult) { // {{{
+	tci := cr.tci
+
+	ts.Chunks++
+	ts.RowcntSrc += tci.RowcntSrc
+	ts.RowcntTgt += tci.RowcntTgt
+	ts.ElapsedMsSrc += tci.ElapsedMsSrc
+	ts.ElapsedMsTgt += tci.ElapsedMsTgt
+
+	if tci.Match {
+		ts.MatchChunks++
+	} else {
+		ts.MismatchChunks++
+		ts.Status = "mismatch"
+	}
+
+	lower, upper := chunkBoundaries(tci)
+	ts.addSlowChunks(SlowChunk{
+		TableSrc:      tci.TableSrc,
+		ChunkIdx:      tci.ChunkIdx,
+		LowerBoundary: lower,
+		UpperBoundary: upper,
+		ElapsedMsSrc:  tci.ElapsedMsSrc,
+		ElapsedMsTgt:  tci.ElapsedMsTgt,
+	})
+
+	if cr.tcri != nil {
+		ts.Insert += len(cr.tcri.Diff.Insert)
+		ts.Update += len(cr.tcri.Diff.Update)
+		ts.Delete += len(cr.tcri.Diff.Delete)
+	}
+} // }}}
+
+// add : add table totals to the run totals
+func (ts *TableSummary) add(other *TableSummary) { // {{{
+	ts.Chunks += other.Chunks
+	ts.MatchChunks += other.MatchChunks
+	ts.MismatchChunks += other.MismatchChunks
+	ts.RowcntSrc += other.RowcntSrc
+	ts.RowcntTgt += other.RowcntTgt
+	ts.Insert += other.Insert
+	ts.Update += other.Update
+	ts.Delete += other.Delete
+	ts.ElapsedMsSrc += other.ElapsedMsSrc
+	ts.ElapsedMsTgt += other.ElapsedMsTgt
+	ts.addSlowChunks(other.SlowestChunks...)
+} // }}}
+
+// newRunSummary : summarize all table runs, elapsed of the totals is the wall clock of the run
+func newRunSummary(ts time.Time, tables []*TableSummary) (rs *RunSummary) { // {{{
+	rs = &RunSummary{
+		Timestamp: ts,
+		Tables:    tables,
+		Totals: TableSummary{
+			Status:    "match",
+			ElapsedMs: time.Since(ts).Milliseconds(),
+		},
+	}
+
+	for _, table := range tables {
+		rs.Totals.add(table)
+		if table.Status == "incomplete" {
+			rs.Totals.Status = "incomplete"
+		} else if table.Status != "match" && rs.Totals.Status != "incomplete" {
+			rs.Totals.Status = "mismatch"
+		}
+	}
+
+	return
+} // }}}
+
+// Print : print the run summary as text table to stdout, followed by the slowest chunks and the
+// effective args
+func (rs *RunSummary) Print() { // {{{
+	format := "%-30s %-30s %-10s %8s %8s %8s %12s %12s %8s %8s %8s %10s %12s %12s\n"
+
+	fmt.Printf(
+		format,
+		"tablesrc", "tabletgt", "status", "chunks", "match", "mismatch",
+		"rowcntsrc", "rowcnttgt", "insert", "update", "delete",
+		"elapsedms", "elapsedmssrc", "elapsedmstgt",
+	)
+	printrow := func(tablesrc string, tabletgt string, ts *TableSummary) {
+		fmt.Printf(
+			format,
+			tablesrc, tabletgt, ts.Status,
+			fmt.Sprint(ts.Chunks), fmt.Sprint(ts.MatchChunks), fmt.Sprint(ts.MismatchChunks),
+			fmt.Sprint(ts.RowcntSrc), fmt.Sprint(ts.RowcntTgt),
+			fmt.Sprint(ts.Insert), fmt.Sprint(ts.Update), fmt.Sprint(ts.Delete),
+			fmt.Sprint(ts.ElapsedMs), fmt.Sprint(ts.ElapsedMsSrc), fmt.Sprint(ts.ElapsedMsTgt),
+		)
+		if ts.Reason != "" {
+			fmt.Printf("  %s\n", ts.Reason)
+		}
+	}
+
+	for _, ts := range rs.Tables {
+		printrow(ts.TableSrc, ts.TableTgt, ts)
+	}
+	printrow("[total]", "", &rs.Totals)
+
+	if len(rs.Totals.SlowestChunks) > 0 {
+		fmt.Println("\nslowest chunks:")
+		for _, sc := range rs.Totals.SlowestChunks {
+			lb, _ := json.Marshal(sc.LowerBoundary)
+			ub, _ := json.Marshal(sc.UpperBoundary)
+			fmt.Printf(
+				"  %-30s [%5d] -l %v -u %v [ElapsedMsSrc: %d, ElapsedMsTgt: %d]\n",
+				sc.TableSrc, sc.ChunkIdx,
+				strings.Trim(string(lb), "[]"), strings.Trim(string(ub), "[]"),
+				sc.ElapsedMsSrc, sc.ElapsedMsTgt,
+			)
+		}
+	}
+
+	fmt.Println("\nargs:")
+	if rs.Args != nil {
+		fmt.Printf("  %s\n", argsLine(rs.Args))
+	}
+	for _, ts := range rs.Tables {
+		if ts.Args != nil {
+			fmt.Printf("  %-30s %s\n", ts.TableSrc, argsLine(ts.Args))
+		}
+	}
+} // }}}
+
+// WriteFile : write the run summary as json to summaryfile
+func (rs *RunSummary) WriteFile(summaryfile string) (err error) { // {{{
+	file, err := os.Create(summaryfile)
+	if err != nil {
+		return err
+	}
+	defer closeErr(file, &err)
+
+	encoder := json.NewEncoder(file)
+	encoder.SetEscapeHTML(false) // don't encode '>' char in hex
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(rs)
+} // }}}
+
+// vim: fdm=marker fdc=2
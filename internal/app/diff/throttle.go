@@ -0,0 +1,250 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// throttleProbeInterval is how long a load probe result is shared by the chunk workers
+const throttleProbeInterval = time.Second
+
+// throttleMaxBackoff caps the wait between load probes of an overloaded server
+const throttleMaxBackoff = 30 * time.Second
+
+// throttler : --sleep between chunks, and back off while the source DB or its replica is over the
+// load thresholds or the run is over --max-rows-per-second
+type throttler struct { // {{{
+	sleep             time.Duration
+	maxThreadsRunning int
+	maxReplicaLag     time.Duration
+	maxRowsPerSecond  int
+	dbSrc             *DB
+	dbReplica         *DB // nil without --replica
+	log               *logrus.Logger
+
+	mu         sync.Mutex
+	start      time.Time // rows budget of the run starts here
+	rows       int       // rows hashed by the run
+	probemu    sync.Mutex
+	lastProbe  time.Time
+	lastReason string
+} // }}}
+
+// enabled : whether any throttling is set
+func (th *throttler) enabled() bool { // {{{
+	return th.sleep > 0 || th.maxThreadsRunning > 0 || th.maxReplicaLag > 0 || th.maxRowsPerSecond > 0
+} // }}}
+
+// sleepContext : sleep d unless ctx is cancelled first, returns false if cancelled
+func sleepContext(ctx context.Context, d time.Duration) bool { // {{{
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+} // }}}
+
+// threadsRunning : Threads_running global status of db
+func threadsRunning(db *sql.DB) (threads int, err error) { // {{{
+	var name, value string
+	if err = db.QueryRow("SHOW GLOBAL STATUS LIKE 'Threads_running'").Scan(&name, &value); err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(value)
+} // }}}
+
+// replicaLag : Seconds_Behind_Source (Seconds_Behind_Master before MySQL 8.0.22) of db, running is
+// false if db is not replicating
+func replicaLag(db *sql.DB) (lag time.Duration, running bool, err error) { // {{{
+	rows, err := db.Query("SHOW REPLICA STATUS")
+	if err != nil { // older servers
+		rows, err = db.Query("SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer closeErr(rows, &err)
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !rows.Next() {
+		return 0, false, rows.Err()
+	}
+
+	vals := make([]any, len(columns))
+	for i := range vals {
+		vals[i] = new(sql.NullString)
+	}
+	if err = rows.Scan(vals...); err != nil {
+		return 0, false, err
+	}
+
+	for i, column := range columns {
+		if column != "Seconds_Behind_Source" && column != "Seconds_Behind_Master" {
+			continue
+		}
+
+		seconds := vals[i].(*sql.NullString)
+		if !seconds.Valid { // NULL while the replication threads are stopped
+			return
+		}
+
+		s, e := strconv.Atoi(seconds.String)
+		if e != nil {
+			return 0, false, e
+		}
+		return time.Duration(s) * time.Second, true, nil
+	}
+
+	return
+} // }}}
+
+// probe : reason the servers are over the load thresholds, empty if not. Results are shared for
+// throttleProbeInterval
+func (th *throttler) probe() (reason string, err error) { // {{{
+	th.probemu.Lock()
+	defer th.probemu.Unlock()
+
+	if time.Since(th.lastProbe) < throttleProbeInterval {
+		return th.lastReason, nil
+	}
+
+	if th.maxThreadsRunning > 0 {
+		threads, e := th.dbSrc.dialect.threadsRunning(th.dbSrc.DB)
+		if e != nil {
+			return "", e
+		}
+		if threads > th.maxThreadsRunning {
+			reason = fmt.Sprintf("threads_running %d > %d", threads, th.maxThreadsRunning)
+		}
+	}
+
+	if reason == "" && th.dbReplica != nil {
+		lag, running, e := th.dbReplica.dialect.replicaLag(th.dbReplica.DB)
+		if e != nil {
+			return "", e
+		}
+		if !running {
+			reason = "replica is not running"
+		} else if lag > th.maxReplicaLag {
+			reason = fmt.Sprintf("replica lag %v > %v", lag, th.maxReplicaLag)
+		}
+	}
+
+	th.lastProbe = time.Now()
+	th.lastReason = reason
+
+	return
+} // }}}
+
+// rowsDue : time the rows hashed so far are within --max-rows-per-second
+func (th *throttler) rowsDue() time.Time { // {{{
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	return th.start.Add(time.Duration(float64(th.rows) / float64(th.maxRowsPerSecond) * float64(time.Second)))
+} // }}}
+
+// wait : called by chunk workers before each chunk. Sleeps --sleep, then waits for the rows budget
+// and backs off while the servers are overloaded. Returns the time waited and the first overload
+// reason
+func (th *throttler) wait(ctx context.Context) (waited time.Duration, reason string, err error) { // {{{
+	if !th.enabled() {
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		waited = time.Since(start)
+	}()
+
+	if !sleepContext(ctx, th.sleep) {
+		return
+	}
+
+	if th.maxRowsPerSecond > 0 {
+		if due := th.rowsDue(); time.Now().Before(due) {
+			reason = fmt.Sprintf("rows per second > %d", th.maxRowsPerSecond)
+			if !sleepContext(ctx, time.Until(due)) {
+				return
+			}
+		}
+	}
+
+	if th.maxThreadsRunning <= 0 && th.dbReplica == nil {
+		return
+	}
+
+	backoff := throttleProbeInterval
+	for {
+		overload, e := th.probe()
+		if e != nil || overload == "" {
+			return waited, reason, e
+		}
+		if reason == "" {
+			reason = overload
+		}
+
+		th.log.Warnf("throttling: %s, retry in %v\n", overload, backoff)
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+
+		backoff = nextBackoff(backoff)
+	}
+} // }}}
+
+// nextBackoff : wait before the next load probe after waiting backoff, doubled up to
+// throttleMaxBackoff
+func nextBackoff(backoff time.Duration) time.Duration { // {{{
+	if backoff *= 2; backoff > throttleMaxBackoff {
+		return throttleMaxBackoff
+	}
+	return backoff
+} // }}}
+
+// done : account the source rows of a diffed chunk to --max-rows-per-second
+func (th *throttler) done(rows int) { // {{{
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	th.rows += rows
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,105 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package diff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRowsDue(t *testing.T) { // {{{
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		chunks           []int // source rows of the diffed chunks
+		maxRowsPerSecond int
+		want             time.Duration // after start
+	}{
+		{"no rows", nil, 100, 0},
+		{"one second", []int{100}, 100, time.Second},
+		{"chunks add up", []int{100, 50}, 100, 1500 * time.Millisecond},
+		{"fraction of a second", []int{1}, 4, 250 * time.Millisecond},
+		{"empty chunks", []int{0, 0}, 100, 0},
+		{"many rows", []int{1000000, 1000000}, 1000, 2000 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &throttler{maxRowsPerSecond: tt.maxRowsPerSecond, start: start}
+			for _, rows := range tt.chunks {
+				th.done(rows)
+			}
+
+			if got := th.rowsDue(); !got.Equal(start.Add(tt.want)) {
+				t.Errorf("rowsDue = start + %v, want start + %v", got.Sub(start), tt.want)
+			}
+		})
+	}
+} // }}}
+
+func TestNextBackoff(t *testing.T) { // {{{
+	tests := []struct {
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{throttleProbeInterval, 2 * time.Second},
+		{4 * time.Second, 8 * time.Second},
+		{15 * time.Second, throttleMaxBackoff},
+		{16 * time.Second, throttleMaxBackoff},
+		{throttleMaxBackoff, throttleMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := nextBackoff(tt.backoff); got != tt.want {
+			t.Errorf("nextBackoff(%v) = %v, want %v", tt.backoff, got, tt.want)
+		}
+	}
+
+	// the waits of an overloaded server: 1s, 2s, 4s, 8s, 16s then 30s on
+	want := []time.Duration{1, 2, 4, 8, 16, 30, 30, 30}
+	backoff := throttleProbeInterval
+	for i, w := range want {
+		if backoff != w*time.Second {
+			t.Fatalf("wait %d = %v, want %v", i+1, backoff, w*time.Second)
+		}
+		backoff = nextBackoff(backoff)
+	}
+} // }}}
+
+func TestThrottlerEnabled(t *testing.T) { // {{{
+	tests := []struct {
+		name string
+		th   *throttler
+		want bool
+	}{
+		{"none", &throttler{}, false},
+		{"sleep", &throttler{sleep: time.Millisecond}, true},
+		{"threads running", &throttler{maxThreadsRunning: 10}, true},
+		{"replica lag", &throttler{maxReplicaLag: time.Second}, true},
+		{"rows per second", &throttler{maxRowsPerSecond: 1000}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.th.enabled(); got != tt.want {
+			t.Errorf("%s: enabled = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
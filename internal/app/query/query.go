@@ -20,6 +20,7 @@ package query
 
 // Importing fmt package for the sake of printing
 import (
+	"bytes"
 	"diffchecker/internal/app/diff"
 	"diffchecker/internal/pkg/common"
 	"encoding/json"
@@ -27,6 +28,7 @@ import (
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
 )
 
 type envarg struct { // {{{
@@ -39,9 +41,6 @@ type envarg struct { // {{{
 // envArg is the package variable that holds the arg variables
 var envArg = envarg{}
 
-// envVar is the package variable that holds the environment variables
-var envVar = common.GetEnvVar()
-
 // ConsolidateTableRows : A struct to store multiple diff chunk json lines output
 type ConsolidateTableRows struct { // {{{
 	MapPKColumnValuesRows *map[string][]string // formated PK Column Values, 1 string per row
@@ -51,6 +50,7 @@ type ConsolidateTableRows struct { // {{{
 	AllPKColumnNames      []string
 	AllPKColumnQuotes     []string
 	FieldColumnNames      []string
+	MapFileValuesRows     *map[string][]string // formated values of a csv or parquet source, 1 string per insert or update row, nil for a DB source
 } // }}}
 
 func errorCheck(err error) { // {{{
@@ -79,17 +79,20 @@ func PopulateConsolidateTableRows(
 
 	inputLineBytes := readFromStdinOrFile(argRowlevelFile)
 
-	dbSrc := diff.InitializeDBSettings(
-		envVar.DfcSrcHost,
-		envVar.DfcSrcPort,
-		envVar.DfcSrcUsername,
-		envVar.DfcSrcPassword,
-		envVar.DfcSrcDbname,
-	)
+	// a csv or parquet source has the table definition of the target, its table was loaded from
+	// the file with the columns and key of the target table
+	connSrc, connTgt := diff.EnvConnections(common.GetEnvVar())
+	conn, fromtarget := connSrc, connSrc.IsFile()
+	if fromtarget {
+		conn = connTgt
+	}
+	db, e := diff.InitializeDBSettings(conn)
+	errorCheck(e)
 	defer func() {
-		e := dbSrc.Close()
+		e := db.Close()
 		errorCheck(e)
 	}()
+	var keyColumns, ignoreFields []string
 
 	// stores PK column value rows string 'value1',value2,'value3'...
 	mapPKColumnValuesRows := &map[string][]string{
@@ -161,7 +164,9 @@ func PopulateConsolidateTableRows(
 		// 	"textline: %v\n",
 		// 	string(input),
 		// )
-		e := json.Unmarshal(input, &tcri)
+		decoder := json.NewDecoder(bytes.NewReader(input))
+		decoder.UseNumber() // decimal and bigint pk values keep all digits
+		e := decoder.Decode(&tcri)
 		errorCheck(e)
 
 		if consolidateTableRows.TableSrc == "" {
@@ -170,21 +175,38 @@ func PopulateConsolidateTableRows(
 
 		if consolidateTableRows.TableTgt == "" {
 			consolidateTableRows.TableTgt = tcri.TableTgt
+			keyColumns = tcri.KeyColumns
+			ignoreFields = tcri.IgnoreFields
+		}
+
+		table := tcri.TableSrc
+		if fromtarget {
+			table = tcri.TableTgt
 		}
 
 		if consolidateTableRows.FieldColumnNames == nil {
-			consolidateTableRows.FieldColumnNames = diff.GetTableColumns(dbSrc, tcri.TableSrc)
+			columns, e := diff.GetTableColumns(db, table)
+			errorCheck(e)
+			for _, column := range columns {
+				// ignored columns may not be in the file, the target keeps their values
+				if !(fromtarget && contains(tcri.IgnoreFields, column)) {
+					consolidateTableRows.FieldColumnNames = append(consolidateTableRows.FieldColumnNames, column)
+				}
+			}
 		}
 
 		if consolidateTableRows.AllPKColumnNames == nil {
-			consolidateTableRows.AllPKColumnNames = diff.FindAllPKColumnNames(dbSrc, tcri.TableSrc)
+			consolidateTableRows.AllPKColumnNames, e = diff.FindAllPKColumnNames(db, table, tcri.KeyColumns)
+			errorCheck(e)
 		}
 
 		if consolidateTableRows.AllPKColumnQuotes == nil {
-			consolidateTableRows.AllPKColumnQuotes = diff.FindAllPKColumnQuotes(
-				dbSrc,
-				tcri.TableSrc,
+			consolidateTableRows.AllPKColumnQuotes, e = diff.FindAllPKColumnQuotes(
+				db,
+				table,
+				tcri.KeyColumns,
 			)
+			errorCheck(e)
 		}
 
 		populate("insert", tcri.Diff.Insert)
@@ -192,6 +214,10 @@ func PopulateConsolidateTableRows(
 		populate("delete", tcri.Diff.Delete)
 	}
 
+	if fromtarget && consolidateTableRows.TableSrc != "" {
+		consolidateTableRows.MapFileValuesRows = fileValuesRows(connSrc, db, consolidateTableRows, keyColumns, ignoreFields)
+	}
+
 	// fmt.Printf("insert: %v\n", (*consolidateTableRows.MapTableRows)["insert"])
 	// fmt.Printf("update: %v\n", (*consolidateTableRows.MapTableRows)["update"])
 	// fmt.Printf("delete: %v\n", (*consolidateTableRows.MapTableRows)["delete"])
@@ -199,6 +225,130 @@ func PopulateConsolidateTableRows(
 	return
 } // }}}
 
+// contains : s is one of values
+func contains(values []string, s string) bool { // {{{
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+} // }}}
+
+// fileValuesBatchSize is the max number of rows of a file source looked up by one query
+const fileValuesBatchSize = 500
+
+/*
+fileValuesRows : values of the insert and update rows of a csv or parquet source, its file is
+loaded like the diff run loaded it, shaped like the target table of dbTgt. Each row is formated
+as SQL literals by SQLite quote(), escaped for the engine of dbTgt. Rows are looked up in batches,
+the position of a row in its batch comes back with its values
+
+	SELECT d.column1, quote(s."field1"), quote(s."field2"), ..., quote(s."fieldn")
+	FROM (VALUES (0, ?, ..., ?), (1, ?, ..., ?), ...) AS d
+	INNER JOIN "table" AS s
+	ON s."pkfield1" = d.column2 AND ... AND s."pkfieldn" = d.column{n+1}
+*/
+func fileValuesRows(
+	connSrc diff.Connection,
+	dbTgt *diff.DB,
+	consolidateTableRows *ConsolidateTableRows,
+	keyColumns []string,
+	ignoreFields []string,
+) *map[string][]string { // {{{
+
+	dbSrc, e := diff.InitializeDBSettings(connSrc)
+	errorCheck(e)
+	defer func() {
+		e := dbSrc.Close()
+		errorCheck(e)
+	}()
+
+	e = diff.LoadFile(
+		dbSrc,
+		dbTgt,
+		consolidateTableRows.TableSrc,
+		consolidateTableRows.TableTgt,
+		keyColumns,
+		ignoreFields,
+		log.StandardLogger(),
+	)
+	errorCheck(e)
+
+	var fields, pkfields []string
+	for _, fieldname := range consolidateTableRows.FieldColumnNames {
+		fields = append(fields, `quote(s."`+fieldname+`")`)
+	}
+	for i, pkColumnName := range consolidateTableRows.AllPKColumnNames {
+		pkfields = append(pkfields, fmt.Sprintf(`s."%s" = d.column%d`, pkColumnName, i+2))
+	}
+	row := "(?" + strings.Repeat(", ?", len(pkfields)) + ")"
+
+	mapFileValuesRows := &map[string][]string{
+		"insert": {},
+		"update": {},
+	}
+	for crudtype := range *mapFileValuesRows {
+		allPKColumnValues := (*consolidateTableRows.MapPKColumnValues)[crudtype]
+		valuesRows := make([]string, len(allPKColumnValues))
+
+		for start := 0; start < len(allPKColumnValues); start += fileValuesBatchSize {
+			end := start + fileValuesBatchSize
+			if end > len(allPKColumnValues) {
+				end = len(allPKColumnValues)
+			}
+
+			var rows []string
+			var inputs []any
+			for i := start; i < end; i++ {
+				rows = append(rows, row)
+				inputs = append(append(inputs, i-start), allPKColumnValues[i]...)
+			}
+			query := fmt.Sprintf(
+				`SELECT d.column1, %s FROM (VALUES %s) AS d INNER JOIN "%s" AS s ON %s`,
+				strings.Join(fields, ", "),
+				strings.Join(rows, ", "),
+				consolidateTableRows.TableSrc,
+				strings.Join(pkfields, " AND "),
+			)
+
+			result, e := dbSrc.Query(query, inputs...)
+			errorCheck(e)
+			for result.Next() {
+				var i int
+				values := make([]string, len(fields))
+				dest := []any{&i}
+				for j := range values {
+					dest = append(dest, &values[j])
+				}
+				e = result.Scan(dest...)
+				errorCheck(e)
+
+				for j, value := range values {
+					values[j] = dbTgt.Literal(value)
+				}
+				valuesRows[start+i] = strings.Join(values, ",")
+			}
+			errorCheck(result.Err())
+			e = result.Close()
+			errorCheck(e)
+		}
+
+		for i, values := range valuesRows {
+			if values == "" {
+				errorCheck(fmt.Errorf(
+					"row (%s) is not in the file of table %s",
+					(*consolidateTableRows.MapPKColumnValuesRows)[crudtype][i],
+					consolidateTableRows.TableSrc,
+				))
+			}
+		}
+		(*mapFileValuesRows)[crudtype] = valuesRows
+	}
+
+	return mapFileValuesRows
+} // }}}
+
 // prepareSQLStatement : prepares sql statement based on diff crud results
 func prepareSQLStatement(
 	crudtype string,
@@ -223,6 +373,11 @@ func prepareSQLStatement(
 	}
 	//  └──────────────────────────────────────────────────────────────────────────────┘
 
+	// a csv or parquet source is no DB to select the rows from, its values are in the statement
+	if consolidateTableRows.MapFileValuesRows != nil && crudtype != "delete" {
+		return prepareFileSQLStatement(crudtype, consolidateTableRows, mapAllPKColumnValues)
+	}
+
 	mapDiffTable := &map[string]string{
 		"insert": tableSrc + "_diff_insert",
 		"update": tableSrc + "_diff_update",
@@ -351,6 +506,76 @@ func prepareSQLStatement(
 	return query
 } // }}}
 
+// prepareFileSQLStatement : prepares insert or update sql statement with the values of the rows
+// of a csv or parquet source
+func prepareFileSQLStatement(
+	crudtype string,
+	consolidateTableRows *ConsolidateTableRows,
+	mapAllPKColumnValues map[string]bool,
+) (query string) { // {{{
+
+	tableTgt := consolidateTableRows.TableTgt
+	fieldnames := consolidateTableRows.FieldColumnNames
+
+	var valuesRows []string
+	for _, value := range (*consolidateTableRows.MapFileValuesRows)[crudtype] {
+		valuesRows = append(valuesRows, fmt.Sprintf("(%s)", value))
+	}
+
+	switch crudtype {
+	case "insert":
+		query = fmt.Sprintf(`
+
+    -- target
+    INSERT INTO /*target*/ %s(
+      %s)
+    VALUES
+      %s;`,
+			tableTgt,
+			strings.Join(fieldnames, ",\n      "),
+			strings.Join(valuesRows, ",\n      "),
+		)
+
+	case "update":
+		for i, value := range valuesRows {
+			valuesRows[i] = "ROW" + value
+		}
+
+		updatefieldnames := []string{}
+		for _, fieldname := range fieldnames {
+			var v string
+			if mapAllPKColumnValues[fieldname] {
+				v = fmt.Sprintf("  -- /*PK*/ t.%s = s.%s", fieldname, fieldname)
+			} else {
+				v = fmt.Sprintf("  t.%s = s.%s", fieldname, fieldname)
+			}
+			updatefieldnames = append(updatefieldnames, v)
+		}
+
+		query = fmt.Sprintf(`
+
+    -- target
+    UPDATE /*target*/ %s AS t
+    INNER JOIN (
+      SELECT *
+      FROM (VALUES
+        %s
+        ) AS s(%s)
+      ) AS s
+    USING (%s)
+    SET
+    %s;`,
+			tableTgt,
+			strings.Join(valuesRows, ",\n        "),
+			strings.Join(fieldnames, ","),
+			strings.Join(consolidateTableRows.AllPKColumnNames, ","),
+			strings.Join(updatefieldnames, ",\n    "),
+		)
+	}
+
+	return
+} // }}}
+
 // GenerateSQL : Generate SQL statements
 func GenerateSQL() { // {{{
 
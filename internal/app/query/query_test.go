@@ -0,0 +1,157 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package query
+
+import (
+	"database/sql"
+	"diffchecker/internal/pkg/common"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFileSourceSQL : fixes of a csv source carry the values of the file rows, the source is no DB
+func TestFileSourceSQL(t *testing.T) { // {{{
+	// more inserts than a batch of lookups, in descending key order
+	manycsv, manyinserts, manyvalues := "id,name,note\n", []string{}, []string{}
+	for id := fileValuesBatchSize*2 + 10; id > 0; id-- {
+		manycsv += fmt.Sprintf("%d,n%d,\n", id, id)
+		manyinserts = append(manyinserts, fmt.Sprintf(`{"allpkcolumnvalues":[%d]}`, id))
+		manyvalues = append(manyvalues, fmt.Sprintf("%d,'n%d',NULL", id, id))
+	}
+
+	tests := []struct {
+		name       string
+		csv        string
+		rowlevel   string
+		wantFields []string
+		wantValues map[string][]string
+	}{
+		{
+			name: "insert and update",
+			csv:  "id,name,note\n1,it's,a\\b\n2,b,\n3,c,z\n",
+			rowlevel: `{"tablesrc":"emp","tabletgt":"emp","ignorefields":[""],"diff":{` +
+				`"insert":[{"allpkcolumnvalues":[3]}],` +
+				`"update":[{"allpkcolumnvalues":[1]},{"allpkcolumnvalues":[2]}],` +
+				`"delete":[{"allpkcolumnvalues":[4]}]}}`,
+			wantFields: []string{"id", "name", "note"},
+			wantValues: map[string][]string{
+				"insert": {`3,'c','z'`},
+				"update": {`1,'it''s','a\b'`, `2,'b',NULL`}, // SQLite reads backslashes as is
+			},
+		},
+		{
+			name: "ignored column not in the file",
+			csv:  "id,name\n1,a\n3,c\n",
+			rowlevel: `{"tablesrc":"emp","tabletgt":"emp","ignorefields":["note"],"diff":{` +
+				`"insert":[{"allpkcolumnvalues":[3]}],` +
+				`"update":[{"allpkcolumnvalues":[1]}],` +
+				`"delete":[]}}`,
+			wantFields: []string{"id", "name"},
+			wantValues: map[string][]string{
+				"insert": {`3,'c'`},
+				"update": {`1,'a'`},
+			},
+		},
+		{
+			name: "batches",
+			csv:  manycsv,
+			rowlevel: `{"tablesrc":"emp","tabletgt":"emp","ignorefields":[""],"diff":{` +
+				`"insert":[` + strings.Join(manyinserts, ",") + `],"update":[],"delete":[]}}`,
+			wantFields: []string{"id", "name", "note"},
+			wantValues: map[string][]string{"insert": manyvalues, "update": {}},
+		},
+	}
+
+	// the rowlevel file is read from stdin unless it is a terminal
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			csvfile := filepath.Join(dir, "emp.csv")
+			rowlevelfile := filepath.Join(dir, "emp.rowlevel.json")
+			dbfile := filepath.Join(dir, "tgt.db")
+			for file, content := range map[string]string{csvfile: tt.csv, rowlevelfile: tt.rowlevel + "\n"} {
+				if e := os.WriteFile(file, []byte(content), 0o600); e != nil {
+					t.Fatal(e)
+				}
+			}
+
+			db, e := sql.Open("sqlite", dbfile)
+			if e != nil {
+				t.Fatal(e)
+			}
+			_, e = db.Exec("CREATE TABLE emp (id INT, name VARCHAR(20), note VARCHAR(20), PRIMARY KEY (id))")
+			if e == nil {
+				_, e = db.Exec("INSERT INTO emp VALUES (1, 'a', NULL), (2, 'b', 'y'), (4, 'd', NULL)")
+			}
+			if e == nil {
+				e = db.Close()
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			for key, value := range map[string]string{
+				"DFC_SRC_DRIVER": "csv", "DFC_SRC_DBNAME": csvfile, "DFC_SRC_PARAMS": "null=",
+				"DFC_TGT_DRIVER": "sqlite", "DFC_TGT_DBNAME": dbfile, "DFC_TGT_PARAMS": "",
+				"DFC_SRC_DSN": "", "DFC_SRC_HOST": "", "DFC_TGT_DSN": "", "DFC_TGT_HOST": "",
+			} {
+				t.Setenv(key, value)
+			}
+			common.ParseEnvVar()
+
+			os.Stdin, e = os.Open(os.DevNull)
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer os.Stdin.Close()
+
+			consolidateTableRows := PopulateConsolidateTableRows(rowlevelfile)
+
+			if !reflect.DeepEqual(consolidateTableRows.FieldColumnNames, tt.wantFields) {
+				t.Errorf("FieldColumnNames = %v, want %v", consolidateTableRows.FieldColumnNames, tt.wantFields)
+			}
+			if consolidateTableRows.MapFileValuesRows == nil {
+				t.Fatal("MapFileValuesRows = nil, want the values of the file rows")
+			}
+			if !reflect.DeepEqual(*consolidateTableRows.MapFileValuesRows, tt.wantValues) {
+				t.Errorf("MapFileValuesRows = %v, want %v", *consolidateTableRows.MapFileValuesRows, tt.wantValues)
+			}
+
+			for crudtype, values := range tt.wantValues {
+				query := prepareSQLStatement(crudtype, consolidateTableRows)
+				if strings.Contains(query, "/*source*/") {
+					t.Errorf("%s reads the source table:\n%s", crudtype, query)
+				}
+				for _, value := range values {
+					if !strings.Contains(query, "("+value+")") {
+						t.Errorf("%s misses row (%s):\n%s", crudtype, value, query)
+					}
+				}
+			}
+		})
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,467 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package schema is a tool to diff table definitions of source and target DB
+package schema
+
+import (
+	"database/sql"
+	"diffchecker/internal/app/diff"
+	"diffchecker/internal/pkg/common"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+type envarg struct { // {{{
+	ArgSrcTable  string
+	ArgTgtTable  string
+	ArgAllTables bool
+	ArgFormat    string
+} // }}}
+
+// envArg is the package variable that holds the arg variables
+var envArg = envarg{}
+
+// columnDef : column definition from INFORMATION_SCHEMA.COLUMNS, NULL is not a valid value, e.g.
+// the default of a column without one
+type columnDef struct { // {{{
+	Name      string
+	Ordinal   sql.NullString
+	Type      sql.NullString
+	Nullable  sql.NullString
+	Default   sql.NullString
+	Charset   sql.NullString
+	Collation sql.NullString
+	Extra     sql.NullString
+} // }}}
+
+// indexDef : index definition from INFORMATION_SCHEMA.STATISTICS
+type indexDef struct { // {{{
+	Name    string
+	Unique  sql.NullString
+	Columns []string // prefix length in parenthesis, like name(10)
+	Type    sql.NullString
+} // }}}
+
+// tableDef : table definition of one side DB
+type tableDef struct { // {{{
+	Name    string
+	Exists  bool
+	Options map[string]sql.NullString
+	Columns []columnDef
+	Indexes []indexDef
+} // }}}
+
+// schemaDiff : json marshalable difference of one attribute, nil source or target means the
+// object is missing on that side
+type schemaDiff struct { // {{{
+	Object    string  `json:"object"` // table, option, column or index
+	Name      string  `json:"name"`
+	Attribute string  `json:"attribute,omitempty"`
+	Source    *string `json:"source"`
+	Target    *string `json:"target"`
+} // }}}
+
+// tableSchemaDiff : json marshalable differences of a source/target table pair
+type tableSchemaDiff struct { // {{{
+	TableSrc string       `json:"tablesrc"`
+	TableTgt string       `json:"tabletgt"`
+	Match    bool         `json:"match"`
+	Diffs    []schemaDiff `json:"diffs"`
+} // }}}
+
+// SetArgs : assign CLI arguments
+func SetArgs(
+	argTable string,
+	argSrcTable string,
+	argTgtTable string,
+	argAllTables bool,
+	argFormat string,
+) error { // {{{
+	if argFormat != "text" && argFormat != "json" {
+		return errors.New("--format should be text or json")
+	}
+	envArg.ArgFormat = argFormat
+	envArg.ArgAllTables = argAllTables
+
+	if argAllTables {
+		if argTable != "" || argSrcTable != "" || argTgtTable != "" {
+			return errors.New("--all-tables and --table/-s/-t are mutual exclusive")
+		}
+		return nil
+	}
+
+	if !((argTable != "" && argSrcTable == "" && argTgtTable == "") || (argTable == "" && argSrcTable != "" && argTgtTable != "")) {
+		return errors.New("--table or -s/-t is required, --table and -s/-t are mutual exclusive")
+	}
+
+	if argTable != "" {
+		envArg.ArgSrcTable = argTable
+		envArg.ArgTgtTable = argTable
+	} else {
+		envArg.ArgSrcTable = argSrcTable
+		envArg.ArgTgtTable = argTgtTable
+	}
+
+	return nil
+} // }}}
+
+// queryRows : run query with table as input, every row is scanned as strings, NULL is not valid
+func queryRows(db *sql.DB, query string, table string) (rows [][]sql.NullString, err error) { // {{{
+	result, e := db.Query(query, table)
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		if e := result.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	columns, e := result.Columns()
+	if e != nil {
+		return nil, e
+	}
+
+	for result.Next() {
+		row := make([]sql.NullString, len(columns))
+		vals := make([]any, len(columns))
+		for i := range vals {
+			vals[i] = &row[i]
+		}
+
+		if e := result.Scan(vals...); e != nil {
+			return nil, e
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, result.Err()
+} // }}}
+
+// text : printed value of an attribute, NULL apart from the text 'NULL'
+func text(v sql.NullString) string { // {{{
+	switch {
+	case !v.Valid:
+		return "NULL"
+	case v.String == "NULL":
+		return "'NULL'"
+	default:
+		return v.String
+	}
+} // }}}
+
+// getTableDef : read table options, columns and indexes of table from INFORMATION_SCHEMA
+func getTableDef(db *sql.DB, table string) (td *tableDef, err error) { // {{{
+	td = &tableDef{Name: table, Options: map[string]sql.NullString{}}
+
+	options, e := queryRows(db, `
+    SELECT SQL_NO_CACHE ENGINE, ROW_FORMAT, TABLE_COLLATION, CREATE_OPTIONS, TABLE_COMMENT
+    FROM INFORMATION_SCHEMA.TABLES
+    WHERE TABLE_SCHEMA = database()
+      AND TABLE_NAME = ?
+    `, table)
+	if e != nil || len(options) == 0 {
+		return td, e
+	}
+	td.Exists = true
+	for i, name := range []string{"engine", "row_format", "collation", "create_options", "comment"} {
+		td.Options[name] = options[0][i]
+	}
+
+	columns, e := queryRows(db, `
+    SELECT SQL_NO_CACHE
+      COLUMN_NAME, ORDINAL_POSITION, COLUMN_TYPE, IS_NULLABLE, COLUMN_DEFAULT,
+      CHARACTER_SET_NAME, COLLATION_NAME, EXTRA
+    FROM INFORMATION_SCHEMA.COLUMNS
+    WHERE TABLE_SCHEMA = database()
+      AND TABLE_NAME = ?
+    ORDER BY ORDINAL_POSITION
+    `, table)
+	if e != nil {
+		return nil, e
+	}
+	for _, row := range columns {
+		td.Columns = append(td.Columns, columnDef{
+			Name:      row[0].String,
+			Ordinal:   row[1],
+			Type:      row[2],
+			Nullable:  row[3],
+			Default:   row[4],
+			Charset:   row[5],
+			Collation: row[6],
+			Extra:     row[7],
+		})
+	}
+
+	indexes, e := queryRows(db, `
+    SELECT SQL_NO_CACHE INDEX_NAME, NON_UNIQUE, COLUMN_NAME, SUB_PART, INDEX_TYPE
+    FROM INFORMATION_SCHEMA.STATISTICS
+    WHERE TABLE_SCHEMA = database()
+      AND TABLE_NAME = ?
+    ORDER BY INDEX_NAME, SEQ_IN_INDEX
+    `, table)
+	if e != nil {
+		return nil, e
+	}
+	for _, row := range indexes {
+		column := row[2].String
+		if row[3].Valid {
+			column += "(" + row[3].String + ")"
+		}
+
+		if n := len(td.Indexes); n > 0 && td.Indexes[n-1].Name == row[0].String {
+			td.Indexes[n-1].Columns = append(td.Indexes[n-1].Columns, column)
+			continue
+		}
+
+		unique := sql.NullString{String: "YES", Valid: true}
+		if row[1].String != "0" {
+			unique.String = "NO"
+		}
+		td.Indexes = append(td.Indexes, indexDef{
+			Name:    row[0].String,
+			Unique:  unique,
+			Columns: []string{column},
+			Type:    row[4],
+		})
+	}
+
+	return
+} // }}}
+
+// compareTableDefs : differences between source and target table definitions
+func compareTableDefs(src *tableDef, tgt *tableDef) (diffs []schemaDiff) { // {{{
+	value := func(s string) *string {
+		return &s
+	}
+
+	attribute := func(object string, name string, attr string, vsrc sql.NullString, vtgt sql.NullString) {
+		if vsrc != vtgt {
+			diffs = append(diffs, schemaDiff{object, name, attr, value(text(vsrc)), value(text(vtgt))})
+		}
+	}
+	columns := func(i indexDef) sql.NullString {
+		return sql.NullString{String: strings.Join(i.Columns, ","), Valid: true}
+	}
+
+	if !src.Exists || !tgt.Exists {
+		d := schemaDiff{Object: "table", Name: src.Name}
+		if src.Exists {
+			d.Source = value("exists")
+		}
+		if tgt.Exists {
+			d.Target = value("exists")
+		}
+		return []schemaDiff{d}
+	}
+
+	optionNames := make([]string, 0, len(src.Options))
+	for name := range src.Options {
+		optionNames = append(optionNames, name)
+	}
+	sort.Strings(optionNames)
+	for _, name := range optionNames {
+		attribute("option", name, "", src.Options[name], tgt.Options[name])
+	}
+
+	// columns in source order, then columns only on target
+	columnsTgt := map[string]columnDef{}
+	for _, c := range tgt.Columns {
+		columnsTgt[c.Name] = c
+	}
+	columnsSrc := map[string]bool{}
+	for _, c := range src.Columns {
+		columnsSrc[c.Name] = true
+
+		ct, exists := columnsTgt[c.Name]
+		if !exists {
+			diffs = append(diffs, schemaDiff{"column", c.Name, "", value(text(c.Type)), nil})
+			continue
+		}
+		attribute("column", c.Name, "ordinal", c.Ordinal, ct.Ordinal)
+		attribute("column", c.Name, "type", c.Type, ct.Type)
+		attribute("column", c.Name, "nullable", c.Nullable, ct.Nullable)
+		attribute("column", c.Name, "default", c.Default, ct.Default)
+		attribute("column", c.Name, "charset", c.Charset, ct.Charset)
+		attribute("column", c.Name, "collation", c.Collation, ct.Collation)
+		attribute("column", c.Name, "extra", c.Extra, ct.Extra)
+	}
+	for _, c := range tgt.Columns {
+		if !columnsSrc[c.Name] {
+			diffs = append(diffs, schemaDiff{"column", c.Name, "", nil, value(text(c.Type))})
+		}
+	}
+
+	indexesTgt := map[string]indexDef{}
+	for _, i := range tgt.Indexes {
+		indexesTgt[i.Name] = i
+	}
+	indexesSrc := map[string]bool{}
+	for _, i := range src.Indexes {
+		indexesSrc[i.Name] = true
+
+		it, exists := indexesTgt[i.Name]
+		if !exists {
+			diffs = append(diffs, schemaDiff{"index", i.Name, "", value(strings.Join(i.Columns, ",")), nil})
+			continue
+		}
+		attribute("index", i.Name, "unique", i.Unique, it.Unique)
+		attribute("index", i.Name, "columns", columns(i), columns(it))
+		attribute("index", i.Name, "type", i.Type, it.Type)
+	}
+	for _, i := range tgt.Indexes {
+		if !indexesSrc[i.Name] {
+			diffs = append(diffs, schemaDiff{"index", i.Name, "", nil, value(strings.Join(i.Columns, ","))})
+		}
+	}
+
+	return
+} // }}}
+
+// tablePairs : source/target table pairs to compare, with --all-tables base tables of both DBs
+func tablePairs(dbSrc *diff.DB, dbTgt *diff.DB) (pairs [][2]string, err error) { // {{{
+	if !envArg.ArgAllTables {
+		return [][2]string{{envArg.ArgSrcTable, envArg.ArgTgtTable}}, nil
+	}
+
+	tables := map[string]bool{}
+	for _, db := range []*diff.DB{dbSrc, dbTgt} {
+		basetables, e := diff.GetBaseTables(db)
+		if e != nil {
+			return nil, e
+		}
+		for _, table := range basetables {
+			tables[table] = true
+		}
+	}
+
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	for _, table := range names {
+		pairs = append(pairs, [2]string{table, table})
+	}
+
+	return
+} // }}}
+
+// printText : print differences as text, one line per difference
+func printText(results []*tableSchemaDiff) { // {{{
+	show := func(v *string) string {
+		if v == nil {
+			return "<missing>"
+		}
+		return *v
+	}
+
+	format := "  %-8s %-30s %-15s %-30s %s\n"
+
+	for _, ts := range results {
+		if ts.Match {
+			fmt.Printf("%s -> %s: match\n", ts.TableSrc, ts.TableTgt)
+			continue
+		}
+
+		fmt.Printf("%s -> %s: %d differences\n", ts.TableSrc, ts.TableTgt, len(ts.Diffs))
+		fmt.Printf(format, "object", "name", "attribute", "source", "target")
+		for _, d := range ts.Diffs {
+			fmt.Printf(format, d.Object, d.Name, d.Attribute, show(d.Source), show(d.Target))
+		}
+	}
+} // }}}
+
+// DiffSchema : compare table definitions of source and target DB, print the differences
+func DiffSchema() (err error) { // {{{
+	connSrc, connTgt := diff.EnvConnections(common.GetEnvVar())
+	for _, c := range []diff.Connection{connSrc, connTgt} {
+		if c.Driver != "" && c.Driver != "mysql" {
+			return fmt.Errorf("schema diff supports MySQL compatible DBs only, not DRIVER %s", c.Driver)
+		}
+	}
+
+	dbSrc, err := diff.InitializeDBSettings(connSrc)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := dbSrc.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	dbTgt, err := diff.InitializeDBSettings(connTgt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := dbTgt.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	pairs, err := tablePairs(dbSrc, dbTgt)
+	if err != nil {
+		return err
+	}
+
+	var results []*tableSchemaDiff
+	for _, pair := range pairs {
+		src, e := getTableDef(dbSrc.DB, pair[0])
+		if e != nil {
+			return e
+		}
+		tgt, e := getTableDef(dbTgt.DB, pair[1])
+		if e != nil {
+			return e
+		}
+
+		diffs := compareTableDefs(src, tgt)
+		if diffs == nil {
+			diffs = []schemaDiff{}
+		}
+		results = append(results, &tableSchemaDiff{
+			TableSrc: pair[0],
+			TableTgt: pair[1],
+			Match:    len(diffs) == 0,
+			Diffs:    diffs,
+		})
+	}
+
+	if envArg.ArgFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false) // don't encode '>' char in hex
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	printText(results)
+
+	return
+} // }}}
+
+// vim: fdm=marker fdc=2
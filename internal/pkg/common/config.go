@@ -0,0 +1,179 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// ConnConfig : connection settings of one side DB in job config file
+type ConnConfig struct { // {{{
+	Host         string            `yaml:"host"`
+	Port         string            `yaml:"port"`
+	Username     string            `yaml:"username"`
+	Password     string            `yaml:"password"`
+	Dbname       string            `yaml:"dbname"`
+	Driver       string            `yaml:"driver"`
+	Dsn          string            `yaml:"dsn"`
+	Socket       string            `yaml:"socket"`
+	TLSMode      string            `yaml:"tls-mode"`
+	TLSCA        string            `yaml:"tls-ca"`
+	TLSCert      string            `yaml:"tls-cert"`
+	TLSKey       string            `yaml:"tls-key"`
+	Timeout      string            `yaml:"timeout"`
+	ReadTimeout  string            `yaml:"read-timeout"`
+	WriteTimeout string            `yaml:"write-timeout"`
+	Params       map[string]string `yaml:"params"`
+} // }}}
+
+// JobConfig : job config file, flag values are keyed by flag long names
+type JobConfig struct { // {{{
+	Source ConnConfig       `yaml:"source"`
+	Target ConnConfig       `yaml:"target"`
+	Diff   map[string]any   `yaml:"diff"`   // diff flags, defaults of every table
+	Tables []map[string]any `yaml:"tables"` // diff flags per table
+	Query  map[string]any   `yaml:"query"`  // query flags
+} // }}}
+
+// LoadJobConfig : read job config file, connection settings become defaults of the DFC_SRC_* and
+// DFC_TGT_* environment variables
+func LoadJobConfig(configfile string) (jc *JobConfig) { // {{{
+	b, e := os.ReadFile(configfile)
+	if e != nil {
+		log.Fatalf("read config file error: %v", e)
+	}
+
+	jc = new(JobConfig)
+	decoder := yaml.NewDecoder(strings.NewReader(string(b)))
+	decoder.KnownFields(true)
+	if e = decoder.Decode(jc); e != nil {
+		log.Fatalf("parse config file %s error: %v", configfile, e)
+	}
+
+	setEnvVarDefault := func(key string, value string) {
+		if _, isset := os.LookupEnv(key); !isset && value != "" {
+			e := os.Setenv(key, value)
+			if e != nil {
+				log.Fatalf("set %s error: %v", key, e)
+			}
+		}
+	}
+
+	for prefix, cc := range map[string]ConnConfig{"DFC_SRC_": jc.Source, "DFC_TGT_": jc.Target} {
+		setEnvVarDefault(prefix+"USERNAME", cc.Username)
+		setEnvVarDefault(prefix+"PASSWORD", cc.Password)
+		setEnvVarDefault(prefix+"HOST", cc.Host)
+		setEnvVarDefault(prefix+"PORT", cc.Port)
+		setEnvVarDefault(prefix+"DBNAME", cc.Dbname)
+		setEnvVarDefault(prefix+"DRIVER", cc.Driver)
+		setEnvVarDefault(prefix+"DSN", cc.Dsn)
+		setEnvVarDefault(prefix+"SOCKET", cc.Socket)
+		setEnvVarDefault(prefix+"TLS_MODE", cc.TLSMode)
+		setEnvVarDefault(prefix+"TLS_CA", cc.TLSCA)
+		setEnvVarDefault(prefix+"TLS_CERT", cc.TLSCert)
+		setEnvVarDefault(prefix+"TLS_KEY", cc.TLSKey)
+		setEnvVarDefault(prefix+"TIMEOUT", cc.Timeout)
+		setEnvVarDefault(prefix+"READ_TIMEOUT", cc.ReadTimeout)
+		setEnvVarDefault(prefix+"WRITE_TIMEOUT", cc.WriteTimeout)
+
+		params := url.Values{}
+		for name, value := range cc.Params {
+			params.Set(name, value)
+		}
+		setEnvVarDefault(prefix+"PARAMS", params.Encode())
+	}
+
+	return
+} // }}}
+
+// ChangedFlags : names of flags explicitly set on command line
+func ChangedFlags(flags *pflag.FlagSet) (changed map[string]bool) { // {{{
+	changed = map[string]bool{}
+	flags.Visit(func(f *pflag.Flag) {
+		changed[f.Name] = true
+	})
+	return
+} // }}}
+
+// ResetFlags : set flags back to their defaults, except flags set on command line
+func ResetFlags(flags *pflag.FlagSet, changed map[string]bool) { // {{{
+	flags.VisitAll(func(f *pflag.Flag) {
+		if !changed[f.Name] {
+			e := f.Value.Set(f.DefValue)
+			if e != nil {
+				log.Fatalf("reset flag --%s error: %v", f.Name, e)
+			}
+		}
+	})
+} // }}}
+
+// ApplyFlagValues : set flags from config file values, flags set on command line are kept. Lists
+// are joined by commas
+func ApplyFlagValues(
+	flags *pflag.FlagSet,
+	changed map[string]bool,
+	values map[string]any,
+	section string,
+) { // {{{
+	// sorted for deterministic error messages
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if flags.Lookup(name) == nil {
+			log.Fatalf("unknown flag %s in %s section of config file", name, section)
+		}
+		if changed[name] {
+			continue
+		}
+
+		var value string
+		switch v := values[name].(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		case nil:
+			value = ""
+		case time.Time: // unquoted dates and timestamps
+			value = v.Format("2006-01-02T15:04:05-07:00")
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		if e := flags.Set(name, value); e != nil {
+			log.Fatalf("invalid value %s of %s in %s section of config file: %v", value, name, section, e)
+		}
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,122 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// testFlags : flags of the types used by diff and query, set from args like the command line
+func testFlags(t *testing.T, args ...string) *pflag.FlagSet { // {{{
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringP("table", "s", "", "")
+	flags.Int("chunk-size", 1000, "")
+	flags.Bool("debug", false, "")
+	flags.StringSlice("ignore-fields", []string{}, "")
+	flags.Duration("recheck-delay", 5*time.Second, "")
+	flags.String("lower-boundary", "", "")
+	flags.String("upper-boundary", "", "")
+	if e := flags.Parse(args); e != nil {
+		t.Fatal(e)
+	}
+	return flags
+} // }}}
+
+func TestApplyFlagValues(t *testing.T) { // {{{
+	tests := []struct {
+		name   string
+		args   []string // command line
+		config string   // yaml section
+		want   map[string]string
+	}{
+		{
+			name:   "scalars",
+			config: "table: emp\nchunk-size: 500\ndebug: true\nrecheck-delay: 10s",
+			want:   map[string]string{"table": "emp", "chunk-size": "500", "debug": "true", "recheck-delay": "10s"},
+		},
+		{
+			name:   "list joined by commas",
+			config: "ignore-fields: [note, hired]",
+			want:   map[string]string{"ignore-fields": "[note,hired]"},
+		},
+		{
+			name:   "list of numbers",
+			config: "lower-boundary: [1, 20]",
+			want:   map[string]string{"lower-boundary": "1,20"},
+		},
+		{
+			name:   "null is empty",
+			config: "table: null",
+			want:   map[string]string{"table": ""},
+		},
+		{
+			name:   "unquoted timestamp",
+			config: "upper-boundary: 2023-01-02T03:04:05Z",
+			want:   map[string]string{"upper-boundary": "2023-01-02T03:04:05+00:00"},
+		},
+		{
+			name:   "command line wins",
+			args:   []string{"--chunk-size", "20", "-s", "dept"},
+			config: "table: emp\nchunk-size: 500\ndebug: true",
+			want:   map[string]string{"table": "dept", "chunk-size": "20", "debug": "true"},
+		},
+		{
+			name:   "defaults kept",
+			config: "table: emp",
+			want:   map[string]string{"table": "emp", "chunk-size": "1000", "debug": "false", "recheck-delay": "5s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var values map[string]any
+			if e := yaml.Unmarshal([]byte(tt.config), &values); e != nil {
+				t.Fatal(e)
+			}
+			flags := testFlags(t, tt.args...)
+
+			ApplyFlagValues(flags, ChangedFlags(flags), values, "diff")
+
+			for name, want := range tt.want {
+				if got := flags.Lookup(name).Value.String(); got != want {
+					t.Errorf("--%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+} // }}}
+
+func TestResetFlags(t *testing.T) { // {{{
+	flags := testFlags(t, "--chunk-size", "20")
+	ApplyFlagValues(flags, ChangedFlags(flags), map[string]any{"table": "emp", "chunk-size": 500}, "tables")
+
+	ResetFlags(flags, map[string]bool{"chunk-size": true})
+
+	for name, want := range map[string]string{"table": "", "chunk-size": "20"} {
+		if got := flags.Lookup(name).Value.String(); got != want {
+			t.Errorf("--%s = %q, want %q", name, got, want)
+		}
+	}
+} // }}}
+
+// vim: fdm=marker fdc=2
@@ -0,0 +1,62 @@
+/*
+Copyright © 2023 Rick Sun
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+Package diffchecker diffs two MySQL compatible database tables from Go code, the same run as the
+diff command without its flags, environment variables and exits:
+
+	checker, err := diffchecker.New(diffchecker.Options{
+		TableOptions: diffchecker.TableOptions{Table: "employees", ChunkSize: 1000, Output: "employees.json"},
+		Source:       diffchecker.Connection{Host: "127.0.0.1", Port: "3306", Username: "root", DBName: "src"},
+		Target:       diffchecker.Connection{Host: "127.0.0.1", Port: "3306", Username: "root", DBName: "tgt"},
+	})
+	if err != nil {
+		return err
+	}
+	summary, err := checker.Run(ctx)
+*/
+package diffchecker
+
+import "diffchecker/internal/app/diff"
+
+// Connection : connection settings of source or target DB of Driver mysql or postgres, host and
+// port, unix socket or a raw DSN, with TLS, timeouts and extra DSN parameters. A sqlite DB is the
+// database file of DBName, as is a csv or parquet file diffed against the table of the other side
+type Connection = diff.Connection
+
+// TableOptions : options of one table diff, flags of the diff command with the same names
+type TableOptions = diff.TableOptions
+
+// Options : options of a diff run
+type Options = diff.Options
+
+// Checker : validated options of a diff run
+type Checker = diff.Checker
+
+// TableSummary : totals of a table run
+type TableSummary = diff.TableSummary
+
+// RunSummary : totals of every table of the run
+type RunSummary = diff.RunSummary
+
+// New : validate opts, returns error instead of exiting on invalid options. Nothing is connected
+// or written until (*Checker).Run
+func New(opts Options) (*Checker, error) { // {{{
+	return diff.New(opts)
+} // }}}
+
+// vim: fdm=marker fdc=2